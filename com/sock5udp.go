@@ -0,0 +1,143 @@
+package Com
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// max size of udp datagram
+	MaxUdpPackageSize = 65535
+	// high bit of frag marks the last fragment of sequence
+	Sock5FragEnd = 0x80
+	// RFC1928 reassembly timer should be no less than 5 seconds
+	DefaultFragTimeout = 5 * time.Second
+)
+
+// sock5 udp package, data may be a fragment when frag is not zero
+type DataPackage struct {
+	Addr net.Addr
+	Frag byte
+	Data []byte
+}
+
+// marshal data, addr may be ipv4, ipv6 or domain
+func MarshalPackage(pkg DataPackage) ([]byte, error) {
+	/*
+			sock5 udp data
+		   +-----+------+------+----------+----------+----------+
+		   | RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+		   +-----+------+------+----------+----------+----------+
+		   |  2  |  1   |  1   | Variable |    2     | Variable |
+		   +-----+------+------+----------+----------+----------+
+	*/
+	addr, err := MarshalSock5Addr(pkg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	size := 3 + len(addr) + len(pkg.Data)
+	if size > MaxUdpPackageSize {
+		return nil, fmt.Errorf("udp package is too large, size: %d", size)
+	}
+	buf := make([]byte, 3, size)
+	buf[2] = pkg.Frag
+	buf = append(buf, addr...)
+	buf = append(buf, pkg.Data...)
+	return buf, nil
+}
+
+// unmarshal data, addr may be ipv4, ipv6 or domain, data refers to msg
+func UnMarshalPackage(msg []byte) (DataPackage, error) {
+	// rsv(2) frag(1), rsv is ignored
+	if len(msg) < 3 {
+		return DataPackage{}, errors.New("udp package is too short")
+	}
+	if len(msg) > MaxUdpPackageSize {
+		return DataPackage{}, fmt.Errorf("udp package is too large, size: %d", len(msg))
+	}
+	reader := bytes.NewReader(msg[3:])
+	addr, err := ReadSock5Addr(reader, "udp")
+	if err != nil {
+		return DataPackage{}, fmt.Errorf("udp package addr is invalid, err: %v", err)
+	}
+	if domain, ok := addr.(*DomainAddr); ok && domain.Domain == "" {
+		return DataPackage{}, errors.New("udp package domain is empty")
+	}
+	return DataPackage{
+		Addr: addr,
+		Frag: msg[2],
+		Data: msg[len(msg)-reader.Len():],
+	}, nil
+}
+
+// reassemble fragments of one sequence, fragment out of order is dropped with the whole queue
+/*
+	frag 1 -> frag 2 -> frag 3|0x80   complete
+	frag 1 -> frag 3                  gap, queue dropped
+	frag 1 -> frag 2 -> frag 1        new sequence, old queue dropped
+	frag 1 -> ... timeout             queue dropped
+*/
+type Sock5Reassembler struct {
+	timeout time.Duration
+
+	// current sequence
+	addr     string
+	pos      byte
+	deadline time.Time
+	size     int
+	frags    [][]byte
+}
+
+// create reassembler, timeout less than 5 seconds is reset to default
+func NewSock5Reassembler(timeout time.Duration) *Sock5Reassembler {
+	if timeout < DefaultFragTimeout {
+		timeout = DefaultFragTimeout
+	}
+	return &Sock5Reassembler{timeout: timeout}
+}
+
+// push package, complete package is returned when standalone or last fragment arrived
+func (r *Sock5Reassembler) Push(pkg DataPackage) (DataPackage, bool) {
+	// standalone package
+	if pkg.Frag == 0 {
+		return pkg, true
+	}
+	pos := pkg.Frag &^ Sock5FragEnd
+	now := time.Now()
+	if r.frags != nil && (now.After(r.deadline) || pos != r.pos+1 || pkg.Addr.String() != r.addr) {
+		r.reset()
+	}
+	if r.frags == nil {
+		// sequence begin with position 1
+		if pos != 1 {
+			return DataPackage{}, false
+		}
+		r.addr = pkg.Addr.String()
+		r.deadline = now.Add(r.timeout)
+	}
+	r.size += len(pkg.Data)
+	if r.size > MaxUdpPackageSize {
+		r.reset()
+		return DataPackage{}, false
+	}
+	// data may refer to read buffer
+	r.frags = append(r.frags, append([]byte(nil), pkg.Data...))
+	r.pos = pos
+	if pkg.Frag&Sock5FragEnd == 0 {
+		return DataPackage{}, false
+	}
+	data := bytes.Join(r.frags, nil)
+	r.reset()
+	return DataPackage{Addr: pkg.Addr, Data: data}, true
+}
+
+// drop current sequence
+func (r *Sock5Reassembler) reset() {
+	r.addr = ""
+	r.pos = 0
+	r.size = 0
+	r.frags = nil
+}
@@ -0,0 +1,128 @@
+package Com
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMarshalPackage(t *testing.T) {
+	tests := []struct {
+		addr   net.Addr
+		header []byte
+	}{
+		{&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53},
+			[]byte{0, 0, 0, Sock5IPv4, 1, 2, 3, 4, 0, 53}},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+			[]byte{0, 0, 0, Sock5IPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 0xbb}},
+		{NewDomainAddr("udp", "example.com", 443),
+			append(append([]byte{0, 0, 0, Sock5Domain, 11}, "example.com"...), 1, 0xbb)},
+	}
+	data := []byte("data")
+	for _, test := range tests {
+		msg, err := MarshalPackage(DataPackage{Addr: test.addr, Data: data})
+		if err != nil {
+			t.Fatalf("marshal %v failed, err: %v", test.addr, err)
+		}
+		if !bytes.Equal(msg, append(test.header, data...)) {
+			t.Errorf("marshal %v is %v, want %v", test.addr, msg, append(test.header, data...))
+		}
+		pkg, err := UnMarshalPackage(msg)
+		if err != nil {
+			t.Fatalf("unmarshal %v failed, err: %v", test.addr, err)
+		}
+		if pkg.Addr.String() != test.addr.String() || !bytes.Equal(pkg.Data, data) {
+			t.Errorf("unmarshal is %v %q, want %v %q", pkg.Addr, pkg.Data, test.addr, data)
+		}
+	}
+
+	// 64KiB datagram
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+	large := make([]byte, MaxUdpPackageSize-10)
+	msg, err := MarshalPackage(DataPackage{Addr: addr, Data: large})
+	if err != nil || len(msg) != MaxUdpPackageSize {
+		t.Errorf("marshal max package failed, size: %d, err: %v", len(msg), err)
+	}
+	_, err = MarshalPackage(DataPackage{Addr: addr, Data: append(large, 0)})
+	if err == nil {
+		t.Error("marshal package larger than max size should fail")
+	}
+	// truncated header
+	for _, msg := range [][]byte{{0, 0}, {0, 0, 0, Sock5IPv6, 1, 2, 3, 4, 0, 53}, {0, 0, 0, Sock5Domain, 0, 0, 53}, {0, 0, 0, 2}} {
+		_, err = UnMarshalPackage(msg)
+		if err == nil {
+			t.Errorf("unmarshal %v should fail", msg)
+		}
+	}
+}
+
+func TestSock5Reassembler(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+	push := func(r *Sock5Reassembler, frag byte, data string) (string, bool) {
+		pkg, ok := r.Push(DataPackage{Addr: addr, Frag: frag, Data: []byte(data)})
+		return string(pkg.Data), ok
+	}
+	r := NewSock5Reassembler(0)
+	if data, ok := push(r, 0, "standalone"); !ok || data != "standalone" {
+		t.Errorf("standalone package is %q %v", data, ok)
+	}
+	// complete sequence
+	push(r, 1, "a")
+	push(r, 2, "b")
+	if data, ok := push(r, 3|Sock5FragEnd, "c"); !ok || data != "abc" {
+		t.Errorf("reassembled package is %q %v, want abc", data, ok)
+	}
+	// gap drop queue
+	push(r, 1, "a")
+	if _, ok := push(r, 3|Sock5FragEnd, "c"); ok {
+		t.Error("sequence with gap should be dropped")
+	}
+	// lower position begin new sequence
+	push(r, 1, "a")
+	push(r, 2, "b")
+	push(r, 1, "x")
+	if data, ok := push(r, 2|Sock5FragEnd, "y"); !ok || data != "xy" {
+		t.Errorf("restarted package is %q %v, want xy", data, ok)
+	}
+	// timer expired
+	push(r, 1, "a")
+	r.deadline = time.Now().Add(-time.Second)
+	if _, ok := push(r, 2|Sock5FragEnd, "b"); ok {
+		t.Error("expired sequence should be dropped")
+	}
+	// reassembled package can not exceed max size
+	large := string(make([]byte, MaxUdpPackageSize/2+1))
+	push(r, 1, large)
+	if _, ok := push(r, 2|Sock5FragEnd, large); ok {
+		t.Error("package larger than max size should be dropped")
+	}
+}
+
+func FuzzUnMarshalPackage(f *testing.F) {
+	f.Add([]byte{0, 0, 0, Sock5IPv4, 1, 2, 3, 4, 0, 53, 'a'})
+	f.Add([]byte{0, 0, 0x81, Sock5IPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53})
+	f.Add(append([]byte{0, 0, 0, Sock5Domain, 11}, "example.com\x01\xbbdata"...))
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		pkg, err := UnMarshalPackage(msg)
+		if err != nil {
+			return
+		}
+		// marshal again, domain may be normalized
+		buf, err := MarshalPackage(pkg)
+		if err != nil {
+			if _, ok := pkg.Addr.(*DomainAddr); ok {
+				return
+			}
+			t.Fatalf("marshal %v failed, err: %v", pkg.Addr, err)
+		}
+		again, err := UnMarshalPackage(buf)
+		if err != nil {
+			t.Fatalf("unmarshal %v failed, err: %v", buf, err)
+		}
+		if again.Frag != pkg.Frag || !bytes.Equal(again.Data, pkg.Data) {
+			t.Errorf("package changed after marshal, %v -> %v", pkg, again)
+		}
+		NewSock5Reassembler(0).Push(pkg)
+	})
+}
@@ -4,9 +4,11 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -18,6 +20,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"unsafe"
 
 	"github.com/godbus/dbus"
 	polkit "github.com/linuxdeepin/go-dbus-factory/org.freedesktop.policykit1"
@@ -40,8 +43,24 @@ func GetTcpRemoteAddr(conn *net.TCPConn) (*net.TCPAddr, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 	fd := int(file.Fd())
 
+	// ipv6 connection, ipv4 mapped addr of dual stack socket is ipv4
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		// from linux/include/uapi/linux/netfilter_ipv6/ip6_tables.h, sockaddr_in6 is returned
+		info, err := unix.GetsockoptIPv6MTUInfo(fd, syscall.IPPROTO_IPV6, Ip6SoOriginalDst)
+		if err != nil {
+			return nil, err
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		tcpAddr := &net.TCPAddr{
+			IP:   append(net.IP{}, info.Addr.Addr[:]...),
+			Port: int(port[0])<<8 + int(port[1]),
+		}
+		return tcpAddr, nil
+	}
+
 	// from linux/include/uapi/linux/netfilter_ipv4.h
 	req, err := unix.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, SoOriginalDst)
 	if err != nil {
@@ -104,14 +123,29 @@ func SetSockOptTrn(fd int) error {
 	if err != nil {
 		return err
 	}
-	// set ip transparent
-	err = syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+	domain, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, unix.SO_DOMAIN)
 	if err != nil {
 		return err
 	}
+	// set ipv6 transparent and recv_origin_dst
+	if domain == syscall.AF_INET6 {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		if err != nil {
+			return err
+		}
+		err = syscall.SetsockoptInt(fd, syscall.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+		if err != nil {
+			return err
+		}
+	}
+	// set ip transparent, dual stack ipv6 socket need it for ipv4 mapped packet
+	err = syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+	if err != nil && domain == syscall.AF_INET {
+		return err
+	}
 	// set ip recv_origin_dst
 	err = syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
-	if err != nil {
+	if err != nil && domain == syscall.AF_INET {
 		return err
 	}
 	return nil
@@ -123,6 +157,133 @@ type BaseAddr struct {
 	Port int
 }
 
+// domain addr, use to replace fake ip with domain, let proxy server resolve domain
+type DomainAddr struct {
+	network string
+	Domain  string
+	Port    int
+}
+
+func NewDomainAddr(network string, domain string, port int) *DomainAddr {
+	return &DomainAddr{
+		network: network,
+		Domain:  domain,
+		Port:    port,
+	}
+}
+
+func (a *DomainAddr) Network() string {
+	return a.network
+}
+
+func (a *DomainAddr) String() string {
+	return net.JoinHostPort(a.Domain, strconv.Itoa(a.Port))
+}
+
+// sock5 addr type
+const (
+	Sock5IPv4   = 1
+	Sock5Domain = 3
+	Sock5IPv6   = 4
+)
+
+// MarshalSock5Addr marshal addr to sock5 addr
+func MarshalSock5Addr(addr net.Addr) ([]byte, error) {
+	/*
+		   sock5 addr
+		+------+----------+----------+
+		| ATYP | DST.ADDR | DST.PORT |
+		+------+----------+----------+
+		|  1   | Variable |    2     |
+		+------+----------+----------+
+	*/
+	var ip net.IP
+	var port int
+	var buf []byte
+	switch rAddr := addr.(type) {
+	case *DomainAddr:
+		// domain is 1 byte length prefixed, without NUL
+		domain := strings.TrimSuffix(rAddr.Domain, ".")
+		if len(domain) == 0 || len(domain) > 255 {
+			return nil, fmt.Errorf("domain length is invalid, domain: %s", rAddr.Domain)
+		}
+		buf = append(buf, Sock5Domain, byte(len(domain)))
+		buf = append(buf, []byte(domain)...)
+		port = rAddr.Port
+	case *net.TCPAddr:
+		ip = rAddr.IP
+		port = rAddr.Port
+	case *net.UDPAddr:
+		ip = rAddr.IP
+		port = rAddr.Port
+	default:
+		return nil, fmt.Errorf("addr type is not support, type: %T", addr)
+	}
+	// ip addr
+	if buf == nil {
+		if ip.To4() != nil {
+			buf = append(buf, Sock5IPv4)
+			buf = append(buf, ip.To4()...)
+		} else if ip.To16() != nil {
+			buf = append(buf, Sock5IPv6)
+			buf = append(buf, ip.To16()...)
+		} else {
+			return nil, fmt.Errorf("ip is not ipv4 or ipv6, ip: %v", ip)
+		}
+	}
+	// convert port 2 byte
+	portBy := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBy, uint16(port))
+	buf = append(buf, portBy...)
+	return buf, nil
+}
+
+// ReadSock5Addr read sock5 addr from reader, network decide tcp addr or udp addr returned
+func ReadSock5Addr(reader io.Reader, network string) (net.Addr, error) {
+	// read addr type
+	typ := make([]byte, 1)
+	_, err := io.ReadFull(reader, typ)
+	if err != nil {
+		return nil, err
+	}
+	var buf []byte
+	switch typ[0] {
+	case Sock5IPv4:
+		buf = make([]byte, net.IPv4len)
+	case Sock5IPv6:
+		buf = make([]byte, net.IPv6len)
+	case Sock5Domain:
+		// domain length
+		length := make([]byte, 1)
+		_, err = io.ReadFull(reader, length)
+		if err != nil {
+			return nil, err
+		}
+		buf = make([]byte, length[0])
+	default:
+		return nil, fmt.Errorf("sock5 addr type is invalid, type: %v", typ[0])
+	}
+	_, err = io.ReadFull(reader, buf)
+	if err != nil {
+		return nil, err
+	}
+	// port
+	portBy := make([]byte, 2)
+	_, err = io.ReadFull(reader, portBy)
+	if err != nil {
+		return nil, err
+	}
+	port := int(binary.BigEndian.Uint16(portBy))
+	// make addr
+	if typ[0] == Sock5Domain {
+		return NewDomainAddr(network, string(buf), port), nil
+	}
+	if network == "udp" {
+		return &net.UDPAddr{IP: buf, Port: port}, nil
+	}
+	return &net.TCPAddr{IP: buf, Port: port}, nil
+}
+
 // ParseRemoteAddrFromMsgHdr parse origin remote addr msg from msg_hdr
 func ParseRemoteAddrFromMsgHdr(buf []byte) (*BaseAddr, error) {
 	var addr *BaseAddr
@@ -135,16 +296,20 @@ func ParseRemoteAddrFromMsgHdr(buf []byte) (*BaseAddr, error) {
 		return addr, err
 	}
 	// tcp and udp addr is the same struct, use tcp to represent all
+	/*
+		sockaddr_in    family(2) port(2) addr(4)
+		sockaddr_in6   family(2) port(2) flowinfo(4) addr(16) scope_id(4)
+	*/
 	for _, msg := range msgSl {
 		// use t_proxy and ip route, msg_hdr address is marked as sol_ip type
-		if msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_RECVORIGDSTADDR {
+		if msg.Header.Level == syscall.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR && len(msg.Data) >= 8 {
 			addr = &BaseAddr{
-				IP:   msg.Data[4:8],
+				IP:   append(net.IP{}, msg.Data[4:8]...),
 				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
 			}
-		} else if msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == syscall.IP_RECVORIGDSTADDR {
+		} else if msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR && len(msg.Data) >= 24 {
 			addr = &BaseAddr{
-				IP:   msg.Data[8:24],
+				IP:   append(net.IP{}, msg.Data[8:24]...),
 				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
 			}
 		}
@@ -162,19 +327,18 @@ func MegaDial(network string, lAddr net.Addr, rAddr net.Addr) (net.Conn, error)
 	if reflect.TypeOf(lAddr) != reflect.TypeOf(rAddr) {
 		return nil, errors.New("dial local addr is not match with remote addr")
 	}
-	// get domain
-	var domain int
-	// net.addr is pointer, cannot get field by name directly
-	addrPtr := reflect.ValueOf(lAddr)
-	addrValue := reflect.Indirect(addrPtr)
-	// get ip message
-	var ip net.IP = addrValue.FieldByName("IP").Bytes()
-	if ip.To4() != nil {
-		domain = syscall.AF_INET
-	} else if ip.To16() != nil {
-		domain = syscall.AF_INET6
-	} else {
-		return nil, errors.New("local ip is incorrect")
+	// get domain, ipv6 socket is used if any addr is ipv6, ipv4 addr is mapped
+	domain := syscall.AF_INET
+	for _, addr := range []net.Addr{lAddr, rAddr} {
+		// net.addr is pointer, cannot get field by name directly
+		addrValue := reflect.Indirect(reflect.ValueOf(addr))
+		// get ip message
+		var ip net.IP = addrValue.FieldByName("IP").Bytes()
+		if ip.To4() == nil && ip.To16() != nil {
+			domain = syscall.AF_INET6
+		} else if ip.To4() == nil {
+			return nil, errors.New("dial ip is incorrect")
+		}
 	}
 	// get typ
 	var typ int
@@ -189,23 +353,28 @@ func MegaDial(network string, lAddr net.Addr, rAddr net.Addr) (net.Conn, error)
 	}
 	// set transparent
 	if err = SetSockOptTrn(fd); err != nil {
+		_ = syscall.Close(fd)
 		return nil, err
 	}
 	// convert addr
-	lSockAddr, err := convertAddrToSockAddr(lAddr)
+	lSockAddr, err := convertAddrToSockAddr(lAddr, domain)
 	if err != nil {
+		_ = syscall.Close(fd)
 		return nil, err
 	}
-	rSockAddr, err := convertAddrToSockAddr(rAddr)
+	rSockAddr, err := convertAddrToSockAddr(rAddr, domain)
 	if err != nil {
+		_ = syscall.Close(fd)
 		return nil, err
 	}
 	// bind fake addr
 	if err = syscall.Bind(fd, lSockAddr); err != nil {
+		_ = syscall.Close(fd)
 		return nil, err
 	}
 	// bind addr
 	if err = syscall.Connect(fd, rSockAddr); err != nil {
+		_ = syscall.Close(fd)
 		return nil, err
 	}
 	// create new file
@@ -218,8 +387,11 @@ func MegaDial(network string, lAddr net.Addr, rAddr net.Addr) (net.Conn, error)
 
 	file := os.NewFile(uintptr(fd), fmt.Sprintf(name, fd))
 	if file == nil {
+		_ = syscall.Close(fd)
 		return nil, errors.New("create new file is nil")
 	}
+	// file conn dup fd, file is useless after created
+	defer file.Close()
 	// create file conn
 	conn, err := net.FileConn(file)
 	if err != nil {
@@ -228,8 +400,8 @@ func MegaDial(network string, lAddr net.Addr, rAddr net.Addr) (net.Conn, error)
 	return conn, nil
 }
 
-// convert addr to sock addr
-func convertAddrToSockAddr(addr net.Addr) (syscall.Sockaddr, error) {
+// convert addr to sock addr of socket domain, ipv4 addr is mapped to ipv6 for ipv6 socket
+func convertAddrToSockAddr(addr net.Addr, domain int) (syscall.Sockaddr, error) {
 	// check if addr can convert to udp addr and tcp addr, if not return as error
 	if !reflect.TypeOf(addr).ConvertibleTo(reflect.TypeOf(&net.UDPAddr{})) &&
 		!reflect.TypeOf(addr).ConvertibleTo(reflect.TypeOf(&net.TCPAddr{})) {
@@ -244,7 +416,7 @@ func convertAddrToSockAddr(addr net.Addr) (syscall.Sockaddr, error) {
 		port = 80
 	}
 	// convert addr and port
-	if ip.To4() != nil {
+	if ip.To4() != nil && domain == syscall.AF_INET {
 		inet4 := &syscall.SockaddrInet4{
 			Port: int(port),
 		}
@@ -260,75 +432,13 @@ func convertAddrToSockAddr(addr net.Addr) (syscall.Sockaddr, error) {
 	return nil, errors.New("ip is not ipv4 or ipv6")
 }
 
-type DataPackage struct {
-	Addr net.Addr
-	Data []byte
-}
-
-// marshal data, now only useful for udp
-func MarshalPackage(pkg DataPackage, proto string) []byte {
-	/*
-			sock5 udp data
-		   +----+------+--------+----------+----------+------+
-		   |RSV | FRAG |  ATYP  | DST.ADDR | DST.PORT | DATA |
-		   +----+------+--------+------+----------+----------+
-		   | 1  |  0   |    1   | Variable | Variable | Data |
-		   +----+------+--------+----------+----------+------+
-	*/
-	// message
-	addr := pkg.Addr
-	valuePtr := reflect.ValueOf(addr)
-	value := reflect.Indirect(valuePtr)
-	var ip net.IP = value.FieldByName("IP").Bytes()
-	netPort := value.FieldByName("Port").Int()
-	data := pkg.Data
-	// udp message protocol
-	buf := make([]byte, 4)
-	buf[0] = 0
-	// only udp is valid
-	switch proto {
-	case "tcp":
-		return nil
-	case "udp":
-		buf[1] = 0
-	default:
-		return nil
-	}
-	buf[1] = 0
-	buf[2] = 0
-	if ip.To4() != nil {
-		buf[3] = 1
-		buf = append(buf, ip.To4()...)
-	} else if ip.To16() != nil {
-		buf[3] = 1
-		buf = append(buf, ip.To16()...)
-	} else {
-		buf[3] = 3
-		buf = append(buf, ip...)
-	}
-	// convert port 2 byte
-
-	port := make([]byte, 2)
-	binary.BigEndian.PutUint16(port, uint16(netPort))
-	buf = append(buf, port...)
-	// add data
-	buf = append(buf, data...)
-	return buf
-}
-
-// unmarshal data
-func UnMarshalPackage(msg []byte) DataPackage {
-	addr := msg[4:8]
-	port := binary.BigEndian.Uint16(msg[8:10])
-	data := msg[10:]
-
-	return DataPackage{
-		Addr: &net.UDPAddr{
-			IP:   addr[:],
-			Port: int(port),
-		},
-		Data: data,
+// check if ipv6 is enabled in kernel, module not loaded is disabled
+func IPv6Enabled() bool {
+	buf, err := ioutil.ReadFile("/proc/sys/net/ipv6/conf/all/disable_ipv6")
+	if err != nil {
+		return false
 	}
+	return strings.TrimSpace(string(buf)) == "0"
 }
 
 // get home dir
@@ -410,6 +520,111 @@ func GetProcStartTime(pid uint32) (uint64, error) {
 	return uint64(time), nil
 }
 
+// find executable path of process which owns local socket addr
+func GetProcessByAddr(network string, addr net.Addr) (string, error) {
+	inode, err := GetSocketInode(network, addr)
+	if err != nil {
+		return "", err
+	}
+	return GetProcessBySocketInode(inode)
+}
+
+// find inode of local socket addr, only /proc/net is read
+func GetSocketInode(network string, addr net.Addr) (string, error) {
+	var ip net.IP
+	var port int
+	switch sockAddr := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = sockAddr.IP, sockAddr.Port
+	case *net.UDPAddr:
+		ip, port = sockAddr.IP, sockAddr.Port
+	default:
+		return "", errors.New("addr type is not support")
+	}
+	// ipv4 socket may be listed in ipv6 table as mapped addr
+	for _, table := range []string{network, network + "6"} {
+		inode, err := findSocketInode("/proc/net/"+table, ip, port)
+		if err == nil {
+			return inode, nil
+		}
+	}
+	return "", fmt.Errorf("socket %s not found in proc", addr.String())
+}
+
+// find executable path of process which owns socket inode, fd of all process is searched
+func GetProcessBySocketInode(inode string) (string, error) {
+	link := "socket:[" + inode + "]"
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return "", err
+	}
+	for _, proc := range procs {
+		if !IsPid(proc.Name()) {
+			continue
+		}
+		fdPath := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdPath)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(fdPath, fd.Name()))
+			if err != nil || target != link {
+				continue
+			}
+			return os.Readlink(filepath.Join("/proc", proc.Name(), "exe"))
+		}
+	}
+	return "", fmt.Errorf("process of socket inode %s not found", inode)
+}
+
+// find socket inode from /proc/net/[tcp,tcp6,udp,udp6]
+func findSocketInode(path string, ip net.IP, port int) (string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(string(buf), "\n")
+	// first line is title
+	for _, line := range lines[1:] {
+		// sl local_address rem_address st tx_queue rx_queue tr tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+		local := strings.Split(fields[1], ":")
+		if len(local) != 2 {
+			continue
+		}
+		localPort, err := strconv.ParseUint(local[1], 16, 16)
+		if err != nil || int(localPort) != port {
+			continue
+		}
+		localIP, err := parseProcNetIP(local[0])
+		if err != nil || !localIP.Equal(ip) {
+			continue
+		}
+		return fields[9], nil
+	}
+	return "", errors.New("socket not found")
+}
+
+// ip in /proc/net is hex of 32 bits words in host order
+func parseProcNetIP(str string) (net.IP, error) {
+	buf, err := hex.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) != net.IPv4len && len(buf) != net.IPv6len {
+		return nil, fmt.Errorf("proc net ip %s is invalid", str)
+	}
+	ip := make(net.IP, len(buf))
+	for index := 0; index < len(buf); index += 4 {
+		binary.BigEndian.PutUint32(ip[index:], binary.LittleEndian.Uint32(buf[index:]))
+	}
+	return ip, nil
+}
+
 // use to mega add elem to slice and map     result add err
 func MegaAdd(src interface{}, tgt interface{}) (interface{}, bool, error) {
 	// check kind, only map and slice support mega del
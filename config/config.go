@@ -5,19 +5,24 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
 
 	Com "github.com/ArisAachen/deepin-network-proxy/com"
 	define "github.com/ArisAachen/deepin-network-proxy/define"
 	"gopkg.in/yaml.v2"
 )
 
-// proxy type, support HTTP SOCK4 SOCK5
+// proxy type, support HTTP HTTPS SOCK4 SOCK4A SOCK5 SHADOWSOCKS CHAIN
 type ProxyProto int
 
 const (
 	HttpProxy ProxyProto = iota
 	Sock4Proxy
 	Sock5Proxy
+	Sock4aProxy
+	ShadowsocksProxy
+	HttpsProxy
+	ChainProxy
 )
 
 func (p ProxyProto) String() string {
@@ -29,6 +34,14 @@ func (p ProxyProto) String() string {
 		proto = "SOCK4"
 	case Sock5Proxy:
 		proto = "SOCK5"
+	case Sock4aProxy:
+		proto = "SOCK4A"
+	case ShadowsocksProxy:
+		proto = "SHADOWSOCKS"
+	case HttpsProxy:
+		proto = "HTTPS"
+	case ChainProxy:
+		proto = "CHAIN"
 	default:
 		proto = "UNKNOWN"
 	}
@@ -89,7 +102,7 @@ app:
 // proxy type
 type Proxy struct {
 	// proxy proto type
-	ProtoType string `json:"type"` // http sock4 sock5
+	ProtoType string `json:"type"` // http https sock4 sock4a sock5 shadowsocks chain
 
 	// [proto]&[name] as ident
 	Name string `yaml:"name"`
@@ -101,21 +114,140 @@ type Proxy struct {
 	// auth message
 	UserName string `yaml:"username"`
 	Password string `yaml:"password"`
+
+	// shadowsocks aead cipher, aes-256-gcm chacha20-ietf-poly1305
+	Cipher string `yaml:"cipher,omitempty"`
+
+	// https proxy tls message
+	SNI        string `yaml:"sni,omitempty"`         // server name override, default is server
+	CAFile     string `yaml:"ca-file,omitempty"`     // custom ca bundle path, default use system ca
+	CertFile   string `yaml:"cert-file,omitempty"`   // client cert path for mtls
+	KeyFile    string `yaml:"key-file,omitempty"`    // client key path for mtls
+	SkipVerify bool   `yaml:"skip-verify,omitempty"` // dont verify proxy cert, not safe
+
+	// udp over tcp relay endpoint [host]:[port], udp is framed in tcp tunnel of http https sock4 sock4a and chain proxy,
+	// sing-box accept sp.v2.udp-over-tcp.arpa:0
+	UoT string `yaml:"uot,omitempty"`
+
+	// chain proxy hops in order, [proto]/[name] of other proxies, only used by chain proxy
+	Hops []string `yaml:"hops,omitempty"`
+	// hop proxies resolved from hops when chain proxy is got
+	Chain []Proxy `yaml:"-" json:"-"`
+}
+
+// proxy group policy
+const (
+	FallbackPolicy     = "fallback"      // use the first healthy member in order
+	RoundRobinPolicy   = "round-robin"   // use healthy members in turn
+	LeastLatencyPolicy = "least-latency" // use the healthy member with least probe latency
+)
+
+// proxy group, select one healthy member to proxy
+type ProxyGroup struct {
+	// group name, start group with proto group
+	Name string `yaml:"name"`
+	// fallback round-robin least-latency
+	Policy string `yaml:"policy"`
+	// members in order, [proto]/[name] of other proxies
+	Members []string `yaml:"members"`
+
+	// probe message
+	ProbeTarget   string `yaml:"probe-target,omitempty"`   // [host]:[port] to connect through member, default www.baidu.com:80
+	ProbeInterval int    `yaml:"probe-interval,omitempty"` // seconds between probes, default 60
+}
+
+// dns upstream strategy, fallback is the same as group
+const (
+	FastestStrategy = "fastest" // query all upstreams and use the fastest response
+)
+
+// how to answer aaaa query of proxied domain
+const (
+	FakeIPv6Mode  = "fake"  // answer with fake ipv6, default
+	EmptyIPv6Mode = "empty" // answer with no record, force app to use ipv4
+)
+
+// dns proxy setting
+type DNSConfig struct {
+	// real dns servers, default use /etc/resolv.conf
+	// [ip]:[port] udp://[ip]:[port] tcp://[ip]:[port] tls://[host]:[port] https://[host]/[path]
+	Upstreams []string `yaml:"upstreams,omitempty"`
+	Strategy  string   `yaml:"strategy,omitempty"`  // fallback fastest, default fallback
+	ViaProxy  bool     `yaml:"via-proxy,omitempty"` // dial upstreams through current proxy, udp is sent as tcp
+
+	Bypass    []string `yaml:"bypass,omitempty"`     // domain suffix answered with real ip instead of fake ip
+	CacheSize int      `yaml:"cache-size,omitempty"` // max cached response count, default 1000
+
+	// split dns, policy of the longest matched domain suffix is used
+	Policies []DNSPolicy `yaml:"policies,omitempty"`
+
+	// local hosts files or adblock lists, reloaded when changed
+	BlockLists []string `yaml:"block-lists,omitempty"`
+	BlockMode  string   `yaml:"block-mode,omitempty"` // zero or nxdomain, default zero
+}
+
+// how to answer blocked domain
+const (
+	ZeroBlockMode     = "zero"     // answer with 0.0.0.0 or ::
+	NXDomainBlockMode = "nxdomain" // answer with nxdomain
+)
+
+// dns policy action
+const (
+	FakeIPAction  = "fake-ip" // answer a and aaaa with fake ip
+	ForwardAction = "forward" // forward to policy upstreams
+	HostsAction   = "hosts"   // answer from static hosts
+)
+
+// dns policy of domain suffixes
+/*
+	policies:
+	  - domains: ["corp.example"]
+	    action: forward
+	    upstreams: ["10.0.0.53"]
+	    interface: tun0
+	  - domains: ["nas.home"]
+	    action: hosts
+	    hosts:
+	      nas.home: ["192.168.1.10"]
+*/
+type DNSPolicy struct {
+	Domains []string `yaml:"domains" json:"domains"`
+	Action  string   `yaml:"action" json:"action"`
+
+	// forward, default upstreams is used if empty
+	Upstreams []string `yaml:"upstreams,omitempty" json:"upstreams,omitempty"`
+	Interface string   `yaml:"interface,omitempty" json:"interface,omitempty"` // send query from this interface
+
+	// hosts, [domain] -> [ip], domain not found is answered with nxdomain
+	Hosts map[string][]string `yaml:"hosts,omitempty" json:"hosts,omitempty"`
 }
 
 // scope proxy
 type ScopeProxies struct {
-	Proxies map[string][]Proxy `yaml:"proxies"` // map[http,sock4,sock5][]proxy
+	Proxies map[string][]Proxy `yaml:"proxies"` // map[http,https,sock4,sock4a,sock5,shadowsocks,chain][]proxy
+	Groups  []ProxyGroup       `yaml:"groups,omitempty"`
 	// proxy setting
 	ProxyProgram   []string `yaml:"proxy-program"`    // global proxy will ignore
 	NoProxyProgram []string `yaml:"no-proxy-program"` // app proxy will ignore
 
 	// white list
-	WhiteList []string `yaml:"whitelist"` // white site dont use proxy, not use this time
+	WhiteList []string `yaml:"whitelist"` // white site dont use proxy, domain suffix or ip cidr, matched before rules
 	TPort     int      `yaml:"t-port"`
 	DNSPort   int      `yaml:"dns-port"`
+	// idle seconds before udp session is closed, default 60
+	UDPTimeout int `yaml:"udp-timeout,omitempty"`
+
+	UseFakeIP     bool      `yaml:"use-fake-ip"`
+	FakeIPRange   string    `yaml:"fake-ip-range,omitempty"`   // ipv4 cidr, default 198.18.0.0/15
+	FakeIPv6Range string    `yaml:"fake-ipv6-range,omitempty"` // ipv6 cidr, default fdfe:dcba:9876::/64
+	IPv6Mode      string    `yaml:"ipv6-mode,omitempty"`       // fake or empty, default fake
+	DNS           DNSConfig `yaml:"dns,omitempty"`
+	// dont sniff domain from tls sni and http host
+	DisableSniff bool `yaml:"disable-sniff,omitempty"`
 
-	UseFakeIP bool `yaml:"use-fake-ip"`
+	// route rules, [type],[payload],[action], action is DIRECT REJECT or [proto]/[name]
+	Rules []string `yaml:"rules,omitempty"`
 }
 
 func (p *ScopeProxies) GetProxy(proto string, name string) (Proxy, error) {
@@ -130,12 +262,83 @@ func (p *ScopeProxies) GetProxy(proto string, name string) (Proxy, error) {
 	// search name
 	for _, proxy := range proxies {
 		if proxy.Name == name {
+			// chain proxy need resolve hops
+			if proto == define.CHAIN {
+				return p.resolveChain(proxy)
+			}
 			return proxy, nil
 		}
 	}
 	return Proxy{}, fmt.Errorf("proxy name [%s] not exist in proto [%s]", name, proto)
 }
 
+// resolve chain hops to proxies, hop proto is saved as proto type
+func (p *ScopeProxies) resolveChain(chain Proxy) (Proxy, error) {
+	if len(chain.Hops) == 0 {
+		return Proxy{}, fmt.Errorf("chain proxy [%s] has no hop", chain.Name)
+	}
+	chain.Chain = nil
+	for _, hop := range chain.Hops {
+		// chain in chain is not allowed
+		if strings.HasPrefix(hop, define.CHAIN+"/") {
+			return Proxy{}, fmt.Errorf("chain proxy [%s] cant use chain as hop", chain.Name)
+		}
+		proxy, err := p.getProxyByIdent(hop)
+		if err != nil {
+			return Proxy{}, err
+		}
+		chain.Chain = append(chain.Chain, proxy)
+	}
+	return chain, nil
+}
+
+// get proxy by [proto]/[name], proto is saved as proto type
+func (p *ScopeProxies) getProxyByIdent(ident string) (Proxy, error) {
+	identSl := strings.SplitN(ident, "/", 2)
+	if len(identSl) != 2 {
+		return Proxy{}, fmt.Errorf("proxy ident [%s] is invalid", ident)
+	}
+	proxy, err := p.GetProxy(identSl[0], identSl[1])
+	if err != nil {
+		return Proxy{}, err
+	}
+	proxy.ProtoType = identSl[0]
+	return proxy, nil
+}
+
+// get group and its member proxies
+func (p *ScopeProxies) GetGroup(name string) (ProxyGroup, []Proxy, error) {
+	if p == nil {
+		return ProxyGroup{}, nil, errors.New("proxy proxies is nil")
+	}
+	for _, group := range p.Groups {
+		if group.Name != name {
+			continue
+		}
+		if len(group.Members) == 0 {
+			return ProxyGroup{}, nil, fmt.Errorf("proxy group [%s] has no member", name)
+		}
+		// check policy
+		switch group.Policy {
+		case "":
+			group.Policy = FallbackPolicy
+		case FallbackPolicy, RoundRobinPolicy, LeastLatencyPolicy:
+		default:
+			return ProxyGroup{}, nil, fmt.Errorf("proxy group [%s] policy [%s] is invalid", name, group.Policy)
+		}
+		var proxies []Proxy
+		for _, member := range group.Members {
+			proxy, err := p.getProxyByIdent(member)
+			if err != nil {
+				return ProxyGroup{}, nil, err
+			}
+			proxies = append(proxies, proxy)
+		}
+		return group, proxies, nil
+	}
+	return ProxyGroup{}, nil, fmt.Errorf("proxy group [%s] not exist", name)
+}
+
 func (p *ScopeProxies) ClearProxy() {
 	p.Proxies = nil
 }
@@ -15,14 +15,16 @@ type AppProxy struct {
 
 	// methods
 	methods *struct {
-		ClearProxy    func()
-		SetProxies    func() `in:"proxies" out:"err"`
-		StartProxy    func() `in:"proto,name,udp" out:"err"`
-		StopProxy     func()
-		GetProxy      func() `out:"proxy"`
-		AddProxy      func() `in:"proto,name,proxy"`
-		GetCGroups    func() `out:"cgroups"`
-		AddProc       func() `in:"pid" out:"success"`
+		ClearProxy       func()
+		SetProxies       func() `in:"proxies" out:"err"`
+		StartProxy       func() `in:"proto,name,udp" out:"err"`
+		StopProxy        func()
+		GetProxy         func() `out:"proxy"`
+		AddProxy         func() `in:"proto,name,proxy"`
+		GetCGroups       func() `out:"cgroups"`
+		AddProc          func() `in:"pid" out:"success"`
+		SetDNSPolicies   func() `in:"policies" out:"err"`
+		GetDNSBlockStats func() `out:"stats"`
 
 		// diff method
 		AddProxyApps func() `in:"app" out:"err"`
@@ -34,6 +36,10 @@ type AppProxy struct {
 		Proxy struct {
 			proxy config.Proxy
 		}
+		// rules missing in kernel is re-applied
+		IptablesDrift struct {
+			drift []string
+		}
 	}
 }
 
@@ -42,6 +48,8 @@ func NewAppProxy() *AppProxy {
 	appModule := &AppProxy{
 		proxyPrv: initProxyPrv(define.App, define.AppPriority),
 	}
+	// dns proxy refer to embedded proxy private
+	appModule.dnsProxy.prv = &appModule.proxyPrv
 	return appModule
 }
 
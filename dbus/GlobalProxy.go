@@ -18,14 +18,16 @@ type GlobalProxy struct {
 
 	// methods
 	methods *struct {
-		ClearProxy func()
-		SetProxies func() `in:"proxies" out:"err"`
-		StartProxy func() `in:"proto,name,udp" out:"err"`
-		StopProxy  func()
-		GetProxy   func() `out:"proxy"`
-		AddProxy   func() `in:"proto,name,proxy"`
-		GetCGroups func() `out:"cgroups"`
-		AddProc    func() `in:"pid" out:"success"`
+		ClearProxy       func()
+		SetProxies       func() `in:"proxies" out:"err"`
+		StartProxy       func() `in:"proto,name,udp" out:"err"`
+		StopProxy        func()
+		GetProxy         func() `out:"proxy"`
+		AddProxy         func() `in:"proto,name,proxy"`
+		GetCGroups       func() `out:"cgroups"`
+		AddProc          func() `in:"pid" out:"success"`
+		SetDNSPolicies   func() `in:"policies" out:"err"`
+		GetDNSBlockStats func() `out:"stats"`
 
 		// diff method
 		IgnoreProxyApps   func() `in:"app" out:"err"`
@@ -37,6 +39,10 @@ type GlobalProxy struct {
 		Proxy struct {
 			proxy config.Proxy
 		}
+		// rules missing in kernel is re-applied
+		IptablesDrift struct {
+			drift []string
+		}
 	}
 }
 
@@ -44,6 +50,8 @@ func NewGlobalProxy() *GlobalProxy {
 	global := &GlobalProxy{
 		proxyPrv: initProxyPrv(define.Global, define.GlobalPriority),
 	}
+	// dns proxy refer to embedded proxy private
+	global.dnsProxy.prv = &global.proxyPrv
 	return global
 }
 
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	com "github.com/ArisAachen/deepin-network-proxy/com"
 	"github.com/linuxdeepin/go-lib/log"
@@ -16,6 +17,12 @@ import (
 	"github.com/linuxdeepin/go-lib/dbusutil"
 )
 
+// interval to check if iptables rules in kernel drift from memory
+const iptablesCheckInterval = 30 * time.Second
+
+// route table of tproxy marked packages
+const mainRouteTable = "100"
+
 // manage all proxy handler
 type Manager struct {
 
@@ -38,21 +45,37 @@ type Manager struct {
 	// iptables manager
 	mainChain   *newIptables.Chain // main attach chain
 	iptablesMgr *newIptables.Manager
+	// protect chains from drift check
+	iptablesLock sync.Mutex
+	driftStop    chan struct{}
 
 	// route manager
-	mainRoute *route.Route
-	routeMgr  *route.Manager
+	mainRoute  *route.Route
+	mainRoute6 *route.Route // nil when ipv6 is disabled
+	routeMgr   *route.Manager
 
 	// if current listening
 	runOnce *sync.Once
+
+	// record everything created, used to clean after crash
+	journal *stateJournal
+	// instance id in owner tag of iptables rules
+	instance string
 }
 
 // make manager
 func NewManager() *Manager {
-	manager := &Manager{}
+	manager := &Manager{
+		instance: newIptables.NewInstanceID(),
+	}
 	return manager
 }
 
+// owner tag of iptables rules created for scope
+func (m *Manager) ownerTag(scope define.Scope) string {
+	return newIptables.OwnerTag(m.instance, scope.String())
+}
+
 // inti manager
 func (m *Manager) Init() error {
 	// init session dbus service to export service
@@ -155,7 +178,7 @@ func (m *Manager) Start() {
 		m.runOnce = new(sync.Once)
 	}
 	m.runOnce.Do(func() {
-		// run first clean script
+		// clean things left by last run from journal
 		_ = m.firstClean()
 
 		// init cgroups
@@ -163,6 +186,7 @@ func (m *Manager) Start() {
 
 		// iptables init
 		_ = m.initIptables()
+		m.startDriftCheck()
 
 		// init route
 		_ = m.initRoute()
@@ -173,13 +197,18 @@ func (m *Manager) Start() {
 func (m *Manager) initIptables() error {
 	var err error
 	m.iptablesMgr = newIptables.NewManager()
+	m.iptablesMgr.SetRecorder(m.journal.recordIptables)
 	m.iptablesMgr.Init()
+	logger.Debugf("init iptables with %s backend", m.iptablesMgr.BackendName())
 	// get mangle output chain
 	outputChain := m.iptablesMgr.GetChain("mangle", "OUTPUT")
 	// create main chain to manager all children chain
 	// sudo iptables -t mangle -N Main
 	// sudo iptables -t mangle -A OUTPUT -j Main
-	m.mainChain, err = outputChain.CreateChild(define.Main.String(), 0, &newIptables.CompleteRule{Action: define.Main.String()})
+	m.mainChain, err = outputChain.CreateChild(define.Main.String(), 0, &newIptables.CompleteRule{
+		Action:  define.Main.String(),
+		Comment: m.ownerTag(define.Main),
+	})
 	if err != nil {
 		logger.Warningf("init iptables failed, err: %v", err)
 		return err
@@ -196,6 +225,7 @@ func (m *Manager) initIptables() error {
 		Action:    newIptables.RETURN,
 		BaseSl:    []newIptables.BaseRule{base},
 		ExtendsSl: nil,
+		Comment:   m.ownerTag(define.Main),
 	}
 	// append rule
 	err = m.mainChain.AppendRule(cpl)
@@ -226,6 +256,7 @@ func (m *Manager) initIptables() error {
 		BaseSl: nil,
 		// -m cgroup --path main.slice -j RETURN
 		ExtendsSl: []newIptables.ExtendsRule{extends},
+		Comment:   m.ownerTag(define.Main),
 	}
 	// append rule
 	err = m.mainChain.AppendRule(cpl)
@@ -247,10 +278,63 @@ func (m *Manager) initCGroups() error {
 		logger.Warningf("init cgroup failed, err: %v", err)
 		return err
 	}
+	// main cgroup is kept after stop, not journaled, or recover move its procs out of main.slice
 	logger.Debug("init cgroup success")
 	return nil
 }
 
+// check iptables drift periodically, missing rules is re-applied
+func (m *Manager) startDriftCheck() {
+	if m.iptablesMgr == nil || m.driftStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	m.driftStop = stop
+	iptablesMgr := m.iptablesMgr
+	go func() {
+		ticker := time.NewTicker(iptablesCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				m.iptablesLock.Lock()
+				drift, err := iptablesMgr.Reconcile()
+				m.iptablesLock.Unlock()
+				if err != nil {
+					logger.Warningf("[manager] check iptables drift failed, err: %v", err)
+				}
+				if len(drift) != 0 {
+					m.emitDrift(drift)
+				}
+			}
+		}
+	}()
+}
+
+// stop drift check
+func (m *Manager) stopDriftCheck() {
+	if m.driftStop == nil {
+		return
+	}
+	close(m.driftStop)
+	m.driftStop = nil
+}
+
+// emit drift signal from all proxy handler
+func (m *Manager) emitDrift(drift []string) {
+	if m.sysService == nil {
+		return
+	}
+	for _, handler := range m.handler {
+		err := m.sysService.Emit(handler, "IptablesDrift", drift)
+		if err != nil {
+			logger.Warningf("[%s] emit iptables drift failed, err: %v", handler.getScope(), err)
+		}
+	}
+}
+
 // init route
 func (m *Manager) initRoute() error {
 	var err error
@@ -262,15 +346,34 @@ func (m *Manager) initRoute() error {
 	info := route.RouteInfoSpec{
 		Dev: "lo",
 	}
-	m.mainRoute, err = m.routeMgr.CreateRoute("100", node, info)
+	m.mainRoute, err = m.routeMgr.CreateRoute(mainRouteTable, node, info)
 	if err != nil {
 		logger.Warningf("init route failed, err: %v", err)
 		return err
 	}
+	m.journal.addRoute(journalRoute{Table: mainRouteTable, Node: node, Info: info})
+	// ip -6 route add local default dev lo table 100
+	if com.IPv6Enabled() {
+		m.mainRoute6, err = m.routeMgr.CreateRoute6(mainRouteTable, node, info)
+		if err != nil {
+			logger.Warningf("init ipv6 route failed, err: %v", err)
+			return err
+		}
+		m.journal.addRoute(journalRoute{Table: mainRouteTable, IPv6: true, Node: node, Info: info})
+	}
 	logger.Debug("init route success")
 	return nil
 }
 
+// main routes of all enabled ip family
+func (m *Manager) mainRoutes() []*route.Route {
+	routes := []*route.Route{m.mainRoute}
+	if m.mainRoute6 != nil {
+		routes = append(routes, m.mainRoute6)
+	}
+	return routes
+}
+
 // format current procs
 func (m *Manager) GetAllProcs() (map[string]newCGroups.ControlProcSl, error) {
 	// check service
@@ -382,8 +485,13 @@ func (m *Manager) release() error {
 	// stop loop
 	// m.sigLoop.Stop()
 
+	// stop drift check before remove chain
+	m.stopDriftCheck()
+
 	// remove chain
+	m.iptablesLock.Lock()
 	err := m.mainChain.Remove()
+	m.iptablesLock.Unlock()
 	if err != nil {
 		logger.Warningf("[manager] remove main chain failed, err: %v", err)
 		return err
@@ -404,6 +512,16 @@ func (m *Manager) release() error {
 		logger.Warning("[manager] remove all route failed, err:", err)
 		return err
 	}
+	m.journal.delRoute(journalRoute{Table: mainRouteTable, Node: m.mainRoute.Node, Info: m.mainRoute.Info})
+	if m.mainRoute6 != nil {
+		err = m.mainRoute6.Remove()
+		if err != nil {
+			logger.Warning("[manager] remove ipv6 route failed, err:", err)
+			return err
+		}
+		m.journal.delRoute(journalRoute{Table: mainRouteTable, IPv6: true, Node: m.mainRoute6.Node, Info: m.mainRoute6.Info})
+		m.mainRoute6 = nil
+	}
 	m.routeMgr = nil
 
 	// reset once
@@ -411,23 +529,23 @@ func (m *Manager) release() error {
 	return nil
 }
 
-// run first clean script
+// clean everything left by last run from journal
 func (m *Manager) firstClean() error {
-	// get config path
-	path, err := com.GetConfigDir()
-	if err != nil {
-		logger.Warningf("[%s] run first clean failed, config err: %v", "manager", err)
-		return err
+	if m.journal == nil {
+		// get config path
+		path, err := com.GetConfigDir()
+		if err != nil {
+			logger.Warningf("[%s] run first clean failed, config err: %v", "manager", err)
+			return err
+		}
+		m.journal = newStateJournal(filepath.Join(path, define.JournalName))
 	}
-	// get script file path
-	path = filepath.Join(path, define.ScriptName)
-	// run script
-	buf, err := com.RunScript(path, []string{"clear_Main"})
+	err := m.journal.recover(m.instance)
 	if err != nil {
-		logger.Debugf("[%s] run first clean script failed, out: %s, err: %v", "manager", string(buf), err)
+		logger.Warningf("[%s] recover journal failed, err: %v", "manager", err)
 		return err
 	}
-	logger.Debugf("[%s] run first clean script success", "manager")
+	logger.Debugf("[%s] recover journal success", "manager")
 	return nil
 }
 
@@ -1,46 +1,216 @@
 package DBus
 
 import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"math"
 	"net"
+	"sync"
 )
 
-type fakeIP struct {
-	start uint32
-	end   uint32
-	index uint32
+const (
+	// default fake ip range, reserved for benchmark by rfc 2544
+	defaultFakeIPRange = "198.18.0.0/15"
+	// default fake ipv6 range, unique local address
+	defaultFakeIPv6Range = "fdfe:dcba:9876::/64"
+	// max ip count to find not restored ip
+	maxFakeIPHoleScan = 1 << 20
+	// max ip count of ipv6 pool, the same as default ipv4 range, or ip is never recycled
+	maxFakeIPv6PoolSize = 1<<17 - 2
+)
+
+// domain and fake ip pair, ip is offset in range
+type fakeIPEntry struct {
+	domain string
+	ip     uint32
+}
+
+// fake ip pool, domain <-> ip, least recently used ip is recycled when pool is exhausted,
+// ip is saved as offset from network address, only low 32 bits is used for ipv6
+/*
+  start               next                 end
+    |-------------------|-------------------|
+         allocated           never used
+*/
+type fakeIPPool struct {
+	lock sync.Mutex
+
+	network *net.IPNet
+	start   uint32
+	end     uint32
+	next    uint32   // next never used ip
+	free    []uint32 // ip not in use below next
+
+	// front is most recently used
+	entries *list.List
+	domains map[string]*list.Element
+	ips     map[uint32]*list.Element
+
+	// changed since last save
+	dirty bool
+}
+
+// create pool from cidr, network and broadcast address is not used
+func newFakeIPPool(cidr string) (*fakeIPPool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := network.Mask.Size()
+	hostBits := bits - ones
+	if hostBits < 2 {
+		return nil, fmt.Errorf("fake ip range [%s] is too small", cidr)
+	}
+	end := uint32(math.MaxUint32 - 1)
+	if hostBits < 32 {
+		end = uint32(1)<<uint(hostBits) - 2
+	}
+	if len(network.IP) == net.IPv6len && end > maxFakeIPv6PoolSize {
+		end = maxFakeIPv6PoolSize
+	}
+	return &fakeIPPool{
+		network: network,
+		start:   1,
+		end:     end,
+		next:    1,
+		entries: list.New(),
+		domains: make(map[string]*list.Element),
+		ips:     make(map[uint32]*list.Element),
+	}, nil
+}
+
+// ip of offset
+func (p *fakeIPPool) ipAt(offset uint32) net.IP {
+	ip := make(net.IP, len(p.network.IP))
+	copy(ip, p.network.IP)
+	low := ip[len(ip)-4:]
+	binary.BigEndian.PutUint32(low, binary.BigEndian.Uint32(low)|offset)
+	return ip
 }
 
-func ipToUint(ip net.IP) uint32 {
-	return (uint32(ip[0]) << 24) | (uint32(ip[1]) << 16) | (uint32(ip[2]) << 8) | uint32(ip[3])
+// offset of ip, false if ip is not in pool
+func (p *fakeIPPool) offsetOf(ip net.IP) (uint32, bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if len(ip) != len(p.network.IP) || !p.network.Contains(ip) {
+		return 0, false
+	}
+	offset := binary.BigEndian.Uint32(ip[len(ip)-4:]) & ^binary.BigEndian.Uint32(p.network.Mask[len(ip)-4:])
+	if offset < p.start || offset > p.end || !ip.Equal(p.ipAt(offset)) {
+		return 0, false
+	}
+	return offset, true
 }
 
-func uintToIP(v uint32) net.IP {
-	return net.IP{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+// get fake ip of domain, allocate one if not exist
+func (p *fakeIPPool) lookup(domain string) net.IP {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if elem, ok := p.domains[domain]; ok {
+		p.entries.MoveToFront(elem)
+		return p.ipAt(elem.Value.(*fakeIPEntry).ip)
+	}
+	ip := p.allocate()
+	p.add(domain, ip)
+	return p.ipAt(ip)
 }
 
-func prefixToMask(prefix uint32) uint32 {
-	return uint32(0xFFFFFFFF << (32 - prefix))
+// get domain of fake ip
+func (p *fakeIPPool) getDomain(ip net.IP) (string, bool) {
+	offset, ok := p.offsetOf(ip)
+	if !ok {
+		return "", false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	elem, ok := p.ips[offset]
+	if !ok {
+		return "", false
+	}
+	// connection keeps ip alive
+	p.entries.MoveToFront(elem)
+	return elem.Value.(*fakeIPEntry).domain, true
 }
 
-func newFakeIP(ip net.IP, prefix uint32) fakeIP {
-	ipUint := ipToUint(ip)
-	mask := prefixToMask(prefix)
+// allocate never used ip first, then recycled ip, then the least recently used one
+func (p *fakeIPPool) allocate() uint32 {
+	if p.next <= p.end {
+		ip := p.next
+		p.next++
+		return ip
+	}
+	if count := len(p.free); count > 0 {
+		ip := p.free[count-1]
+		p.free = p.free[:count-1]
+		return ip
+	}
+	elem := p.entries.Back()
+	entry := elem.Value.(*fakeIPEntry)
+	logger.Debugf("fake ip pool is exhausted, recycle %s of %s", p.ipAt(entry.ip), entry.domain)
+	p.entries.Remove(elem)
+	delete(p.domains, entry.domain)
+	delete(p.ips, entry.ip)
+	return entry.ip
+}
 
-	start := ipUint & mask
-	end := ipUint | ^mask
+// add entry as most recently used
+func (p *fakeIPPool) add(domain string, ip uint32) {
+	elem := p.entries.PushFront(&fakeIPEntry{domain: domain, ip: ip})
+	p.domains[domain] = elem
+	p.ips[ip] = elem
+	p.dirty = true
+}
 
-	return fakeIP{
-		start: start,
-		end:   end,
+// restore entries, entries are ordered from least to most recently used,
+// pool in use already has the newest mapping
+func (p *fakeIPPool) restore(entries []fakeIPEntry) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.entries.Len() != 0 {
+		return
 	}
+	for _, entry := range entries {
+		// range may be changed
+		if entry.ip < p.start || entry.ip > p.end {
+			continue
+		}
+		if _, ok := p.domains[entry.domain]; ok {
+			continue
+		}
+		if _, ok := p.ips[entry.ip]; ok {
+			continue
+		}
+		p.add(entry.domain, entry.ip)
+		if entry.ip >= p.next {
+			p.next = entry.ip + 1
+		}
+	}
+	// ip below next which is not restored can be reused, huge ipv6 hole is ignored
+	for ip := p.start; ip < p.next && p.next-p.start <= maxFakeIPHoleScan; ip++ {
+		if _, ok := p.ips[ip]; !ok {
+			p.free = append(p.free, ip)
+		}
+	}
+	p.dirty = false
 }
 
-func (i *fakeIP) new() net.IP {
-	current := i.start + i.index
-	if current > i.end {
-		// todo:
+// dump entries ordered from least to most recently used
+func (p *fakeIPPool) dump() []fakeIPEntry {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entries := make([]fakeIPEntry, 0, p.entries.Len())
+	for elem := p.entries.Back(); elem != nil; elem = elem.Prev() {
+		entries = append(entries, *elem.Value.(*fakeIPEntry))
 	}
+	p.dirty = false
+	return entries
+}
 
-	i.index++
-	return uintToIP(current)
+// check if pool changed since last dump
+func (p *fakeIPPool) changed() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.dirty
 }
@@ -1,54 +1,87 @@
 package DBus
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 
-	"github.com/golang/groupcache/lru"
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
 )
 
-type fakeIPCache struct {
-	cache *lru.Cache
-
-	mapper map[uint32]string
-}
-
-func newFakeIPCache() *fakeIPCache {
-	f := new(fakeIPCache)
-	f.cache = lru.New(cacheMaxSize)
-	f.mapper = make(map[uint32]string)
-
-	return f
+// fake ip mapping saved on disk, apps may hold old fake ip after daemon restart
+type fakeIPRecord struct {
+	Domain string `json:"domain"`
+	IP     string `json:"ip"`
 }
 
-func (f *fakeIPCache) Add(domain string, ip net.IP) {
-	f.cache.Add(domain, ip)
-
-	ipUint := ipToUint(ip)
-	f.mapper[ipUint] = domain
+// get path of fake ip file
+func fakeIPFilePath(scope define.Scope) (string, error) {
+	path, err := com.GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(path, fmt.Sprintf(define.FakeIPName, scope.String())), nil
 }
 
-func (f *fakeIPCache) GetByDomain(domain string) (net.IP, bool) {
-	ipI, ok := f.cache.Get(domain)
-	if !ok {
-		return net.IP{}, false
+// load mapping of pools from file, file not exist is not error
+func loadFakeIPPools(path string, pools ...*fakeIPPool) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
 	}
-
-	return ipI.(net.IP), true
+	var records []fakeIPRecord
+	err = json.Unmarshal(buf, &records)
+	if err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		entries := make([]fakeIPEntry, 0, len(records))
+		for _, record := range records {
+			ip := net.ParseIP(record.IP)
+			if record.Domain == "" || ip == nil {
+				continue
+			}
+			// range may be changed
+			offset, ok := pool.offsetOf(ip)
+			if !ok {
+				continue
+			}
+			entries = append(entries, fakeIPEntry{domain: record.Domain, ip: offset})
+		}
+		pool.restore(entries)
+	}
+	return nil
 }
 
-func (f *fakeIPCache) GetByIP(ip net.IP) (domain string, ok bool) {
-	ipUint := ipToUint(ip)
-
-	domain, ok = f.mapper[ipUint]
-	if !ok {
-		return
+// save mapping of pools to file, write to temp file first to avoid broken file
+func saveFakeIPPools(path string, pools ...*fakeIPPool) error {
+	var records []fakeIPRecord
+	for _, pool := range pools {
+		for _, entry := range pool.dump() {
+			records = append(records, fakeIPRecord{Domain: entry.domain, IP: pool.ipAt(entry.ip).String()})
+		}
 	}
-
-	_, ok = f.cache.Get(domain)
-	if !ok {
-		delete(f.mapper, ipUint)
-		return
+	buf, err := json.Marshal(records)
+	if err != nil {
+		return err
 	}
-
-	return
+	err = com.GuaranteeDir(path)
+	if err != nil {
+		return err
+	}
+	// mapping is browsing history, readable by root only, tmp left by last run may have other mode
+	tmp := path + ".tmp"
+	_ = os.Remove(tmp)
+	err = ioutil.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
 }
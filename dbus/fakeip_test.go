@@ -0,0 +1,142 @@
+package DBus
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestFakeIPPool_Recycle(t *testing.T) {
+	// 4 ip, 2 usable
+	pool, err := newFakeIPPool("10.10.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := pool.lookup("a.example")
+	b := pool.lookup("b.example")
+	if !a.Equal(net.IP{10, 10, 0, 1}) || !b.Equal(net.IP{10, 10, 0, 2}) {
+		t.Fatalf("allocated ip is %s %s", a, b)
+	}
+	// a is used recently, b is recycled
+	if domain, ok := pool.getDomain(a); !ok || domain != "a.example" {
+		t.Errorf("domain of %s is %s", a, domain)
+	}
+	c := pool.lookup("c.example")
+	if !c.Equal(b) {
+		t.Errorf("recycled ip is %s, want %s", c, b)
+	}
+	if _, ok := pool.getDomain(net.IP{10, 10, 0, 3}); ok {
+		t.Error("broadcast address should not be allocated")
+	}
+	if domain, _ := pool.getDomain(b); domain != "c.example" {
+		t.Errorf("domain of recycled ip is %s, want c.example", domain)
+	}
+	if !pool.lookup("a.example").Equal(a) {
+		t.Error("domain should keep its ip")
+	}
+}
+
+func TestFakeIPPool_Persist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakeip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fake_ip.json")
+
+	pool, _ := newFakeIPPool(defaultFakeIPRange)
+	pool6, _ := newFakeIPPool(defaultFakeIPv6Range)
+	a := pool.lookup("a.example")
+	b := pool.lookup("b.example")
+	a6 := pool6.lookup("a.example")
+	err = saveFakeIPPools(path, pool, pool6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("mapping file mode is not 0600, info: %v, err: %v", info, err)
+	}
+
+	// restart
+	pool, _ = newFakeIPPool(defaultFakeIPRange)
+	pool6, _ = newFakeIPPool(defaultFakeIPv6Range)
+	err = loadFakeIPPools(path, pool, pool6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain, ok := pool.getDomain(b); !ok || domain != "b.example" {
+		t.Errorf("domain of %s is %s after load", b, domain)
+	}
+	if domain, ok := pool6.getDomain(a6); !ok || domain != "a.example" {
+		t.Errorf("domain of %s is %s after load", a6, domain)
+	}
+	if !pool.lookup("a.example").Equal(a) {
+		t.Error("domain should keep its ip after load")
+	}
+	if c := pool.lookup("c.example"); c.Equal(a) || c.Equal(b) {
+		t.Errorf("new ip %s is in use", c)
+	}
+
+	// mapping out of range is dropped
+	pool, _ = newFakeIPPool("10.10.0.0/16")
+	err = loadFakeIPPools(path, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pool.getDomain(a); ok {
+		t.Error("mapping out of range should be dropped")
+	}
+}
+
+func TestFakeIPPool_IPv6(t *testing.T) {
+	pool, err := newFakeIPPool(defaultFakeIPv6Range)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := pool.lookup("a.example")
+	if !ip.Equal(net.ParseIP("fdfe:dcba:9876::1")) {
+		t.Errorf("allocated ip is %s", ip)
+	}
+	if domain, ok := pool.getDomain(ip); !ok || domain != "a.example" {
+		t.Errorf("domain of %s is %s", ip, domain)
+	}
+	// only low 32 bits is used
+	if _, ok := pool.getDomain(net.ParseIP("fdfe:dcba:9876:0:1::1")); ok {
+		t.Error("ip out of pool should not be found")
+	}
+	if _, ok := pool.getDomain(net.IP{198, 18, 0, 1}); ok {
+		t.Error("ipv4 should not be found in ipv6 pool")
+	}
+}
+
+func TestFakeIPPool_IPv6Recycle(t *testing.T) {
+	pool, err := newFakeIPPool(defaultFakeIPv6Range)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := pool.lookup("0.example")
+	for index := 1; index < maxFakeIPv6PoolSize; index++ {
+		pool.lookup(strconv.Itoa(index) + ".example")
+	}
+	last := pool.lookup(strconv.Itoa(maxFakeIPv6PoolSize-1) + ".example")
+	if !last.Equal(net.ParseIP("fdfe:dcba:9876::1:fffe")) {
+		t.Errorf("last ip is %s", last)
+	}
+	// pool is full, least recently used ip is recycled
+	ip := pool.lookup("new.example")
+	if !ip.Equal(first) {
+		t.Errorf("recycled ip is %s, want %s", ip, first)
+	}
+	if _, ok := pool.getDomain(first); !ok {
+		t.Error("recycled ip should be found")
+	}
+	if count := len(pool.domains); count != maxFakeIPv6PoolSize {
+		t.Errorf("domain count is %d, want %d", count, maxFakeIPv6PoolSize)
+	}
+	if _, ok := pool.domains["0.example"]; ok {
+		t.Error("recycled domain should be removed")
+	}
+}
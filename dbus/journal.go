@@ -0,0 +1,242 @@
+package DBus
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+	route "github.com/ArisAachen/deepin-network-proxy/ip_route"
+	newCGroups "github.com/ArisAachen/deepin-network-proxy/new_cgroups"
+	newIptables "github.com/ArisAachen/deepin-network-proxy/new_iptables"
+)
+
+// ip route created by daemon
+type journalRoute struct {
+	Table string              `json:"table"`
+	IPv6  bool                `json:"ipv6,omitempty"`
+	Node  route.RouteNodeSpec `json:"node"`
+	Info  route.RouteInfoSpec `json:"info"`
+}
+
+// ip rule created by daemon
+type journalIpRule struct {
+	Table    string             `json:"table"`
+	IPv6     bool               `json:"ipv6,omitempty"`
+	Action   route.RuleAction   `json:"action"`
+	Selector route.RuleSelector `json:"selector"`
+}
+
+// everything created by daemon and not removed yet
+type journalState struct {
+	Instance string                `json:"instance"` // instance id in owner tag
+	Iptables []newIptables.Command `json:"iptables"` // chains and rules in created order
+	Routes   []journalRoute        `json:"routes"`
+	IpRules  []journalIpRule       `json:"ip_rules"`
+	CGroups  []string              `json:"cgroups"` // cgroup dir path
+}
+
+// check if nothing is recorded, instance is ignored
+func (state *journalState) empty() bool {
+	return len(state.Iptables) == 0 && len(state.Routes) == 0 && len(state.IpRules) == 0 && len(state.CGroups) == 0
+}
+
+// state journal saved under config dir, every change is saved at once,
+// things left by last run is removed when daemon start
+/*
+	-N Main, -I OUTPUT 1 -j Main     ->   -D OUTPUT -j Main, -F Main, -X Main   (iptables and ip6tables)
+	ip rule add fwmark 8080 table 100     ->   ip rule del fwmark 8080 table 100
+	ip route add local default dev lo table 100  ->   ip route del local default dev lo table 100
+	/sys/fs/cgroup/unified/App.slice      ->   move procs to parent, rmdir
+*/
+type stateJournal struct {
+	path string
+
+	lock  sync.Mutex
+	state journalState
+}
+
+// create journal, nothing is loaded until recover
+func newStateJournal(path string) *stateJournal {
+	return &stateJournal{
+		path: path,
+	}
+}
+
+// update iptables chains and rules with applied commands
+func (j *stateJournal) recordIptables(cmds []newIptables.Command) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.state.Iptables = newIptables.TrackCommands(j.state.Iptables, cmds)
+	j.save()
+}
+
+// record route
+func (j *stateJournal) addRoute(item journalRoute) {
+	j.update(func(state *journalState) {
+		state.Routes = append(state.Routes, item)
+	})
+}
+
+// remove route from journal
+func (j *stateJournal) delRoute(item journalRoute) {
+	j.update(func(state *journalState) {
+		for index, value := range state.Routes {
+			if reflect.DeepEqual(value, item) {
+				state.Routes = append(state.Routes[:index:index], state.Routes[index+1:]...)
+				return
+			}
+		}
+	})
+}
+
+// record ip rule
+func (j *stateJournal) addIpRule(item journalIpRule) {
+	j.update(func(state *journalState) {
+		state.IpRules = append(state.IpRules, item)
+	})
+}
+
+// remove ip rule from journal
+func (j *stateJournal) delIpRule(item journalIpRule) {
+	j.update(func(state *journalState) {
+		for index, value := range state.IpRules {
+			if reflect.DeepEqual(value, item) {
+				state.IpRules = append(state.IpRules[:index:index], state.IpRules[index+1:]...)
+				return
+			}
+		}
+	})
+}
+
+// record cgroup dir
+func (j *stateJournal) addCGroup(path string) {
+	j.update(func(state *journalState) {
+		if !com.MegaExist(state.CGroups, path) {
+			state.CGroups = append(state.CGroups, path)
+		}
+	})
+}
+
+// remove cgroup dir from journal
+func (j *stateJournal) delCGroup(path string) {
+	j.update(func(state *journalState) {
+		for index, value := range state.CGroups {
+			if value == path {
+				state.CGroups = append(state.CGroups[:index:index], state.CGroups[index+1:]...)
+				return
+			}
+		}
+	})
+}
+
+// change state and save
+func (j *stateJournal) update(change func(state *journalState)) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	change(&j.state)
+	j.save()
+}
+
+// save state to file, write to temp file first to avoid broken file
+func (j *stateJournal) save() {
+	buf, err := json.Marshal(j.state)
+	if err != nil {
+		logger.Warningf("[journal] marshal state failed, err: %v", err)
+		return
+	}
+	err = com.GuaranteeDir(j.path)
+	if err == nil {
+		// readable by root only, tmp left by last run may have other mode
+		tmp := j.path + ".tmp"
+		_ = os.Remove(tmp)
+		err = ioutil.WriteFile(tmp, buf, 0600)
+		if err == nil {
+			err = os.Rename(tmp, j.path)
+		}
+	}
+	if err != nil {
+		logger.Warningf("[journal] save state failed, err: %v", err)
+	}
+}
+
+// load state left by last run, file not exist is not error
+func (j *stateJournal) load() (journalState, error) {
+	var state journalState
+	buf, err := ioutil.ReadFile(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, err
+	}
+	err = json.Unmarshal(buf, &state)
+	return state, err
+}
+
+// remove everything left by last run in reverse order, removed one is not error,
+// instance of this run is saved to journal
+func (j *stateJournal) recover(instance string) error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	state, err := j.load()
+	if err != nil {
+		logger.Warningf("[journal] load state failed, err: %v", err)
+		return err
+	}
+	if state.empty() {
+		j.state = journalState{Instance: instance}
+		j.save()
+		return nil
+	}
+	logger.Infof("[journal] recover %d iptables, %d ip rules, %d routes, %d cgroups left by last run",
+		len(state.Iptables), len(state.IpRules), len(state.Routes), len(state.CGroups))
+	// iptables, rules is found by owner tag first, may be reordered by others
+	if len(state.Iptables) != 0 {
+		iptablesMgr := newIptables.NewManager()
+		iptablesMgr.Init()
+		if state.Instance != "" {
+			failed := iptablesMgr.CleanOwner(state.Instance)
+			logger.Debugf("[journal] clean iptables of %s, %d commands failed", state.Instance, failed)
+		}
+		// rules without tag and chains
+		failed := iptablesMgr.Clean(newIptables.CleanCommands(state.Iptables))
+		logger.Debugf("[journal] clean iptables, %d commands failed", failed)
+	}
+	// ip rule depend on route table
+	for index := len(state.IpRules) - 1; index >= 0; index-- {
+		item := state.IpRules[index]
+		buf, err := route.RemoveRule(item.Table, item.IPv6, item.Action, item.Selector)
+		if err != nil {
+			logger.Debugf("[journal] remove ip rule failed, out: %s, err: %v", string(buf), err)
+		}
+	}
+	for index := len(state.Routes) - 1; index >= 0; index-- {
+		item := state.Routes[index]
+		buf, err := route.RemoveRoute(item.Table, item.IPv6, item.Node, item.Info)
+		if err != nil {
+			logger.Debugf("[journal] remove route failed, out: %s, err: %v", string(buf), err)
+		}
+	}
+	// child cgroup is removed before parent
+	for index := len(state.CGroups) - 1; index >= 0; index-- {
+		err = newCGroups.Remove(state.CGroups[index])
+		if err != nil {
+			logger.Warningf("[journal] remove cgroup %s failed, err: %v", state.CGroups[index], err)
+		}
+	}
+	j.state = journalState{Instance: instance}
+	j.save()
+	return nil
+}
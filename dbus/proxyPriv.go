@@ -4,10 +4,8 @@ import (
 	"errors"
 	"net"
 	"os"
-	"path/filepath"
 	"strconv"
 
-	com "github.com/ArisAachen/deepin-network-proxy/com"
 	config "github.com/ArisAachen/deepin-network-proxy/config"
 	define "github.com/ArisAachen/deepin-network-proxy/define"
 	IpRoute "github.com/ArisAachen/deepin-network-proxy/ip_route"
@@ -41,6 +39,10 @@ type proxyPrv struct {
 	Proxies config.ScopeProxies
 	Proxy   config.Proxy // current proxy
 
+	// default route and rule router, router is nil if no rule
+	route  *proxyRoute
+	router *ruleRouter
+
 	// if proxy opened
 	Enabled bool
 
@@ -55,10 +57,11 @@ type proxyPrv struct {
 	controller *newCGroups.Controller
 
 	// iptables chain rule slice[3]
-	chains [2]*newIptables.Chain
+	chains [3]*newIptables.Chain
 
-	// route rule
-	ipRule *IpRoute.Rule
+	// route rule of each ip family
+	ipRules        []*IpRoute.Rule
+	ipRuleJournals []journalIpRule
 
 	// handler manager
 	handlerMgr *tProxy.HandlerMgr
@@ -87,18 +90,21 @@ func initProxyPrv(scope define.Scope, priority define.Priority) proxyPrv {
 		},
 	}
 
+	// fake ip is persisted in config dir
+	poolPath, err := fakeIPFilePath(scope)
+	if err != nil {
+		logger.Warningf("[%s] get fake ip file path failed, err: %v", scope, err)
+	}
 	prv.dnsProxy = &proxyDNS{
-		prv: &prv,
+		prv:      &prv,
+		poolPath: poolPath,
 	}
 	return prv
 }
 
 // proxy prepare
 func (mgr *proxyPrv) startRedirect() error {
-	// clean old redirect
-	_ = mgr.firstClean()
-
-	// make sure manager start init
+	// make sure manager start init, things left by last run is cleaned
 	mgr.manager.Start()
 
 	// create cgroups
@@ -108,14 +114,9 @@ func (mgr *proxyPrv) startRedirect() error {
 	}
 
 	// create iptables
-	err = mgr.createTable()
+	err = mgr.applyTable()
 	if err != nil {
-		logger.Warning("[%s] create iptables failed, err: %v", mgr.scope, err)
-		return err
-	}
-	err = mgr.appendRule()
-	if err != nil {
-		logger.Warning("[%s] append iptables failed, err: %v", mgr.scope, err)
+		logger.Warningf("[%s] create iptables failed, err: %v", mgr.scope, err)
 		return err
 	}
 
@@ -139,7 +140,7 @@ func (mgr *proxyPrv) startRedirect() error {
 //
 func (mgr *proxyPrv) stopRedirect() error {
 	// release iptables rules
-	err := mgr.releaseRule()
+	err := mgr.removeTable()
 	if err != nil {
 		logger.Warningf("[%s] release iptables failed, err: %v", mgr.scope, err)
 		return err
@@ -193,26 +194,6 @@ func (mgr *proxyPrv) writeConfig() error {
 	return nil
 }
 
-// first clean
-func (mgr *proxyPrv) firstClean() error {
-	// get config path
-	path, err := com.GetConfigDir()
-	if err != nil {
-		logger.Warningf("[%s] run first clean failed, config err: %v", mgr.scope, err)
-		return err
-	}
-	// get script file path
-	path = filepath.Join(path, define.ScriptName)
-	// run script
-	buf, err := com.RunScript(path, []string{"clear_" + mgr.scope.String()})
-	if err != nil {
-		logger.Debugf("[%s] run first clean script failed, out: %s, err: %v", mgr.scope, string(buf), err)
-		return err
-	}
-	logger.Debugf("[%s] run first clean script success", mgr.scope)
-	return nil
-}
-
 // cgroups
 func (mgr *proxyPrv) GetCGroups() (string, *dbus.Error) {
 	if mgr.controller == nil {
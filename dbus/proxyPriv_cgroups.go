@@ -15,6 +15,7 @@ func (mgr *proxyPrv) createCGroupController() error {
 		return err
 	}
 	mgr.controller = controller
+	mgr.manager.journal.addCGroup(controller.GetCGroupPath())
 	return nil
 }
 
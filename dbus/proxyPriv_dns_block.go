@@ -0,0 +1,237 @@
+package DBus
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	"github.com/miekg/dns"
+)
+
+// interval to check if block list changed
+const blockListCheckInterval = 10 * time.Second
+
+// names in hosts file which should not be blocked
+var hostsIgnoreNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+// domains of block lists
+type blockDomains struct {
+	exact  map[string]bool // hosts file and plain domain list
+	suffix map[string]bool // adblock ||domain^
+	allow  map[string]bool // adblock @@||domain^
+}
+
+// dns block list, support hosts file, adblock list and plain domain list
+/*
+	0.0.0.0 ads.example.com     hosts file, block ads.example.com
+	||ads.example.com^          adblock, block ads.example.com and sub domains
+	@@||cdn.ads.example.com^    adblock exception
+	ads.example.com             plain domain
+*/
+type dnsBlocker struct {
+	paths []string
+
+	lock     sync.RWMutex
+	domains  *blockDomains
+	modTimes map[string]time.Time
+}
+
+// create blocker and load lists, return nil if no list
+func newDnsBlocker(paths []string) *dnsBlocker {
+	if len(paths) == 0 {
+		return nil
+	}
+	blocker := &dnsBlocker{
+		paths: paths,
+	}
+	blocker.reload()
+	return blocker
+}
+
+// get modify time of all lists, missing list has zero time
+func (b *dnsBlocker) listModTimes() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, path := range b.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			modTimes[path] = time.Time{}
+			continue
+		}
+		modTimes[path] = info.ModTime()
+	}
+	return modTimes
+}
+
+// reload lists if any list is changed
+func (b *dnsBlocker) reloadIfChanged() {
+	modTimes := b.listModTimes()
+	b.lock.RLock()
+	changed := false
+	for path, modTime := range modTimes {
+		if !b.modTimes[path].Equal(modTime) {
+			changed = true
+			break
+		}
+	}
+	b.lock.RUnlock()
+	if changed {
+		b.reload()
+	}
+}
+
+// load all lists, list failed to load is ignored
+func (b *dnsBlocker) reload() {
+	modTimes := b.listModTimes()
+	domains := &blockDomains{
+		exact:  make(map[string]bool),
+		suffix: make(map[string]bool),
+		allow:  make(map[string]bool),
+	}
+	for _, path := range b.paths {
+		err := domains.load(path)
+		if err != nil {
+			logger.Warningf("load block list %s failed, err: %v", path, err)
+		}
+	}
+	logger.Debugf("load block list success, exact: %d, suffix: %d, allow: %d",
+		len(domains.exact), len(domains.suffix), len(domains.allow))
+	b.lock.Lock()
+	b.domains = domains
+	b.modTimes = modTimes
+	b.lock.Unlock()
+}
+
+// check if domain is blocked
+func (b *dnsBlocker) isBlocked(domain string) bool {
+	if b == nil {
+		return false
+	}
+	b.lock.RLock()
+	domains := b.domains
+	b.lock.RUnlock()
+	return domains.match(normalizeDomain(domain))
+}
+
+// load one list file
+func (d *blockDomains) load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		d.parseLine(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// parse one line of list, unsupported line is ignored
+func (d *blockDomains) parseLine(line string) {
+	line = strings.TrimSpace(line)
+	// comment and adblock header
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return
+	}
+	// adblock rule, rule with path or option is not dns rule
+	if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||") {
+		domains := d.suffix
+		if strings.HasPrefix(line, "@@") {
+			domains = d.allow
+			line = line[2:]
+		}
+		line = strings.TrimPrefix(line, "||")
+		line = strings.TrimSuffix(line, "$important")
+		line = strings.TrimSuffix(line, "^")
+		if strings.ContainsAny(line, "/^$*|") || !isDomainName(line) {
+			return
+		}
+		domains[normalizeDomain(line)] = true
+		return
+	}
+	// remove inline comment
+	if index := strings.Index(line, "#"); index >= 0 {
+		line = line[:index]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	// hosts file, [ip] [name]...
+	if net.ParseIP(fields[0]) != nil {
+		for _, name := range fields[1:] {
+			name = normalizeDomain(name)
+			if hostsIgnoreNames[name] || !isDomainName(name) {
+				continue
+			}
+			d.exact[name] = true
+		}
+		return
+	}
+	// plain domain list
+	if len(fields) == 1 && isDomainName(fields[0]) {
+		d.exact[normalizeDomain(fields[0])] = true
+	}
+}
+
+// check if domain is blocked, exception is matched first
+func (d *blockDomains) match(domain string) bool {
+	if d == nil || domain == "" {
+		return false
+	}
+	if matchSuffix(d.allow, domain) {
+		return false
+	}
+	return d.exact[domain] || matchSuffix(d.suffix, domain)
+}
+
+// check if domain or any parent domain is in set
+func matchSuffix(set map[string]bool, domain string) bool {
+	for {
+		if set[domain] {
+			return true
+		}
+		index := strings.Index(domain, ".")
+		if index < 0 {
+			return false
+		}
+		domain = domain[index+1:]
+	}
+}
+
+// check if name is a valid domain with at least one dot
+func isDomainName(name string) bool {
+	_, ok := dns.IsDomainName(name)
+	return ok && strings.Contains(strings.Trim(name, "."), ".") && net.ParseIP(name) == nil
+}
+
+// answer blocked query
+func blockAnswer(r *dns.Msg, mode string) *dns.Msg {
+	m := &dns.Msg{}
+	if mode == config.NXDomainBlockMode {
+		m.SetRcode(r, dns.RcodeNameError)
+		return m
+	}
+	m.SetReply(r)
+	q := r.Question[0]
+	header := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: hostsTTL}
+	switch q.Qtype {
+	case dns.TypeA:
+		m.Answer = append(m.Answer, &dns.A{Hdr: header, A: net.IPv4zero.To4()})
+	case dns.TypeAAAA:
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: header, AAAA: net.IPv6zero})
+	}
+	return m
+}
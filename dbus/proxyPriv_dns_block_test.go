@@ -0,0 +1,65 @@
+package DBus
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	"github.com/miekg/dns"
+)
+
+func TestDnsBlocker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	adblock := filepath.Join(dir, "adblock.txt")
+	_ = ioutil.WriteFile(hosts, []byte("# hosts\n127.0.0.1 localhost\n0.0.0.0 ads.example.com tracker.example.com # inline\n"), 0644)
+	_ = ioutil.WriteFile(adblock, []byte("[Adblock Plus 2.0]\n! comment\n||ad.example.org^\n@@||ok.ad.example.org^\n||example.net/path^\n"), 0644)
+
+	blocker := newDnsBlocker([]string{hosts, adblock, filepath.Join(dir, "missing")})
+	for domain, blocked := range map[string]bool{
+		"ads.example.com.":    true,
+		"tracker.example.com": true,
+		"sub.ads.example.com": false,
+		"localhost":           false,
+		"ad.example.org":      true,
+		"cdn.ad.example.org":  true,
+		"ok.ad.example.org":   false,
+		"a.ok.ad.example.org": false,
+		"example.net":         false,
+		"www.example.com":     false,
+	} {
+		if blocker.isBlocked(domain) != blocked {
+			t.Errorf("%s blocked should be %v", domain, blocked)
+		}
+	}
+
+	// list changed
+	_ = ioutil.WriteFile(hosts, []byte("0.0.0.0 www.example.com\n"), 0644)
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(hosts, future, future)
+	blocker.reloadIfChanged()
+	if !blocker.isBlocked("www.example.com") || blocker.isBlocked("ads.example.com") {
+		t.Error("block list should be reloaded")
+	}
+}
+
+func TestBlockAnswer(t *testing.T) {
+	r := &dns.Msg{}
+	r.SetQuestion("ads.example.com.", dns.TypeA)
+	m := blockAnswer(r, "")
+	if len(m.Answer) != 1 || !m.Answer[0].(*dns.A).A.Equal(net.IPv4zero) {
+		t.Errorf("zero answer is %v", m.Answer)
+	}
+	m = blockAnswer(r, config.NXDomainBlockMode)
+	if m.Rcode != dns.RcodeNameError {
+		t.Errorf("rcode is %s, want NXDOMAIN", dns.RcodeToString[m.Rcode])
+	}
+}
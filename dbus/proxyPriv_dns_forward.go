@@ -0,0 +1,258 @@
+package DBus
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	"github.com/golang/groupcache/lru"
+	"github.com/miekg/dns"
+)
+
+const (
+	resolvConfPath = "/etc/resolv.conf"
+	dnsTimeout     = 3 * time.Second
+	// ttl of negative response which has no soa
+	negativeTTL = 60
+)
+
+// forward dns query to real upstream servers
+type dnsForwarder struct {
+	upstreams []dnsUpstream
+	strategy  string
+	cache     *dnsCache
+}
+
+// create forwarder, use /etc/resolv.conf if upstream is empty
+func newDnsForwarder(cfg config.DNSConfig, dial dnsDialer) (*dnsForwarder, error) {
+	servers := cfg.Upstreams
+	if len(servers) == 0 {
+		conf, err := dns.ClientConfigFromFile(resolvConfPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, server := range conf.Servers {
+			servers = append(servers, net.JoinHostPort(server, conf.Port))
+		}
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no dns upstream found")
+	}
+	// check strategy
+	switch cfg.Strategy {
+	case "":
+		cfg.Strategy = config.FallbackPolicy
+	case config.FallbackPolicy, config.FastestStrategy:
+	default:
+		return nil, fmt.Errorf("dns strategy [%s] is invalid", cfg.Strategy)
+	}
+	if dial == nil {
+		dial = directDial
+	}
+	var upstreams []dnsUpstream
+	for _, server := range servers {
+		upstream, err := newDnsUpstream(server, dial, cfg.ViaProxy)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	size := cfg.CacheSize
+	if size <= 0 {
+		size = cacheMaxSize
+	}
+	return &dnsForwarder{
+		upstreams: upstreams,
+		strategy:  cfg.Strategy,
+		cache:     newDnsCache(size),
+	}, nil
+}
+
+// add default port if not set
+func withDnsPort(server string, port string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), port)
+}
+
+// exchange query with one upstream, server failure is treated as error
+func exchangeUpstream(upstream dnsUpstream, req *dns.Msg) (*dns.Msg, error) {
+	resp, err := upstream.exchange(req)
+	if err != nil {
+		logger.Debugf("exchange dns with upstream %s failed, err: %v", upstream, err)
+		return nil, err
+	}
+	// server failure may be upstream problem, try others
+	if resp.Rcode == dns.RcodeServerFailure {
+		return nil, fmt.Errorf("upstream %s server failure", upstream)
+	}
+	return resp, nil
+}
+
+// exchange query with upstreams by strategy, response is cached by ttl
+func (f *dnsForwarder) exchange(req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) == 0 {
+		return nil, errors.New("dns query has no question")
+	}
+	// check cache
+	resp, ok := f.cache.get(req)
+	if ok {
+		return resp, nil
+	}
+	if f.strategy == config.FastestStrategy {
+		resp, err := f.exchangeFastest(req)
+		if err != nil {
+			return nil, err
+		}
+		f.cache.add(req, resp)
+		return resp, nil
+	}
+	// fallback, try upstreams in order
+	var lastErr error
+	for _, upstream := range f.upstreams {
+		resp, err := exchangeUpstream(upstream, req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		f.cache.add(req, resp)
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// send query to all upstreams at the same time, use the first response
+func (f *dnsForwarder) exchangeFastest(req *dns.Msg) (*dns.Msg, error) {
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	results := make(chan result, len(f.upstreams))
+	for _, upstream := range f.upstreams {
+		go func(upstream dnsUpstream) {
+			// each upstream use its own message copy
+			resp, err := exchangeUpstream(upstream, req.Copy())
+			results <- result{resp: resp, err: err}
+		}(upstream)
+	}
+	var lastErr error
+	for range f.upstreams {
+		res := <-results
+		if res.err == nil {
+			return res.resp, nil
+		}
+		lastErr = res.err
+	}
+	return nil, lastErr
+}
+
+// cache entry
+type dnsCacheEntry struct {
+	msg    *dns.Msg
+	stored time.Time
+	expire time.Time
+}
+
+// dns response cache honoring ttl
+type dnsCache struct {
+	lock  sync.Mutex
+	cache *lru.Cache
+}
+
+func newDnsCache(size int) *dnsCache {
+	return &dnsCache{
+		cache: lru.New(size),
+	}
+}
+
+// cache key is name type class of question
+func dnsCacheKey(q dns.Question) string {
+	return strings.ToLower(q.Name) + "/" + dns.TypeToString[q.Qtype] + "/" + dns.ClassToString[q.Qclass]
+}
+
+// add response to cache, response without ttl is not cached
+func (c *dnsCache) add(req *dns.Msg, resp *dns.Msg) {
+	ttl := msgTTL(resp)
+	if ttl == 0 {
+		return
+	}
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cache.Add(dnsCacheKey(req.Question[0]), &dnsCacheEntry{
+		msg:    resp.Copy(),
+		stored: now,
+		expire: now.Add(time.Duration(ttl) * time.Second),
+	})
+}
+
+// get copy of cached response, ttl is decreased by elapsed time
+func (c *dnsCache) get(req *dns.Msg) (*dns.Msg, bool) {
+	key := dnsCacheKey(req.Question[0])
+	c.lock.Lock()
+	value, ok := c.cache.Get(key)
+	if !ok {
+		c.lock.Unlock()
+		return nil, false
+	}
+	entry := value.(*dnsCacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expire) {
+		c.cache.Remove(key)
+		c.lock.Unlock()
+		return nil, false
+	}
+	msg := entry.msg.Copy()
+	c.lock.Unlock()
+	// decrease ttl
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	msg.Id = req.Id
+	return msg, true
+}
+
+// cache ttl of response, min ttl of answers, or soa ttl of negative response
+func msgTTL(msg *dns.Msg) uint32 {
+	switch msg.Rcode {
+	case dns.RcodeSuccess:
+		if len(msg.Answer) > 0 {
+			ttl := msg.Answer[0].Header().Ttl
+			for _, rr := range msg.Answer[1:] {
+				if rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+				}
+			}
+			return ttl
+		}
+	case dns.RcodeNameError:
+	default:
+		// other error is not cached
+		return 0
+	}
+	// nxdomain and nodata
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl
+			}
+			return soa.Hdr.Ttl
+		}
+	}
+	return negativeTTL
+}
@@ -0,0 +1,395 @@
+package DBus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	"github.com/miekg/dns"
+)
+
+// upstream dns stand-in, count query number
+func startUpstream(t *testing.T, count *int32) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(count, 1)
+		m := &dns.Msg{}
+		m.SetReply(r)
+		q := r.Question[0]
+		switch {
+		case q.Name == "large.example.":
+			for i := 0; i < 20; i++ {
+				rr, _ := dns.NewRR(q.Name + ` 300 IN TXT "` + strings.Repeat(strconv.Itoa(i%10), 100) + `"`)
+				m.Answer = append(m.Answer, rr)
+			}
+		case q.Name == "missing.example.":
+			m.Rcode = dns.RcodeNameError
+			soa, _ := dns.NewRR("example. 300 IN SOA ns.example. admin.example. 1 3600 600 86400 30")
+			m.Ns = append(m.Ns, soa)
+		case q.Qtype == dns.TypeMX:
+			rr, _ := dns.NewRR(q.Name + " 300 IN MX 10 mail.example.")
+			m.Answer = append(m.Answer, rr)
+		case q.Qtype == dns.TypeA:
+			rr, _ := dns.NewRR(q.Name + " 300 IN A 10.0.0.1")
+			m.Answer = append(m.Answer, rr)
+		}
+		_ = w.WriteMsg(m)
+	})
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: mux, NotifyStartedFunc: func() { close(started) }}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	<-started
+	return conn.LocalAddr().String(), func() {
+		_ = server.Shutdown()
+	}
+}
+
+// start proxy dns server with config
+func startProxyDNS(t *testing.T, cfg config.DNSConfig) (string, func()) {
+	prv := &proxyPrv{}
+	prv.Proxies.DNS = cfg
+	p := &proxyDNS{prv: prv}
+	p.prepare()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: p, NotifyStartedFunc: func() { close(started) }}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	<-started
+	return conn.LocalAddr().String(), func() {
+		_ = server.Shutdown()
+	}
+}
+
+func query(t *testing.T, server string, name string, typ uint16) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetQuestion(name, typ)
+	resp, _, err := (&dns.Client{}).Exchange(m, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestProxyDNS_Forward(t *testing.T) {
+	var count int32
+	upstream, stopUpstream := startUpstream(t, &count)
+	defer stopUpstream()
+	server, stop := startProxyDNS(t, config.DNSConfig{
+		Upstreams: []string{upstream},
+		Bypass:    []string{"direct.example"},
+	})
+	defer stop()
+
+	// a query use fake ip
+	resp := query(t, server, "www.example.", dns.TypeA)
+	if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.IP{198, 18, 0, 1}) {
+		t.Errorf("a query answer is %v, want fake ip", resp.Answer)
+	}
+	resp = query(t, server, "www.example.", dns.TypeAAAA)
+	if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("fdfe:dcba:9876::1")) {
+		t.Errorf("aaaa query answer is %v, want fake ip", resp.Answer)
+	}
+	if atomic.LoadInt32(&count) != 0 {
+		t.Error("a and aaaa query should not be forwarded")
+	}
+
+	// mx query is forwarded and cached
+	for i := 0; i < 2; i++ {
+		resp = query(t, server, "www.example.", dns.TypeMX)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeMX {
+			t.Errorf("mx query answer is %v", resp.Answer)
+		}
+	}
+	if atomic.LoadInt32(&count) != 1 {
+		t.Errorf("mx query forward count is %d, want 1", count)
+	}
+
+	// bypass domain use real ip
+	resp = query(t, server, "www.direct.example.", dns.TypeA)
+	if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.IP{10, 0, 0, 1}) {
+		t.Errorf("bypass query answer is %v, want real ip", resp.Answer)
+	}
+
+	// nxdomain is returned
+	resp = query(t, server, "missing.example.", dns.TypeTXT)
+	if resp.Rcode != dns.RcodeNameError {
+		t.Errorf("missing query rcode is %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestProxyDNS_Truncate(t *testing.T) {
+	var count int32
+	upstream, stopUpstream := startUpstream(t, &count)
+	defer stopUpstream()
+	server, stop := startProxyDNS(t, config.DNSConfig{Upstreams: []string{upstream}})
+	defer stop()
+
+	// edns0 client receive the whole answer
+	m := &dns.Msg{}
+	m.SetQuestion("large.example.", dns.TypeTXT)
+	m.SetEdns0(4096, false)
+	resp, _, err := (&dns.Client{}).Exchange(m, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Truncated || len(resp.Answer) != 20 {
+		t.Errorf("edns0 answer count is %d, truncated: %v", len(resp.Answer), resp.Truncated)
+	}
+	// cached answer is truncated to 512 for plain udp client
+	m = &dns.Msg{}
+	m.SetQuestion("large.example.", dns.TypeTXT)
+	resp, _, err = (&dns.Client{}).Exchange(m, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Truncated || len(resp.Answer) >= 20 {
+		t.Errorf("plain answer count is %d, truncated: %v", len(resp.Answer), resp.Truncated)
+	}
+	if atomic.LoadInt32(&count) != 1 {
+		t.Errorf("large query forward count is %d, want 1", count)
+	}
+}
+
+func TestProxyDNS_ServerFailure(t *testing.T) {
+	// upstream not listen
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := conn.LocalAddr().String()
+	_ = conn.Close()
+	server, stop := startProxyDNS(t, config.DNSConfig{
+		Upstreams: []string{upstream},
+	})
+	defer stop()
+	resp := query(t, server, "www.example.", dns.TypeSRV)
+	if resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode is %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestMsgTTL(t *testing.T) {
+	m := &dns.Msg{}
+	a1, _ := dns.NewRR("a.example. 300 IN A 10.0.0.1")
+	a2, _ := dns.NewRR("a.example. 60 IN A 10.0.0.2")
+	m.Answer = []dns.RR{a1, a2}
+	if ttl := msgTTL(m); ttl != 60 {
+		t.Errorf("answer ttl is %d, want 60", ttl)
+	}
+	m = &dns.Msg{}
+	m.Rcode = dns.RcodeNameError
+	if ttl := msgTTL(m); ttl != negativeTTL {
+		t.Errorf("negative ttl is %d, want %d", ttl, negativeTTL)
+	}
+	m.Rcode = dns.RcodeRefused
+	if ttl := msgTTL(m); ttl != 0 {
+		t.Errorf("refused ttl is %d, want 0", ttl)
+	}
+}
+
+// answer a query with fixed ip
+func answerA(r *dns.Msg) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetReply(r)
+	rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 10.0.0.2")
+	m.Answer = append(m.Answer, rr)
+	return m
+}
+
+func TestEncryptedUpstream(t *testing.T) {
+	// dns over https stand-in
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		req := &dns.Msg{}
+		if r.Header.Get("Content-Type") != "application/dns-message" || req.Unpack(buf) != nil || req.Id != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		buf, _ = answerA(req).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(buf)
+	}))
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	// dns over tls stand-in, use the same cert
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: server.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dotServer := &dns.Server{Listener: listener, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		_ = w.WriteMsg(answerA(r))
+	})}
+	go func() {
+		_ = dotServer.ActivateAndServe()
+	}()
+	defer dotServer.Shutdown()
+
+	for _, addr := range []string{server.URL + "/dns-query", "tls://" + listener.Addr().String()} {
+		upstream, err := newDnsUpstream(addr, directDial, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// trust test cert
+		switch up := upstream.(type) {
+		case *httpsUpstream:
+			up.client.Transport.(*http.Transport).TLSClientConfig.RootCAs = pool
+		case *tlsUpstream:
+			up.config.RootCAs = pool
+		}
+		req := &dns.Msg{}
+		req.SetQuestion("www.example.", dns.TypeA)
+		resp, err := upstream.exchange(req)
+		if err != nil {
+			t.Fatalf("exchange with %s failed, err: %v", upstream, err)
+		}
+		if resp.Id != req.Id || len(resp.Answer) != 1 {
+			t.Errorf("%s response is invalid: %v", upstream, resp)
+		}
+	}
+}
+
+func TestDnsForwarder_Fastest(t *testing.T) {
+	var count int32
+	upstream, stop := startUpstream(t, &count)
+	defer stop()
+	// the first upstream never answer
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	forwarder, err := newDnsForwarder(config.DNSConfig{
+		Upstreams: []string{conn.LocalAddr().String(), upstream},
+		Strategy:  config.FastestStrategy,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.", dns.TypeMX)
+	begin := time.Now()
+	resp, err := forwarder.exchange(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || time.Since(begin) >= dnsTimeout {
+		t.Errorf("fastest response is %v, cost %v", resp.Answer, time.Since(begin))
+	}
+}
+
+func TestProxyDNS_TCP(t *testing.T) {
+	var count int32
+	upstream, stopUpstream := startUpstream(t, &count)
+	defer stopUpstream()
+	// find free port for both udp and tcp
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	prv := &proxyPrv{}
+	prv.Proxies.DNSPort = port
+	prv.Proxies.DNS = config.DNSConfig{Upstreams: []string{upstream}}
+	// fake ip is persisted in temp dir instead of system config dir
+	poolPath := filepath.Join(t.TempDir(), "fake_ip.json")
+	p := &proxyDNS{prv: prv, poolPath: poolPath}
+	err = p.startDNSProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := listener.Addr().String()
+	for _, network := range []string{"udp", "tcp"} {
+		m := &dns.Msg{}
+		m.SetQuestion("www.example.", dns.TypeMX)
+		resp, _, err := (&dns.Client{Net: network}).Exchange(m, server)
+		if err != nil || len(resp.Answer) != 1 {
+			t.Errorf("%s query failed, resp: %v, err: %v", network, resp, err)
+		}
+	}
+	_ = query(t, server, "www.example.", dns.TypeA)
+	p.stopDNSProxy()
+	if _, err := net.DialTimeout("tcp", server, time.Second); err == nil {
+		t.Error("tcp server should be stopped")
+	}
+	if _, err := os.Stat(poolPath); err != nil {
+		t.Errorf("fake ip is not saved to %s, err: %v", poolPath, err)
+	}
+}
+
+func TestProxyDNS_Policy(t *testing.T) {
+	var count, corpCount int32
+	upstream, stopUpstream := startUpstream(t, &count)
+	defer stopUpstream()
+	corp, stopCorp := startUpstream(t, &corpCount)
+	defer stopCorp()
+	server, stop := startProxyDNS(t, config.DNSConfig{
+		Upstreams: []string{upstream},
+		Policies: []config.DNSPolicy{
+			{Domains: []string{"corp.example"}, Action: config.ForwardAction, Upstreams: []string{corp}},
+			{Domains: []string{"www.corp.example"}, Action: config.FakeIPAction},
+			{Domains: []string{"home"}, Action: config.HostsAction, Hosts: map[string][]string{"nas.home": {"192.168.1.10"}}},
+		},
+	})
+	defer stop()
+
+	// forward to corp upstream
+	resp := query(t, server, "git.corp.example.", dns.TypeA)
+	if len(resp.Answer) != 1 || atomic.LoadInt32(&corpCount) != 1 || atomic.LoadInt32(&count) != 0 {
+		t.Errorf("corp query answer is %v, want forward to corp upstream", resp.Answer)
+	}
+	// longest suffix use fake ip
+	resp = query(t, server, "www.corp.example.", dns.TypeA)
+	if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.IP{198, 18, 0, 1}) {
+		t.Errorf("www query answer is %v, want fake ip", resp.Answer)
+	}
+	// static hosts
+	resp = query(t, server, "nas.home.", dns.TypeA)
+	if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.IP{192, 168, 1, 10}) {
+		t.Errorf("hosts query answer is %v", resp.Answer)
+	}
+	resp = query(t, server, "tv.home.", dns.TypeA)
+	if resp.Rcode != dns.RcodeNameError {
+		t.Errorf("hosts query rcode is %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestDnsPolicyTable_Invalid(t *testing.T) {
+	_, err := newDnsPolicyTable(config.DNSConfig{
+		Policies: []config.DNSPolicy{{Domains: []string{"home"}, Action: "drop"}},
+	})
+	if err == nil {
+		t.Error("invalid action should fail")
+	}
+	_, err = newDnsPolicyTable(config.DNSConfig{
+		Policies: []config.DNSPolicy{{Domains: []string{"home"}, Action: config.HostsAction, Hosts: map[string][]string{"nas.home": {"nas"}}}},
+	})
+	if err == nil {
+		t.Error("invalid hosts ip should fail")
+	}
+}
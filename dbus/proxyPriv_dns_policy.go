@@ -0,0 +1,151 @@
+package DBus
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	"github.com/miekg/dns"
+)
+
+// ttl of static hosts answer
+const hostsTTL = 60
+
+// policy of matched domain suffix
+type dnsPolicy struct {
+	action    string
+	forwarder *dnsForwarder
+	hosts     map[string][]net.IP // [domain] -> [ip]
+}
+
+// split dns table, [domain suffix] -> policy
+type dnsPolicyTable struct {
+	suffixes map[string]*dnsPolicy
+}
+
+// normalize domain to lower case without root dot
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.Trim(domain, "."))
+}
+
+// create policy table from config, return nil if no policy
+func newDnsPolicyTable(cfg config.DNSConfig) (*dnsPolicyTable, error) {
+	if len(cfg.Policies) == 0 {
+		return nil, nil
+	}
+	table := &dnsPolicyTable{
+		suffixes: make(map[string]*dnsPolicy),
+	}
+	for _, item := range cfg.Policies {
+		if len(item.Domains) == 0 {
+			return nil, errors.New("dns policy has no domain")
+		}
+		policy := &dnsPolicy{
+			action: item.Action,
+		}
+		switch item.Action {
+		case config.FakeIPAction:
+		case config.ForwardAction:
+			// policy upstreams are dialed directly or from interface
+			upstreams := item.Upstreams
+			if len(upstreams) == 0 {
+				upstreams = cfg.Upstreams
+			}
+			var dial dnsDialer
+			if item.Interface != "" {
+				dial = interfaceDial(item.Interface)
+			}
+			forwarder, err := newDnsForwarder(config.DNSConfig{
+				Upstreams: upstreams,
+				Strategy:  cfg.Strategy,
+				CacheSize: cfg.CacheSize,
+			}, dial)
+			if err != nil {
+				return nil, err
+			}
+			policy.forwarder = forwarder
+		case config.HostsAction:
+			policy.hosts = make(map[string][]net.IP)
+			for domain, ips := range item.Hosts {
+				domain = normalizeDomain(domain)
+				for _, value := range ips {
+					ip := net.ParseIP(value)
+					if ip == nil {
+						return nil, fmt.Errorf("hosts ip [%s] of [%s] is invalid", value, domain)
+					}
+					policy.hosts[domain] = append(policy.hosts[domain], ip)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("dns policy action [%s] is invalid", item.Action)
+		}
+		for _, domain := range item.Domains {
+			table.suffixes[normalizeDomain(domain)] = policy
+		}
+	}
+	return table, nil
+}
+
+// find policy of the longest matched suffix, return nil if not found
+func (t *dnsPolicyTable) match(domain string) *dnsPolicy {
+	if t == nil {
+		return nil
+	}
+	domain = normalizeDomain(domain)
+	for {
+		if policy, ok := t.suffixes[domain]; ok {
+			return policy
+		}
+		index := strings.Index(domain, ".")
+		if index < 0 {
+			return nil
+		}
+		domain = domain[index+1:]
+	}
+}
+
+// answer query from static hosts, domain not found is nxdomain
+func (policy *dnsPolicy) answer(r *dns.Msg) *dns.Msg {
+	m := &dns.Msg{}
+	q := r.Question[0]
+	ips, ok := policy.hosts[normalizeDomain(q.Name)]
+	if !ok {
+		m.SetRcode(r, dns.RcodeNameError)
+		return m
+	}
+	m.SetReply(r)
+	m.Authoritative = true
+	for _, ip := range ips {
+		header := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: hostsTTL}
+		switch {
+		case q.Qtype == dns.TypeA && ip.To4() != nil:
+			header.Rrtype = dns.TypeA
+			m.Answer = append(m.Answer, &dns.A{Hdr: header, A: ip.To4()})
+		case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+			header.Rrtype = dns.TypeAAAA
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	}
+	return m
+}
+
+// dial upstream from interface, such as vpn tun device
+func interfaceDial(iface string) dnsDialer {
+	dialer := &net.Dialer{
+		Timeout: dnsTimeout,
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			var bindErr error
+			err := conn.Control(func(fd uintptr) {
+				bindErr = syscall.BindToDevice(int(fd), iface)
+			})
+			if err != nil {
+				return err
+			}
+			return bindErr
+		},
+	}
+	return dialer.Dial
+}
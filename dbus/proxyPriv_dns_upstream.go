@@ -0,0 +1,213 @@
+package DBus
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dial func of upstream, may dial through proxy
+type dnsDialer func(network string, addr string) (net.Conn, error)
+
+// dial upstream directly
+func directDial(network string, addr string) (net.Conn, error) {
+	return net.DialTimeout(network, addr, dnsTimeout)
+}
+
+// dns upstream server
+type dnsUpstream interface {
+	exchange(req *dns.Msg) (*dns.Msg, error)
+	String() string
+}
+
+// create upstream from config
+/*
+	8.8.8.8 or udp://8.8.8.8:53   plain dns, truncated response retry with tcp
+	tcp://8.8.8.8:53              plain dns over tcp
+	tls://dns.google:853          dns over tls
+	https://dns.google/dns-query  dns over https
+*/
+func newDnsUpstream(upstream string, dial dnsDialer, viaProxy bool) (dnsUpstream, error) {
+	if !strings.Contains(upstream, "://") {
+		upstream = "udp://" + upstream
+	}
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("dns upstream [%s] has no host", upstream)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		// udp cant be sent through tcp tunnel
+		network := u.Scheme
+		if viaProxy {
+			network = "tcp"
+		}
+		return &plainUpstream{
+			addr:    withDnsPort(u.Host, "53"),
+			network: network,
+			dial:    dial,
+		}, nil
+	case "tls":
+		return &tlsUpstream{
+			addr: withDnsPort(u.Host, "853"),
+			config: &tls.Config{
+				ServerName: u.Hostname(),
+			},
+			dial: dial,
+		}, nil
+	case "https":
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				return dial(network, addr)
+			},
+			TLSClientConfig: &tls.Config{
+				ServerName: u.Hostname(),
+			},
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   90 * time.Second,
+		}
+		return &httpsUpstream{
+			url: u.String(),
+			client: &http.Client{
+				Transport: transport,
+				Timeout:   dnsTimeout,
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("dns upstream scheme [%s] is not support", u.Scheme)
+	}
+}
+
+// exchange dns message on stream or packet conn, conn is closed after exchange
+func exchangeConn(conn net.Conn, req *dns.Msg) (*dns.Msg, error) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dnsTimeout))
+	co := &dns.Conn{Conn: conn, UDPSize: dns.MaxMsgSize}
+	err := co.WriteMsg(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := co.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Id != req.Id {
+		return nil, dns.ErrId
+	}
+	return resp, nil
+}
+
+// plain dns upstream
+type plainUpstream struct {
+	addr    string
+	network string
+	dial    dnsDialer
+}
+
+func (up *plainUpstream) exchange(req *dns.Msg) (*dns.Msg, error) {
+	conn, err := up.dial(up.network, up.addr)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := exchangeConn(conn, req)
+	// truncated response should retry with tcp
+	if err == nil && resp.Truncated && up.network == "udp" {
+		conn, err = up.dial("tcp", up.addr)
+		if err != nil {
+			return nil, err
+		}
+		return exchangeConn(conn, req)
+	}
+	return resp, err
+}
+
+func (up *plainUpstream) String() string {
+	return up.network + "://" + up.addr
+}
+
+// dns over tls upstream
+type tlsUpstream struct {
+	addr   string
+	config *tls.Config
+	dial   dnsDialer
+}
+
+func (up *tlsUpstream) exchange(req *dns.Msg) (*dns.Msg, error) {
+	conn, err := up.dial("tcp", up.addr)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(dnsTimeout))
+	tlsConn := tls.Client(conn, up.config)
+	err = tlsConn.Handshake()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return exchangeConn(tlsConn, req)
+}
+
+func (up *tlsUpstream) String() string {
+	return "tls://" + up.addr
+}
+
+// dns over https upstream, connection is kept alive by http client
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (up *httpsUpstream) exchange(req *dns.Msg) (*dns.Msg, error) {
+	// https://datatracker.ietf.org/doc/html/rfc8484#section-4.1, id should be 0 for cache
+	msg := req.Copy()
+	msg.Id = 0
+	buf, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, up.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+	httpResp, err := up.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns over https response status: %s", httpResp.Status)
+	}
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp := &dns.Msg{}
+	err = resp.Unpack(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Question) == 0 {
+		return nil, errors.New("dns over https response has no question")
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
+
+func (up *httpsUpstream) String() string {
+	return up.url
+}
@@ -0,0 +1,236 @@
+package DBus
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
+	tProxy "github.com/ArisAachen/deepin-network-proxy/tproxy"
+)
+
+const (
+	defaultProbeTarget   = "www.baidu.com:80"
+	defaultProbeInterval = 60
+	probeTimeout         = 5 * time.Second
+)
+
+// group member state
+type groupMember struct {
+	proxy config.Proxy
+	typ   tProxy.ProtoTyp
+
+	// probe result
+	healthy bool
+	latency time.Duration
+}
+
+// proxy group, select healthy member and probe member in background
+type proxyGroup struct {
+	scope  define.Scope
+	name   string
+	policy string
+
+	// probe message
+	target   string
+	interval time.Duration
+
+	lock    sync.Mutex
+	members []*groupMember
+	next    int // round robin index
+
+	stop chan bool
+}
+
+// build tcp proto from config proto
+func buildTcpProto(proto string) (tProxy.ProtoTyp, error) {
+	switch proto {
+	case define.SOCK5, "socks5":
+		return tProxy.SOCK5TCP, nil
+	case define.SHADOWSOCKS:
+		return tProxy.SHADOWSOCKSTCP, nil
+	default:
+		return tProxy.BuildProto(proto)
+	}
+}
+
+// create proxy group from config
+func newProxyGroup(scope define.Scope, group config.ProxyGroup, proxies []config.Proxy) (*proxyGroup, error) {
+	pg := &proxyGroup{
+		scope:    scope,
+		name:     group.Name,
+		policy:   group.Policy,
+		target:   group.ProbeTarget,
+		interval: time.Duration(group.ProbeInterval) * time.Second,
+		stop:     make(chan bool),
+	}
+	if pg.target == "" {
+		pg.target = defaultProbeTarget
+	}
+	if pg.interval <= 0 {
+		pg.interval = defaultProbeInterval * time.Second
+	}
+	for _, proxy := range proxies {
+		typ, err := buildTcpProto(proxy.ProtoType)
+		if err != nil {
+			return nil, err
+		}
+		// member is healthy until probe failed
+		pg.members = append(pg.members, &groupMember{
+			proxy:   proxy,
+			typ:     typ,
+			healthy: true,
+		})
+	}
+	return pg, nil
+}
+
+// start probe members in background
+func (pg *proxyGroup) start() {
+	go func() {
+		ticker := time.NewTicker(pg.interval)
+		defer ticker.Stop()
+		for {
+			pg.probeAll()
+			select {
+			case <-pg.stop:
+				logger.Debugf("[%s] group [%s] stop probe", pg.scope, pg.name)
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stop probe
+func (pg *proxyGroup) release() {
+	close(pg.stop)
+}
+
+// probe all members at the same time
+func (pg *proxyGroup) probeAll() {
+	var wg sync.WaitGroup
+	for _, member := range pg.members {
+		wg.Add(1)
+		go func(member *groupMember) {
+			defer wg.Done()
+			latency, err := pg.probe(member)
+			if err != nil {
+				logger.Warningf("[%s] group [%s] probe member [%s/%s] failed, err: %v",
+					pg.scope, pg.name, member.proxy.ProtoType, member.proxy.Name, err)
+				pg.markFailed(member)
+				return
+			}
+			logger.Debugf("[%s] group [%s] probe member [%s/%s] success, latency: %v",
+				pg.scope, pg.name, member.proxy.ProtoType, member.proxy.Name, latency)
+			pg.lock.Lock()
+			member.healthy = true
+			member.latency = latency
+			pg.lock.Unlock()
+		}(member)
+	}
+	wg.Wait()
+}
+
+// create tunnel through member to probe target
+func (pg *proxyGroup) probe(member *groupMember) (time.Duration, error) {
+	rAddr, err := parseTargetAddr(pg.target, member.typ)
+	if err != nil {
+		return 0, err
+	}
+	// probe handler has no local conn
+	lAddr := &net.TCPAddr{}
+	handler := tProxy.NewHandler(member.typ, pg.scope, tProxy.HandlerKey{}, member.proxy, lAddr, rAddr, nil)
+	if handler == nil {
+		return 0, errors.New("proto is not support")
+	}
+	// handshake may hang, wait with timeout, conn is closed by deadline so tunnel dont leak
+	begin := time.Now()
+	if limit, ok := handler.(interface{ SetTunnelDeadline(time.Time) }); ok {
+		limit.SetTunnelDeadline(begin.Add(probeTimeout))
+	}
+	result := make(chan error, 1)
+	go func() {
+		err := handler.Tunnel()
+		handler.Close()
+		result <- err
+	}()
+	select {
+	case err = <-result:
+		if err != nil {
+			return 0, err
+		}
+		return time.Since(begin), nil
+	case <-time.After(probeTimeout):
+		return 0, errors.New("probe timeout")
+	}
+}
+
+// parse [host]:[port] to tcp or domain addr, sock4 only support ipv4
+func parseTargetAddr(target string, typ tProxy.ProtoTyp) (net.Addr, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+	if typ == tProxy.SOCK4 {
+		return net.ResolveTCPAddr("tcp4", target)
+	}
+	return com.NewDomainAddr("tcp", host, port), nil
+}
+
+// mark member unhealthy, member is used again after probe success
+func (pg *proxyGroup) markFailed(member *groupMember) {
+	pg.lock.Lock()
+	defer pg.lock.Unlock()
+	member.healthy = false
+}
+
+// get members in try order, unhealthy members are tried at last
+func (pg *proxyGroup) candidates() []*groupMember {
+	pg.lock.Lock()
+	defer pg.lock.Unlock()
+	var healthy, unhealthy []*groupMember
+	for _, member := range pg.members {
+		if member.healthy {
+			healthy = append(healthy, member)
+		} else {
+			unhealthy = append(unhealthy, member)
+		}
+	}
+	switch pg.policy {
+	case config.RoundRobinPolicy:
+		if len(healthy) > 0 {
+			index := pg.next % len(healthy)
+			rotated := make([]*groupMember, 0, len(healthy))
+			rotated = append(rotated, healthy[index:]...)
+			healthy = append(rotated, healthy[:index]...)
+			pg.next++
+		}
+	case config.LeastLatencyPolicy:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].latency < healthy[j].latency
+		})
+	}
+	return append(healthy, unhealthy...)
+}
+
+// all member proto types, use to close handler
+func (pg *proxyGroup) protoTyps() []tProxy.ProtoTyp {
+	var typs []tProxy.ProtoTyp
+	for _, member := range pg.members {
+		typs = append(typs, member.typ)
+	}
+	return typs
+}
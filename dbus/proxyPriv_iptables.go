@@ -9,6 +9,56 @@ import (
 	newIptables "github.com/ArisAachen/deepin-network-proxy/new_iptables"
 )
 
+// suffix of nat chain which hijack dns query
+const dnsChainSuffix = "_DNS"
+
+// create chains and rules of scope in one transaction, nothing is left when failed
+func (mgr *proxyPrv) applyTable() error {
+	mgr.manager.iptablesLock.Lock()
+	defer mgr.manager.iptablesLock.Unlock()
+	tx, err := mgr.manager.iptablesMgr.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = mgr.createTable()
+	if err == nil {
+		err = mgr.appendRule()
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		// chains are discarded
+		mgr.chains[1] = nil
+		mgr.chains[2] = nil
+		return err
+	}
+	return nil
+}
+
+// remove chains and rules of scope in one transaction
+func (mgr *proxyPrv) removeTable() error {
+	mgr.manager.iptablesLock.Lock()
+	defer mgr.manager.iptablesLock.Unlock()
+	tx, err := mgr.manager.iptablesMgr.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// dns chain is set to nil when release
+	dnsChain := mgr.chains[2]
+	err = mgr.releaseRule()
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		mgr.chains[2] = dnsChain
+		return err
+	}
+	return nil
+}
+
 // create tables
 func (mgr *proxyPrv) createTable() error {
 	// start manager to init iptables and cgroups once
@@ -36,76 +86,178 @@ func (mgr *proxyPrv) createTable() error {
 		mark = true
 	}
 
-	// command line
-	// iptables -t mangle -I main $1 -p tcp -m cgroup --path app.slice/global.slice -j app/global
+	var childChain *newIptables.Chain
+	for protoIndex, proto := range mgr.protos() {
+		// command line
+		// iptables -t mangle -I main $1 -p tcp -m cgroup --path app.slice/global.slice -j app/global
+		// iptables -t mangle -I main $1 -p udp -m cgroup --path app.slice/global.slice -j app/global
+		cpl := &newIptables.CompleteRule{
+			// -j app/global
+			Action: mgr.scope.String(),
+			// base rules slice         -p tcp
+			BaseSl: []newIptables.BaseRule{
+				{
+					Match: "p",
+					Param: proto,
+				},
+			},
+			// extends rules slice       -m cgroup --path app.slice/global.slice
+			ExtendsSl: []newIptables.ExtendsRule{
+				{
+					Match: "m",
+					Elem: newIptables.ExtendsElem{
+						Match: "cgroup",
+						Base:  newIptables.BaseRule{Not: mark, Match: "path", Param: mgr.controller.GetName()},
+					},
+				},
+			},
+			// -m comment --comment deepin-network-proxy:$instance:App
+			Comment: mgr.manager.ownerTag(mgr.scope),
+		}
+		// child chain is created by first rule, others jump to it
+		if childChain == nil {
+			chain, err := mgr.manager.mainChain.CreateChild(mgr.scope.String(), index, cpl)
+			if err != nil {
+				return err
+			}
+			childChain = chain
+			continue
+		}
+		err := mgr.manager.mainChain.InsertRule(index+protoIndex, cpl)
+		if err != nil {
+			return err
+		}
+	}
+
+	// save chain
+	mgr.chains[1] = childChain
+
+	// hijack dns query
+	if mgr.Proxies.DNSPort != 0 {
+		// query redirected to dns proxy should not be marked, or it is tproxy to t-port
+		// iptables -t mangle -A App -j RETURN -p udp -m udp --dport 53
+		for _, proto := range mgr.protos() {
+			err := childChain.AppendRule(&newIptables.CompleteRule{
+				Action: newIptables.RETURN,
+				BaseSl: []newIptables.BaseRule{
+					{
+						Match: "p",
+						Param: proto,
+					},
+				},
+				ExtendsSl: []newIptables.ExtendsRule{
+					{
+						Match: "m",
+						Elem: newIptables.ExtendsElem{
+							Match: proto,
+							Base:  newIptables.BaseRule{Match: "dport", Param: "53"},
+						},
+					},
+				},
+				Comment: mgr.manager.ownerTag(mgr.scope),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		err := mgr.createDNSTable(mark)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protocol redirected to t-port, udp is redirected only when udp listener is opened
+func (mgr *proxyPrv) protos() []string {
+	if mgr.udpHandler != nil {
+		return []string{"tcp", "udp"}
+	}
+	return []string{"tcp"}
+}
+
+// redirect udp and tcp dns query to dns proxy
+func (mgr *proxyPrv) createDNSTable(mark bool) error {
+	chain := mgr.manager.iptablesMgr.GetChain("nat", "OUTPUT")
+	if chain == nil {
+		logger.Warningf("[%s] has no nat OUTPUT chain", mgr.scope)
+		return errors.New("has no nat OUTPUT chain")
+	}
+	name := mgr.scope.String() + dnsChainSuffix
+	// app chain is in front of global chain
+	index := chain.GetRulesCount()
+	if mgr.scope == define.App {
+		pos, exist := chain.GetCreateChildIndex(define.Global.String() + dnsChainSuffix)
+		if exist {
+			index = pos
+		}
+	}
+	// iptables -t nat -I OUTPUT $1 -j App_DNS -m cgroup --path app.slice
 	cpl := &newIptables.CompleteRule{
-		// -j app/global
-		Action: mgr.scope.String(),
-		// base rules slice         -p tcp
-		BaseSl: []newIptables.BaseRule{
+		Action: name,
+		ExtendsSl: []newIptables.ExtendsRule{
 			{
-				Match: "p",
-				Param: "tcp",
+				Match: "m",
+				Elem: newIptables.ExtendsElem{
+					Match: "cgroup",
+					Base:  newIptables.BaseRule{Not: mark, Match: "path", Param: mgr.controller.GetName()},
+				},
 			},
 		},
-		// extends rules slice       -m cgroup --path app.slice/global.slice
+		Comment: mgr.manager.ownerTag(mgr.scope),
+	}
+	childChain, err := chain.CreateChild(name, index, cpl)
+	if err != nil {
+		return err
+	}
+	mgr.chains[2] = childChain
+
+	// query of daemon self go to upstream, or it is redirected to dns proxy again
+	// iptables -t nat -A App_DNS -m cgroup --path main.slice -j RETURN
+	cpl = &newIptables.CompleteRule{
+		Action: newIptables.RETURN,
 		ExtendsSl: []newIptables.ExtendsRule{
 			{
 				Match: "m",
 				Elem: newIptables.ExtendsElem{
 					Match: "cgroup",
-					Base:  newIptables.BaseRule{Not: mark, Match: "path", Param: mgr.controller.GetName()},
+					Base:  newIptables.BaseRule{Match: "path", Param: define.Main.String() + ".slice"},
 				},
 			},
 		},
+		Comment: mgr.manager.ownerTag(mgr.scope),
 	}
-	// child chain
-	childChain, err := mgr.manager.mainChain.CreateChild(mgr.scope.String(), index, cpl)
+	err = childChain.AppendRule(cpl)
 	if err != nil {
 		return err
 	}
 
-	// save chain
-	mgr.chains[1] = childChain
-
-	if mgr.Proxies.DNSPort != 0 {
-		chain := mgr.manager.iptablesMgr.GetChain("nat", "OUTPUT")
-		if chain == nil {
-			logger.Warningf("[%s] has no nat OUTPUT chain", mgr.scope)
-			return errors.New("has no nat OUTPUT chain")
-		}
-
+	// iptables -t nat -A App_DNS -j REDIRECT -p udp --to-ports $2 -m udp --dport 53
+	for _, proto := range []string{"udp", "tcp"} {
 		cpl := &newIptables.CompleteRule{
 			Action: newIptables.REDIRECT,
 			BaseSl: []newIptables.BaseRule{
 				{
 					Match: "p",
-					Param: "udp",
+					Param: proto,
 				},
 				{
 					Match: "-to-ports",
-					Param: "1053",
+					Param: strconv.Itoa(mgr.Proxies.DNSPort),
 				},
 			},
 			ExtendsSl: []newIptables.ExtendsRule{
 				{
 					Match: "m",
 					Elem: newIptables.ExtendsElem{
-						Match: "cgroup",
-						Base:  newIptables.BaseRule{Not: mark, Match: "path", Param: mgr.controller.GetName()},
-					},
-				},
-				{
-					Match: "m",
-					Elem: newIptables.ExtendsElem{
-						Match: "udp",
-						Base:  newIptables.BaseRule{Not: mark, Match: "dport", Param: "53"},
+						Match: proto,
+						Base:  newIptables.BaseRule{Match: "dport", Param: "53"},
 					},
 				},
 			},
+			Comment: mgr.manager.ownerTag(mgr.scope),
 		}
-
-		err := childChain.AppendRule(cpl)
+		err = childChain.AppendRule(cpl)
 		if err != nil {
 			return err
 		}
@@ -131,7 +283,8 @@ func (mgr *proxyPrv) appendRule() error {
 		// -j MARK
 		Action: newIptables.MARK,
 		// --set-mark $2
-		BaseSl: []newIptables.BaseRule{base},
+		BaseSl:  []newIptables.BaseRule{base},
+		Comment: mgr.manager.ownerTag(mgr.scope),
 	}
 	// append
 	err := selfChain.AppendRule(cpl)
@@ -145,20 +298,6 @@ func (mgr *proxyPrv) appendRule() error {
 		logger.Warningf("[%s] cant add rule, chain is nil", mgr.scope)
 		return errors.New("chain is nil")
 	}
-	// iptables -t mangle -A PREROUTING -j TPROXY -m mark --mark $2 --on-port 8080
-	protoExtends := newIptables.ExtendsRule{
-		// -m
-		Match: "p",
-		// mark --mark $2
-		Elem: newIptables.ExtendsElem{
-			// mark
-			Match: "tcp",
-			// --mark $2
-			Base: newIptables.BaseRule{
-				Match: "on-port", Param: strconv.Itoa(mgr.Proxies.TPort),
-			},
-		},
-	}
 	markExtends := newIptables.ExtendsRule{
 		// -m
 		Match: "m",
@@ -172,24 +311,50 @@ func (mgr *proxyPrv) appendRule() error {
 			},
 		},
 	}
-	// one complete rule
-	cpl = &newIptables.CompleteRule{
-		// -j TPROXY
-		Action: newIptables.TPROXY,
-		BaseSl: nil,
-		// -m mark --mark $2
-		ExtendsSl: []newIptables.ExtendsRule{protoExtends, markExtends},
-	}
-	// append
-	err = defChain.AppendRule(cpl)
-	if err != nil {
-		return err
+	// iptables -t mangle -A PREROUTING -j TPROXY -p tcp --on-port 8080 -m mark --mark $2
+	// iptables -t mangle -A PREROUTING -j TPROXY -p udp --on-port 8080 -m mark --mark $2
+	for _, proto := range mgr.protos() {
+		protoExtends := newIptables.ExtendsRule{
+			// -p
+			Match: "p",
+			// tcp --on-port $2
+			Elem: newIptables.ExtendsElem{
+				// tcp or udp
+				Match: proto,
+				// --on-port $2
+				Base: newIptables.BaseRule{
+					Match: "on-port", Param: strconv.Itoa(mgr.Proxies.TPort),
+				},
+			},
+		}
+		// one complete rule
+		cpl = &newIptables.CompleteRule{
+			// -j TPROXY
+			Action: newIptables.TPROXY,
+			BaseSl: nil,
+			// -m mark --mark $2
+			ExtendsSl: []newIptables.ExtendsRule{protoExtends, markExtends},
+			Comment:   mgr.manager.ownerTag(mgr.scope),
+		}
+		// append
+		err = defChain.AppendRule(cpl)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 // delete chain and remove from parent
 func (mgr *proxyPrv) releaseRule() error {
+	// clear dns chain, only exist when dns port is set
+	if dnsChain := mgr.chains[2]; dnsChain != nil {
+		err := dnsChain.Remove()
+		if err != nil {
+			logger.Warningf("[%s] remove dns chain failed, err: %v", mgr.scope, err)
+		}
+		mgr.chains[2] = nil
+	}
 	// clear self chain
 	selfChain := mgr.chains[1]
 	if selfChain == nil {
@@ -208,42 +373,9 @@ func (mgr *proxyPrv) releaseRule() error {
 		logger.Warningf("[%s] default chain is nil", mgr.scope)
 		return fmt.Errorf("[%s] default chain is nil", mgr.scope)
 	}
-	// iptables -t mangle -D PREROUTING -j TPROXY -m mark --mark $2 --on-port 8080
-	protoExtends := newIptables.ExtendsRule{
-		// -m
-		Match: "p",
-		// mark --mark $2
-		Elem: newIptables.ExtendsElem{
-			// mark
-			Match: "tcp",
-			// --mark $2
-			Base: newIptables.BaseRule{
-				Match: "on-port", Param: strconv.Itoa(mgr.Proxies.TPort),
-			},
-		},
-	}
-	markExtends := newIptables.ExtendsRule{
-		// -m
-		Match: "m",
-		// mark --mark $2
-		Elem: newIptables.ExtendsElem{
-			// mark
-			Match: "mark",
-			// --mark $2
-			Base: newIptables.BaseRule{
-				Match: "mark", Param: strconv.Itoa(mgr.Proxies.TPort),
-			},
-		},
-	}
-	// one complete rule
-	cpl := &newIptables.CompleteRule{
-		// -j TPROXY
-		Action: newIptables.TPROXY,
-		BaseSl: nil,
-		// -m mark --mark $2
-		ExtendsSl: []newIptables.ExtendsRule{protoExtends, markExtends},
-	}
-	err = defChain.DelRule(cpl)
+	// delete rules of scope by owner tag, tport may be changed since start
+	// iptables -t mangle -D PREROUTING -j TPROXY ... -m comment --comment deepin-network-proxy:$instance:App
+	err = defChain.DelRulesByOwner(mgr.manager.ownerTag(mgr.scope))
 	if err != nil {
 		logger.Warningf("[%s] delete rule failed, err: %v", mgr.scope, err)
 		return err
@@ -253,5 +385,10 @@ func (mgr *proxyPrv) releaseRule() error {
 
 // release controller
 func (mgr *proxyPrv) releaseController() error {
-	return mgr.controller.ReleaseAll()
+	err := mgr.controller.ReleaseAll()
+	if err != nil {
+		return err
+	}
+	mgr.manager.journal.delCGroup(mgr.controller.GetCGroupPath())
+	return nil
 }
@@ -3,6 +3,8 @@ package DBus
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
@@ -10,15 +12,20 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	com "github.com/ArisAachen/deepin-network-proxy/com"
 	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
 	newCGroups "github.com/ArisAachen/deepin-network-proxy/new_cgroups"
 	tProxy "github.com/ArisAachen/deepin-network-proxy/tproxy"
 	"github.com/godbus/dbus"
 	"github.com/linuxdeepin/go-lib/dbusutil"
 )
 
+// wait time of first client data to sniff domain
+const sniffTimeout = 300 * time.Millisecond
+
 // interface path
 func (mgr *proxyPrv) GetInterfaceName() string {
 	return BusInterface + "." + mgr.scope.String()
@@ -69,64 +76,76 @@ func (mgr *proxyPrv) StartProxy(sender dbus.Sender, proto string, name string, u
 	//}
 	//mgr.stop = false
 	logger.Debugf("[%s] start proxy, proto [%s] name [%s] udp [%v]", mgr.scope, proto, name, udp)
-	// check if proto is legal
-	var proxyTyp tProxy.ProtoTyp
-	if proto == "socks5" {
-		// never err
-		proxyTyp = tProxy.SOCK5TCP
-	} else {
-		proxyTyp, err = tProxy.BuildProto(proto)
-		if err != nil {
-			return dbusutil.ToError(err)
-		}
-	}
-	// get proxies
-	proxy, err := mgr.Proxies.GetProxy(proto, name)
+	// default route, group member is selected when tcp request comes
+	route, err := newTargetRoute(mgr.scope, mgr.Proxies, proto+"/"+name)
 	if err != nil {
 		logger.Warningf("[%s] get proxy failed, err: %v", mgr.scope, err)
 		return dbusutil.ToError(err)
 	}
-	// save proxy
-	mgr.Proxy = proxy
+	proxy := route.proxy
+	if route.group != nil {
+		proxy = config.Proxy{ProtoType: define.GROUP, Name: name}
+	}
 	logger.Debugf("[%s] get proxy success, proxy: %v", mgr.scope, proxy)
+	// create rule router
+	router, err := newRuleRouter(mgr.scope, mgr.Proxies)
+	if err != nil {
+		logger.Warningf("[%s] create rule router failed, err: %v", mgr.scope, err)
+		mgr.releaseRoute(route, nil)
+		return dbusutil.ToError(err)
+	}
 	// tcp module
 	listen, err := mgr.listen()
 	if err != nil {
+		mgr.releaseRoute(route, router)
 		return dbusutil.ToError(err)
 	}
 	// save tcp handler
 	mgr.tcpHandler = listen
 	logger.Debugf("[%s] proxy [%s] listen tcp success at port %v", mgr.scope, proto, mgr.Proxies.TPort)
 	// in case blocks DBus-return, use goroutine
-	go mgr.accept(proxyTyp, proxy, listen)
+	go mgr.accept(route, router, listen)
 
 	// udp module
-	if udp && proto == "sock5" {
+	udpTyp, udpOk := udpProto(proto, proxy)
+	if udp && udpOk {
 		// listen packet conn
 		packetConn, err := mgr.listenPacket()
 		if err != nil {
+			_ = listen.Close()
+			mgr.tcpHandler = nil
+			mgr.releaseRoute(route, router)
 			return dbusutil.ToError(err)
 		}
+		// save udp handler, udp rules is created only when udp is listened
+		mgr.udpHandler = packetConn
 		logger.Debugf("[%s] proxy [%s] listen udp success at port %v", mgr.scope, proto, mgr.Proxies.TPort)
 		// start proxy udp
-		go mgr.readMsgUDP(proxyTyp, proxy, packetConn)
+		go mgr.readMsgUDP(udpTyp, proxy, router, packetConn)
 	}
 
+	// save proxy, released by stop proxy from now on
+	mgr.Proxy = proxy
+	mgr.route = route
+	mgr.router = router
 	// mark enable
 	mgr.Enabled = true
 
 	err = mgr.startRedirect()
 	if err != nil {
 		logger.Warningf("start redirect failed, err: %v", err)
+		// close listeners, release route and rules created partly
+		_ = mgr.StopProxy()
 		return dbusutil.ToError(err)
 	}
 
-	go func() {
-		err := mgr.dnsProxy.startDNSProxy()
+	// dns query is hijacked only when dns port is set
+	if mgr.Proxies.DNSPort != 0 {
+		err = mgr.dnsProxy.startDNSProxy()
 		if err != nil {
-			logger.Warningf("start dns proxy failed: %v", err)
+			logger.Warningf("[%s] start dns proxy failed: %v", mgr.scope, err)
 		}
-	}()
+	}
 
 	return nil
 }
@@ -154,10 +173,18 @@ func (mgr *proxyPrv) StopProxy() *dbus.Error {
 		if err != nil {
 			logger.Warningf("[%s] stop proxy udp handler failed, err: %v", mgr.scope, err)
 		}
+		mgr.udpHandler = nil
 	}
 
 	mgr.Enabled = false
 
+	// stop probe group members
+	mgr.releaseRoute(mgr.route, mgr.router)
+	mgr.route = nil
+	mgr.router = nil
+
+	mgr.dnsProxy.stopDNSProxy()
+
 	err := mgr.stopRedirect()
 	if err != nil {
 		logger.Warningf("stop redirect failed, err: %v", err)
@@ -227,6 +254,40 @@ func (mgr *proxyPrv) SetProxies(proxies config.ScopeProxies) *dbus.Error {
 	return nil
 }
 
+// set split dns policies, take effect without restart proxy
+func (mgr *proxyPrv) SetDNSPolicies(jsonPolicies []byte) *dbus.Error {
+	policies, err := UnMarshalDNSPolicies(jsonPolicies)
+	if err != nil {
+		logger.Warningf("[%s] unmarshal dns policies failed, err: %v", mgr.scope, err)
+		return dbusutil.ToError(err)
+	}
+	cfg := mgr.Proxies.DNS
+	cfg.Policies = policies
+	// check policies before save
+	err = mgr.dnsProxy.setPolicies(cfg)
+	if err != nil {
+		logger.Warningf("[%s] set dns policies failed, err: %v", mgr.scope, err)
+		return dbusutil.ToError(err)
+	}
+	mgr.Proxies.DNS = cfg
+	err = mgr.writeConfig()
+	if err != nil {
+		logger.Warningf("[%s] write config failed, err: %v", mgr.scope, err)
+		return dbusutil.ToError(err)
+	}
+	return nil
+}
+
+// get blocked dns query count of every app, [app] -> [count]
+func (mgr *proxyPrv) GetDNSBlockStats() (string, *dbus.Error) {
+	buf, err := com.MarshalJson(mgr.dnsProxy.getBlockCounts())
+	if err != nil {
+		logger.Warningf("[%s] get dns block stats failed, err: %v", mgr.scope, err)
+		return "", dbusutil.ToError(err)
+	}
+	return buf, nil
+}
+
 func (mgr *proxyPrv) ClearProxy() *dbus.Error {
 	mgr.Proxies.Proxies = nil
 	err := mgr.writeConfig()
@@ -239,7 +300,7 @@ func (mgr *proxyPrv) ClearProxy() *dbus.Error {
 
 // set tcp opt listen
 func (mgr *proxyPrv) listen() (net.Listener, error) {
-	// get proxies
+	// get proxies, listen on all addr is dual stack, ipv4 and ipv6 are both accepted
 	tp := strconv.Itoa(mgr.Proxies.TPort)
 	l, err := net.Listen("tcp", ":"+tp)
 	if err != nil {
@@ -250,12 +311,14 @@ func (mgr *proxyPrv) listen() (net.Listener, error) {
 	tl, ok := l.(*net.TCPListener)
 	if !ok {
 		logger.Warningf("[%s] listener is not tcp listener type", mgr.scope)
-		return nil, err
+		_ = l.Close()
+		return nil, errors.New("listener is not tcp listener")
 	}
 	// get file
 	file, err := tl.File()
 	if err != nil {
-		logger.Warningf("[%s] tcp listener get file failed, err: %v", err)
+		logger.Warningf("[%s] tcp listener get file failed, err: %v", mgr.scope, err)
+		_ = l.Close()
 		return nil, err
 	}
 	defer file.Close()
@@ -263,12 +326,14 @@ func (mgr *proxyPrv) listen() (net.Listener, error) {
 	err = com.SetSockOptTrn(int(file.Fd()))
 	if err != nil {
 		logger.Warningf("[%s] set fd opt transparent failed, err: %v", mgr.scope, err)
+		_ = l.Close()
 		return nil, err
 	}
 	// set non block
 	err = syscall.SetNonblock(int(file.Fd()), true)
 	if err != nil {
 		logger.Warningf("[%s] set non block failed, err: %v", mgr.scope, err)
+		_ = l.Close()
 		return nil, err
 	}
 
@@ -277,7 +342,7 @@ func (mgr *proxyPrv) listen() (net.Listener, error) {
 
 // set udp opt listen
 func (mgr *proxyPrv) listenPacket() (net.PacketConn, error) {
-	// get proxies
+	// get proxies, dual stack as tcp
 	tp := strconv.Itoa(mgr.Proxies.TPort)
 	l, err := net.ListenPacket("udp", ":"+tp)
 	if err != nil {
@@ -288,18 +353,30 @@ func (mgr *proxyPrv) listenPacket() (net.PacketConn, error) {
 	conn, ok := l.(*net.UDPConn)
 	if !ok {
 		logger.Warning("convert udp data failed")
-		return nil, err
+		_ = l.Close()
+		return nil, errors.New("packet conn is not udp conn")
 	}
 	err = com.SetConnOptTrn(conn)
 	if err != nil {
 		logger.Warningf("set conn opt transparent failed, err: %v", err)
+		_ = l.Close()
 		return nil, err
 	}
 	return l, nil
 }
 
-// proxy tcp
-func (mgr *proxyPrv) accept(proxyTyp tProxy.ProtoTyp, proxy config.Proxy, listen net.Listener) {
+// stop group probe of route and router
+func (mgr *proxyPrv) releaseRoute(route *proxyRoute, router *ruleRouter) {
+	if route != nil && route.group != nil {
+		route.group.release()
+	}
+	if router != nil {
+		router.release()
+	}
+}
+
+// proxy tcp, router is nil if no rule
+func (mgr *proxyPrv) accept(route *proxyRoute, router *ruleRouter, listen net.Listener) {
 	if listen == nil {
 		logger.Warningf("[%s] tcp listener is nil", mgr.scope)
 		return
@@ -315,19 +392,25 @@ func (mgr *proxyPrv) accept(proxyTyp tProxy.ProtoTyp, proxy config.Proxy, listen
 				logger.Debugf("[%s] stop proxy tcp break", mgr.scope)
 				break
 			}
-			logger.Warningf("[%s] accept socket failed, err: %v", proxyTyp, err)
+			logger.Warningf("[%s] accept socket failed, err: %v", mgr.scope, err)
 			break
 		}
 		// proxy tcp
-		go mgr.proxyTcp(proxyTyp, proxy, lConn)
+		go mgr.proxyTcp(route, router, lConn)
 	}
 	logger.Debugf("[%s] stop proxy, prepare close handler", mgr.scope)
-	mgr.handlerMgr.CloseTypHandler(proxyTyp)
+	typs := route.protoTyps()
+	if router != nil {
+		typs = append(typs, router.protoTyps()...)
+	}
+	for _, typ := range typs {
+		mgr.handlerMgr.CloseTypHandler(typ)
+	}
 	mgr.tcpHandler = nil
 }
 
 // read udp message
-func (mgr *proxyPrv) readMsgUDP(proxyTyp tProxy.ProtoTyp, proxy config.Proxy, listen net.PacketConn) {
+func (mgr *proxyPrv) readMsgUDP(proxyTyp tProxy.ProtoTyp, proxy config.Proxy, router *ruleRouter, listen net.PacketConn) {
 	if listen == nil {
 		logger.Warningf("[%s] tcp listener is nil", mgr.scope)
 		return
@@ -339,13 +422,17 @@ func (mgr *proxyPrv) readMsgUDP(proxyTyp tProxy.ProtoTyp, proxy config.Proxy, li
 		return
 	}
 	defer conn.Close()
+	// packets from the same socket share one session
+	table := tProxy.NewUdpSessionTable(mgr.scope, time.Duration(mgr.Proxies.UDPTimeout)*time.Second)
+	defer table.Close()
 
+	// packet may be as large as 64k, such as quic
+	buf := make([]byte, 65535)
+	oob := make([]byte, 1024)
 	// start accept until stop
 	for {
 		// read origin addr
-		buf := make([]byte, 512)
-		oob := make([]byte, 1024)
-		_, oobNum, _, lAddr, err := conn.ReadMsgUDP(buf, oob)
+		n, oobNum, _, lAddr, err := conn.ReadMsgUDP(buf, oob)
 		if err != nil {
 			if !mgr.Enabled {
 				logger.Debugf("[%s] stop proxy udp break", mgr.scope)
@@ -357,7 +444,8 @@ func (mgr *proxyPrv) readMsgUDP(proxyTyp tProxy.ProtoTyp, proxy config.Proxy, li
 		// get real remote addr
 		rBaseAddr, err := com.ParseRemoteAddrFromMsgHdr(oob[:oobNum])
 		if err != nil {
-			logger.Fatal(err)
+			logger.Warningf("[%s] parse origin dst of %v failed, err: %v", mgr.scope, lAddr, err)
+			continue
 		}
 
 		// make remote addr
@@ -365,59 +453,90 @@ func (mgr *proxyPrv) readMsgUDP(proxyTyp tProxy.ProtoTyp, proxy config.Proxy, li
 			IP:   rBaseAddr.IP,
 			Port: rBaseAddr.Port,
 		}
-		// proxy udp
-		go mgr.proxyUdp(proxy, lAddr, rAddr, buf)
+		// proxy udp in read order, packet is queued in session, hand shake dont block reading
+		data := append([]byte{}, buf[:n]...)
+		mgr.proxyUdp(table, proxyTyp, proxy, router, lAddr, rAddr, data)
 	}
-	logger.Debugf("[%s] stop proxy, prepare close handler", mgr.scope)
-	mgr.handlerMgr.CloseTypHandler(proxyTyp)
+	logger.Debugf("[%s] stop proxy, prepare close udp sessions", mgr.scope)
 }
 
-type DomainAddr struct {
-	network string
-	Domain  string
-	Port    int
-}
-
-func newDomainAddr(network string, domain string, port int) *DomainAddr {
-	return &DomainAddr{
-		network: network,
-		Domain:  domain,
-		Port:    port,
+// replace fake ip with domain, proxy server will resolve domain
+func (mgr *proxyPrv) getRealRemoteAddr(rAddr net.Addr) net.Addr {
+	switch addr := rAddr.(type) {
+	case *net.UDPAddr:
+		domain, ok := mgr.dnsProxy.getDomainFromFakeIP(addr.IP)
+		if ok {
+			return com.NewDomainAddr("udp", domain, addr.Port)
+		}
+	case *net.TCPAddr:
+		domain, ok := mgr.dnsProxy.getDomainFromFakeIP(addr.IP)
+		if ok {
+			return com.NewDomainAddr("tcp", domain, addr.Port)
+		}
 	}
+	return rAddr
 }
 
-func (a *DomainAddr) Network() string {
-	return a.network
-}
-
-func (a *DomainAddr) String() string {
-	return a.Domain + ":" + strconv.Itoa(a.Port)
+// for t-proxy
+func (mgr *proxyPrv) proxyTcp(route *proxyRoute, router *ruleRouter, lConn net.Conn) {
+	// sniff domain from first client data if fake ip cant recover domain
+	var sniffed string
+	if !mgr.Proxies.DisableSniff {
+		if _, ok := mgr.getRealRemoteAddr(lConn.LocalAddr()).(*com.DomainAddr); !ok {
+			lConn, sniffed = tProxy.SniffConn(lConn, sniffTimeout)
+		}
+	}
+	// rule decide route of connection
+	if router != nil {
+		route = mgr.routeByRule(router, route, "tcp", lConn.RemoteAddr(), lConn.LocalAddr(), sniffed)
+	}
+	group := route.group
+	var handler tProxy.BaseHandler
+	var err error
+	if group == nil {
+		handler, err = mgr.tcpTunnel(route.typ, route.proxy, lConn, sniffed)
+	} else {
+		// try group members in order until tunnel success
+		for _, member := range group.candidates() {
+			handler, err = mgr.tcpTunnel(member.typ, member.proxy, lConn, sniffed)
+			if err == nil {
+				break
+			}
+			logger.Warningf("[%s] group [%s] member [%s/%s] failed, try next, err: %v",
+				mgr.scope, group.name, member.proxy.ProtoType, member.proxy.Name, err)
+			group.markFailed(member)
+		}
+	}
+	if err != nil {
+		_ = lConn.Close()
+		return
+	}
+	// add handler to map
+	handler.AddMgr(mgr.handlerMgr)
+	// begin communication
+	handler.Communicate()
 }
 
-// for t-proxy
-func (mgr *proxyPrv) proxyTcp(proxyTyp tProxy.ProtoTyp, proxy config.Proxy, lConn net.Conn) {
+// create tcp handler and tunnel, lConn is not closed when failed, sniffed is domain sniffed from lConn
+func (mgr *proxyPrv) tcpTunnel(proxyTyp tProxy.ProtoTyp, proxy config.Proxy, lConn net.Conn, sniffed string) (tProxy.BaseHandler, error) {
 	// request is redirect by t-proxy, output -> pre-routing
 	// at that time, the actual remote addr is conn`s local addr, the actual local addr is conn`s remote addr
 	// can use conn as fake remote conn, to connect with actual local connection
 	lAddr := lConn.RemoteAddr()
 	rAddr := lConn.LocalAddr()
 
+	// http https sock4a sock5 shadowsocks and chain can send domain to proxy server
 	realRAddr := rAddr
-	if proxyTyp == tProxy.HTTP {
-		switch addr := rAddr.(type) {
-		case *net.UDPAddr:
-			domain, ok := mgr.dnsProxy.getDomainFromFakeIP(addr.IP)
-			if ok {
-				realRAddr = newDomainAddr("udp", domain, addr.Port)
-			}
-
-		case *net.TCPAddr:
-			domain, ok := mgr.dnsProxy.getDomainFromFakeIP(addr.IP)
-			if ok {
-				realRAddr = newDomainAddr("tcp", domain, addr.Port)
-			}
-
+	switch proxyTyp {
+	case tProxy.HTTP, tProxy.HTTPS, tProxy.SOCK4A, tProxy.SOCK5TCP, tProxy.SHADOWSOCKSTCP, tProxy.CHAIN:
+		realRAddr = mgr.getRealRemoteAddr(rAddr)
+		// proxy server resolve sniffed domain itself
+		if tcpAddr, ok := rAddr.(*net.TCPAddr); ok && realRAddr == rAddr && sniffed != "" {
+			realRAddr = com.NewDomainAddr("tcp", sniffed, tcpAddr.Port)
 		}
+	case tProxy.NoneProto:
+		// direct must resolve fake ip domain, sniffed ip is real
+		realRAddr = mgr.getRealRemoteAddr(rAddr)
 	}
 
 	// print local -> remote
@@ -431,53 +550,101 @@ func (mgr *proxyPrv) proxyTcp(proxyTyp tProxy.ProtoTyp, proxy config.Proxy, lCon
 	}
 	// create new handler
 	handler := tProxy.NewHandler(proxyTyp, mgr.scope, key, proxy, lAddr, realRAddr, lConn)
-	// create tunnel between proxy server and dst server
+	if handler == nil {
+		return nil, fmt.Errorf("proto [%s] is not support", proxyTyp)
+	}
+	// create tunnel between proxy server and dst server, failed tunnel has closed its remote conn
 	err := handler.Tunnel()
 	if err != nil {
 		logger.Warningf("[%s] create tunnel failed, err: %v", proxyTyp, err)
-		handler.Close()
-		return
+		return nil, err
 	}
-	// add handler to map
-	handler.AddMgr(mgr.handlerMgr)
-	// begin communication
-	handler.Communicate()
+	return handler, nil
 }
 
-func (mgr *proxyPrv) proxyUdp(proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, buf []byte) {
-	// make a fake udp dial to cheat socket
-	lConn, err := com.MegaDial("udp", rAddr, lAddr)
-	if err != nil {
-		logger.Warningf("fake dial udp rAddr to lAddr failed, err: %v", err)
-		return
+// dial addr through current default route, used by proxy self such as dns upstream
+func (mgr *proxyPrv) dialProxy(network string, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("network [%s] cant dial through proxy", network)
 	}
-	// make key to mark this connection
-	key := tProxy.HandlerKey{
-		SrcAddr: lAddr.String(),
-		DstAddr: rAddr.String(),
+	route := mgr.route
+	if route == nil {
+		return nil, errors.New("proxy is not started")
 	}
-	// create new handler
-	handler := tProxy.NewHandler(tProxy.SOCK5UDP, mgr.scope, key, proxy, lAddr, rAddr, lConn)
-	// create tunnel between proxy server and dst server
-	err = handler.Tunnel()
-	if err != nil {
-		logger.Warningf("[%s] create tunnel failed, err: %v", tProxy.SOCK5UDP, err)
-		handler.Close()
-		return
+	routes := []*proxyRoute{route}
+	if route.group != nil {
+		routes = nil
+		for _, member := range route.group.candidates() {
+			routes = append(routes, &proxyRoute{typ: member.typ, proxy: member.proxy})
+		}
 	}
-	// add handler to map
-	handler.AddMgr(mgr.handlerMgr)
-	// begin communication
-	handler.Communicate()
-	// write first buf to rAddr
-	pkgData := com.DataPackage{
-		Addr: rAddr,
-		Data: buf,
+	var lastErr error
+	for _, route := range routes {
+		rAddr, err := parseTargetAddr(addr, route.typ)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := tProxy.DialProxy(route.typ, mgr.scope, route.proxy, rAddr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return conn, nil
 	}
-	// write first udp to remote
-	err = handler.WriteRemote(com.MarshalPackage(pkgData, "udp"))
-	if err != nil {
-		handler.Close()
+	return nil, lastErr
+}
+
+func (mgr *proxyPrv) proxyUdp(table *tProxy.UdpSessionTable, proxyTyp tProxy.ProtoTyp, proxy config.Proxy, router *ruleRouter, lAddr net.Addr, rAddr net.Addr, buf []byte) {
+	// rule decide route of packet
+	if router != nil {
+		route := mgr.routeByRule(router, nil, "udp", lAddr, rAddr, "")
+		if route != nil {
+			proxyTyp, proxy = mgr.udpRoute(route, proxyTyp, proxy)
+		}
+	}
+	if proxyTyp == tProxy.REJECT {
+		logger.Debugf("[%s] reject udp packet, local [%s] -> remote [%s]", mgr.scope, lAddr, rAddr)
 		return
 	}
+	// fake dial must use fake ip, but session can send domain to proxy server
+	realRAddr := mgr.getRealRemoteAddr(rAddr)
+	err := table.Send(proxyTyp, proxy, lAddr, rAddr, realRAddr, buf)
+	if err != nil {
+		logger.Warningf("[%s] send udp packet failed, local [%s] -> remote [%s], err: %v", proxyTyp, lAddr, rAddr, err)
+	}
+}
+
+// convert route to udp proto, use default if route cant proxy udp
+func (mgr *proxyPrv) udpRoute(route *proxyRoute, proxyTyp tProxy.ProtoTyp, proxy config.Proxy) (tProxy.ProtoTyp, config.Proxy) {
+	if route.group != nil {
+		logger.Debugf("[%s] group [%s] not support udp, use default", mgr.scope, route.group.name)
+		return proxyTyp, proxy
+	}
+	switch route.typ {
+	case tProxy.NoneProto, tProxy.REJECT:
+		return route.typ, route.proxy
+	case tProxy.SOCK5TCP:
+		return tProxy.SOCK5UDP, route.proxy
+	case tProxy.SHADOWSOCKSTCP:
+		return tProxy.SHADOWSOCKSUDP, route.proxy
+	case tProxy.HTTP, tProxy.HTTPS, tProxy.SOCK4, tProxy.SOCK4A, tProxy.CHAIN:
+		if route.proxy.UoT != "" {
+			return tProxy.UOT, route.proxy
+		}
+	}
+	logger.Debugf("[%s] proto [%s] not support udp, use default", mgr.scope, route.typ)
+	return proxyTyp, proxy
+}
+
+// udp proto of proxy, tcp only proxy carry udp over tcp when relay endpoint is set
+func udpProto(proto string, proxy config.Proxy) (tProxy.ProtoTyp, bool) {
+	switch proto {
+	case define.SOCK5:
+		return tProxy.SOCK5UDP, true
+	case define.SHADOWSOCKS:
+		return tProxy.SHADOWSOCKSUDP, true
+	case define.HTTP, define.HTTPS, define.SOCK4, define.SOCK4A, define.CHAIN:
+		return tProxy.UOT, proxy.UoT != ""
+	}
+	return tProxy.NoneProto, false
 }
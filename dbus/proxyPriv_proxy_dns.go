@@ -1,78 +1,429 @@
 package DBus
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+	config "github.com/ArisAachen/deepin-network-proxy/config"
 	"github.com/miekg/dns"
 )
 
-const cacheMaxSize = 1000
+const (
+	cacheMaxSize = 1000
+	// interval to save fake ip mapping
+	fakeIPSaveInterval = time.Minute
+)
 
 type proxyDNS struct {
 	prv *proxyPrv
 
-	fIP   fakeIP
-	cache *fakeIPCache
-}
+	// fake ip pools and file to persist them, not persisted if path is empty
+	pool     *fakeIPPool
+	pool6    *fakeIPPool
+	poolPath string
 
-func (p *proxyDNS) resolveDomain(domain string) net.IP {
-	i, ok := p.cache.GetByDomain(domain)
-	if ok {
-		return i
-	}
+	// forward query which not use fake ip
+	forwarder *dnsForwarder
 
-	ip := p.fIP.new()
-	logger.Debugf("Query for %s: %s", domain, ip)
-	p.cache.Add(domain, ip)
+	// block list and blocked query count of every app
+	blocker     *dnsBlocker
+	blockLock   sync.Mutex
+	blockCounts map[string]uint64
+
+	// split dns policy, can be reloaded when running
+	policyLock sync.RWMutex
+	policies   *dnsPolicyTable
+
+	// udp and tcp server
+	servers []*dns.Server
+	stop    chan struct{}
+}
 
+// domain is saved without root dot, proxy server resolve it
+func (p *proxyDNS) resolveDomain(domain string, pool *fakeIPPool) net.IP {
+	domain = normalizeDomain(domain)
+	ip := pool.lookup(domain)
+	logger.Debugf("Query for %s: %s", domain, ip)
 	return ip
 }
 
 func (p *proxyDNS) getDomainFromFakeIP(ip net.IP) (string, bool) {
-	return p.cache.GetByIP(ip)
+	// dns proxy may not start
+	for _, pool := range []*fakeIPPool{p.pool, p.pool6} {
+		if pool == nil {
+			continue
+		}
+		if domain, ok := pool.getDomain(ip); ok {
+			return domain, true
+		}
+	}
+	return "", false
 }
 
+// save fake ip mapping if changed
+func (p *proxyDNS) saveFakeIP() {
+	if p.pool == nil || p.pool6 == nil || p.poolPath == "" {
+		return
+	}
+	if !p.pool.changed() && !p.pool6.changed() {
+		return
+	}
+	err := saveFakeIPPools(p.poolPath, p.pool, p.pool6)
+	if err != nil {
+		logger.Warningf("save fake ip to %s failed, err: %v", p.poolPath, err)
+	}
+}
+
+// load fake ip mapping saved by last run
+func (p *proxyDNS) loadFakeIP() {
+	if p.poolPath == "" {
+		return
+	}
+	err := loadFakeIPPools(p.poolPath, p.pool, p.pool6)
+	if err != nil {
+		logger.Warningf("load fake ip from %s failed, err: %v", p.poolPath, err)
+	}
+}
+
+// count blocked query of app which owns socket inode, slow as fd of all process is searched
+func (p *proxyDNS) countBlock(inode string, domain string) {
+	app := "unknown"
+	if inode != "" {
+		process, err := com.GetProcessBySocketInode(inode)
+		if err == nil && process != "" {
+			app = process
+		}
+	}
+	logger.Debugf("block dns query %s from %s", domain, app)
+	p.blockLock.Lock()
+	defer p.blockLock.Unlock()
+	if p.blockCounts == nil {
+		p.blockCounts = make(map[string]uint64)
+	}
+	p.blockCounts[app]++
+}
+
+// get copy of blocked query count, [app] -> [count]
+func (p *proxyDNS) getBlockCounts() map[string]uint64 {
+	p.blockLock.Lock()
+	defer p.blockLock.Unlock()
+	counts := make(map[string]uint64, len(p.blockCounts))
+	for app, count := range p.blockCounts {
+		counts[app] = count
+	}
+	return counts
+}
+
+// get current split dns policy
+func (p *proxyDNS) getPolicies() *dnsPolicyTable {
+	p.policyLock.RLock()
+	defer p.policyLock.RUnlock()
+	return p.policies
+}
+
+// rebuild split dns policy, old policy is kept if config is invalid
+func (p *proxyDNS) setPolicies(cfg config.DNSConfig) error {
+	policies, err := newDnsPolicyTable(cfg)
+	if err != nil {
+		return err
+	}
+	p.policyLock.Lock()
+	p.policies = policies
+	p.policyLock.Unlock()
+	return nil
+}
+
+// check if domain should be answered with real ip
+func (p *proxyDNS) isBypass(domain string) bool {
+	domain = normalizeDomain(domain)
+	for _, suffix := range p.prv.Proxies.DNS.Bypass {
+		suffix = normalizeDomain(suffix)
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// answer a query with fake ip
 func (p *proxyDNS) parseQuery(m *dns.Msg) {
 	for _, q := range m.Question {
 		switch q.Qtype {
 		case dns.TypeA:
-			ip := p.resolveDomain(q.Name)
+			ip := p.resolveDomain(q.Name, p.pool)
 			rr, err := dns.NewRR(fmt.Sprintf("%s 0 A %s", q.Name, ip))
 			if err == nil {
 				m.Answer = append(m.Answer, rr)
 			}
 		case dns.TypeAAAA:
-			fmt.Printf("Query for %s\n", q.Name)
+			// empty answer make app use ipv4
+			if p.prv.Proxies.IPv6Mode == config.EmptyIPv6Mode {
+				continue
+			}
+			ip := p.resolveDomain(q.Name, p.pool6)
+			rr, err := dns.NewRR(fmt.Sprintf("%s 0 AAAA %s", q.Name, ip))
+			if err == nil {
+				m.Answer = append(m.Answer, rr)
+			}
 		}
 	}
 }
 
+// forward query to upstream, reply server failure if all upstreams failed
+func (p *proxyDNS) forward(w dns.ResponseWriter, r *dns.Msg, forwarder *dnsForwarder) {
+	var resp *dns.Msg
+	err := errors.New("dns forwarder is not created")
+	if forwarder != nil {
+		resp, err = forwarder.exchange(r)
+	}
+	if err != nil {
+		logger.Warningf("forward dns query %v failed, err: %v", r.Question, err)
+		m := &dns.Msg{}
+		m.SetRcode(r, dns.RcodeServerFailure)
+		_ = w.WriteMsg(m)
+		return
+	}
+	resp.Id = r.Id
+	writeReply(w, r, resp)
+}
+
+// answer of upstream or cache may exceed udp size of client, truncated answer make client retry with tcp
+func writeReply(w dns.ResponseWriter, r *dns.Msg, resp *dns.Msg) {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
+	}
+	_ = w.WriteMsg(resp)
+}
+
 func (p *proxyDNS) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	m := &dns.Msg{}
+	// only standard query is supported
+	if r.Opcode != dns.OpcodeQuery {
+		m.SetRcode(r, dns.RcodeNotImplemented)
+		_ = w.WriteMsg(m)
+		return
+	}
+	if len(r.Question) != 1 {
+		m.SetRcode(r, dns.RcodeFormatError)
+		_ = w.WriteMsg(m)
+		return
+	}
+	// block list is matched first
+	q := r.Question[0]
+	if p.blocker.isBlocked(q.Name) {
+		// find socket before reply, socket of app may be closed once answered, app is found later
+		addr := w.RemoteAddr()
+		inode, _ := com.GetSocketInode(addr.Network(), addr)
+		_ = w.WriteMsg(blockAnswer(r, p.prv.Proxies.DNS.BlockMode))
+		go p.countBlock(inode, q.Name)
+		return
+	}
+	// split dns policy
+	policy := p.getPolicies().match(q.Name)
+	if policy != nil {
+		switch policy.action {
+		case config.ForwardAction:
+			p.forward(w, r, policy.forwarder)
+			return
+		case config.HostsAction:
+			_ = w.WriteMsg(policy.answer(r))
+			return
+		}
+	}
+	// only A and AAAA query of proxied domain use fake ip
+	if (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) || q.Qclass != dns.ClassINET || (policy == nil && p.isBypass(q.Name)) {
+		p.forward(w, r, p.forwarder)
+		return
+	}
 	m.SetReply(r)
 	m.Compress = false
+	p.parseQuery(m)
+	_ = w.WriteMsg(m)
+}
 
-	switch r.Opcode {
-	case dns.OpcodeQuery:
-		p.parseQuery(m)
+// init fake ip and forwarder, fake ip still works without forwarder
+func (p *proxyDNS) prepare() {
+	var dial dnsDialer
+	if p.prv.Proxies.DNS.ViaProxy {
+		dial = p.prv.dialProxy
 	}
+	forwarder, err := newDnsForwarder(p.prv.Proxies.DNS, dial)
+	if err != nil {
+		logger.Warningf("create dns forwarder failed, err: %v", err)
+	}
+	p.forwarder = forwarder
+	err = p.setPolicies(p.prv.Proxies.DNS)
+	if err != nil {
+		logger.Warningf("create dns policy failed, err: %v", err)
+	}
+	switch p.prv.Proxies.DNS.BlockMode {
+	case "", config.ZeroBlockMode, config.NXDomainBlockMode:
+	default:
+		logger.Warningf("block mode [%s] is invalid, use %s", p.prv.Proxies.DNS.BlockMode, config.ZeroBlockMode)
+	}
+	p.blocker = newDnsBlocker(p.prv.Proxies.DNS.BlockLists)
+	switch p.prv.Proxies.IPv6Mode {
+	case "", config.FakeIPv6Mode, config.EmptyIPv6Mode:
+	default:
+		logger.Warningf("ipv6 mode [%s] is invalid, use %s", p.prv.Proxies.IPv6Mode, config.FakeIPv6Mode)
+	}
+	p.pool = prepareFakeIPPool(p.pool, p.prv.Proxies.FakeIPRange, defaultFakeIPRange, false)
+	p.pool6 = prepareFakeIPPool(p.pool6, p.prv.Proxies.FakeIPv6Range, defaultFakeIPv6Range, true)
+}
 
-	w.WriteMsg(m)
+// create pool of ip family, use default range if invalid, old pool is kept if range not changed
+func prepareFakeIPPool(old *fakeIPPool, cidr string, def string, v6 bool) *fakeIPPool {
+	if cidr == "" {
+		cidr = def
+	}
+	pool, err := newFakeIPPool(cidr)
+	if err == nil && (pool.network.IP.To4() == nil) != v6 {
+		err = fmt.Errorf("fake ip range [%s] is not the right ip family", cidr)
+	}
+	if err != nil {
+		logger.Warningf("fake ip range is invalid, use %s, err: %v", def, err)
+		pool, _ = newFakeIPPool(def)
+	}
+	if old != nil && old.network.String() == pool.network.String() {
+		return old
+	}
+	return pool
 }
 
+// start udp and tcp dns server, large response and dnssec query use tcp
 func (p *proxyDNS) startDNSProxy() error {
-	p.fIP = newFakeIP(net.IP{225, 0, 0, 0}, 8)
-	p.cache = newFakeIPCache()
+	if len(p.servers) != 0 {
+		p.stopDNSProxy()
+	}
+	p.prepare()
+	p.loadFakeIP()
+
+	// ip6tables redirect ipv6 query to ::1
+	hosts := []string{"127.0.0.1"}
+	if com.IPv6Enabled() {
+		hosts = append(hosts, "::1")
+	}
+	// listen first, so error can be returned
+	for _, host := range hosts {
+		dnsListenAddr := net.JoinHostPort(host, strconv.Itoa(p.prv.Proxies.DNSPort))
+		logger.Info("dns listen addr:", dnsListenAddr)
+		packetConn, err := net.ListenPacket("udp", dnsListenAddr)
+		if err != nil {
+			p.closeServers()
+			return err
+		}
+		listener, err := net.Listen("tcp", dnsListenAddr)
+		if err != nil {
+			_ = packetConn.Close()
+			p.closeServers()
+			return err
+		}
+		p.servers = append(p.servers,
+			&dns.Server{PacketConn: packetConn, Net: "udp", Handler: p},
+			&dns.Server{Listener: listener, Net: "tcp", Handler: p})
+	}
+	// wait all server started, server not started cant be shutdown
+	type startResult struct {
+		server *dns.Server
+		err    error
+	}
+	results := make(chan startResult, 2*len(p.servers))
+	for _, server := range p.servers {
+		server := server
+		server.NotifyStartedFunc = func() {
+			results <- startResult{server: server}
+		}
+		go func() {
+			err := server.ActivateAndServe()
+			if err != nil {
+				logger.Warningf("dns server %s stopped, err: %v", server.Net, err)
+				results <- startResult{server: server, err: err}
+			}
+		}()
+	}
+	var startErr error
+	started := make(map[*dns.Server]bool)
+	for range p.servers {
+		result := <-results
+		if result.err != nil {
+			startErr = result.err
+			continue
+		}
+		started[result.server] = true
+	}
+	if startErr != nil {
+		// shutdown started server, close listeners of the rest
+		var failed []*dns.Server
+		for _, server := range p.servers {
+			if started[server] {
+				_ = server.Shutdown()
+				continue
+			}
+			failed = append(failed, server)
+		}
+		p.servers = failed
+		p.closeServers()
+		return startErr
+	}
 
-	dnsListenAddr := fmt.Sprintf("127.0.0.1:%d", p.prv.Proxies.DNSPort)
-	logger.Info("dns listen addr:", dnsListenAddr)
+	// save mapping and reload changed block list periodically
+	p.stop = make(chan struct{})
+	go func(stop chan struct{}, blocker *dnsBlocker) {
+		ticker := time.NewTicker(fakeIPSaveInterval)
+		defer ticker.Stop()
+		blockTicker := time.NewTicker(blockListCheckInterval)
+		defer blockTicker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.saveFakeIP()
+			case <-blockTicker.C:
+				if blocker != nil {
+					blocker.reloadIfChanged()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(p.stop, p.blocker)
+	return nil
+}
 
-	server := &dns.Server{
-		Addr:    dnsListenAddr,
-		Net:     "udp",
-		Handler: p,
+// close listeners of servers not started
+func (p *proxyDNS) closeServers() {
+	for _, server := range p.servers {
+		if server.PacketConn != nil {
+			_ = server.PacketConn.Close()
+		}
+		if server.Listener != nil {
+			_ = server.Listener.Close()
+		}
 	}
+	p.servers = nil
+}
 
-	return server.ListenAndServe()
+// stop dns server and save fake ip mapping, apps may keep fake ip after stop
+func (p *proxyDNS) stopDNSProxy() {
+	for _, server := range p.servers {
+		err := server.Shutdown()
+		if err != nil {
+			logger.Warningf("stop dns server %s failed, err: %v", server.Net, err)
+		}
+	}
+	p.servers = nil
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	p.saveFakeIP()
 }
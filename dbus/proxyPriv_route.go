@@ -5,28 +5,40 @@ import (
 	"strconv"
 )
 
-// create ip rule
+// create ip rule of each ip family, rules created is removed when failed
 func (mgr *proxyPrv) createIpRule() error {
 	action := route.RuleAction{}
 	selector := route.RuleSelector{
 		// fwmark 8080
 		Fwmark: strconv.Itoa(mgr.Proxies.TPort),
 	}
-	// ip rule add fwmark 8080 table 100
-	rule, err := mgr.manager.mainRoute.CreateRule(action, selector)
-	if err != nil {
-		return err
+	for index, mainRoute := range mgr.manager.mainRoutes() {
+		// ip rule add fwmark 8080 table 100
+		// ip -6 rule add fwmark 8080 table 100
+		rule, err := mainRoute.CreateRule(action, selector)
+		if err != nil {
+			_ = mgr.releaseIpRule()
+			return err
+		}
+		mgr.ipRules = append(mgr.ipRules, rule)
+		item := journalIpRule{Table: mainRouteTable, IPv6: index != 0, Action: action, Selector: selector}
+		mgr.ipRuleJournals = append(mgr.ipRuleJournals, item)
+		mgr.manager.journal.addIpRule(item)
 	}
-	mgr.ipRule = rule
 	return nil
 }
 
-// release ip rule
+// release ip rules
 func (mgr *proxyPrv) releaseIpRule() error {
-	buf, err := mgr.ipRule.Remove()
-	if err != nil {
-		logger.Warning("[%s] release rule failed, out: %s, err: %v", mgr.scope, string(buf), err)
-		return err
+	for len(mgr.ipRules) != 0 {
+		buf, err := mgr.ipRules[0].Remove()
+		if err != nil {
+			logger.Warningf("[%s] release rule failed, out: %s, err: %v", mgr.scope, string(buf), err)
+			return err
+		}
+		mgr.manager.journal.delIpRule(mgr.ipRuleJournals[0])
+		mgr.ipRules = mgr.ipRules[1:]
+		mgr.ipRuleJournals = mgr.ipRuleJournals[1:]
 	}
 	logger.Debugf("[%s] release rule success", mgr.scope)
 	return nil
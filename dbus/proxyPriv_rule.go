@@ -0,0 +1,189 @@
+package DBus
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
+	Rule "github.com/ArisAachen/deepin-network-proxy/rule"
+	tProxy "github.com/ArisAachen/deepin-network-proxy/tproxy"
+)
+
+// where connection goes, use proxy or select member from group
+type proxyRoute struct {
+	typ   tProxy.ProtoTyp
+	proxy config.Proxy
+	group *proxyGroup
+}
+
+// all proto types of route, use to close handler
+func (route *proxyRoute) protoTyps() []tProxy.ProtoTyp {
+	if route.group != nil {
+		return route.group.protoTyps()
+	}
+	return []tProxy.ProtoTyp{route.typ}
+}
+
+var (
+	directRoute = &proxyRoute{typ: tProxy.NoneProto}
+	rejectRoute = &proxyRoute{typ: tProxy.REJECT}
+)
+
+// rule router, decide route of every connection
+type ruleRouter struct {
+	engine  *Rule.Engine
+	targets map[string]*proxyRoute // [proto]/[name] -> route
+}
+
+// create router from white list and rules, return nil if no rule
+func newRuleRouter(scope define.Scope, proxies config.ScopeProxies) (*ruleRouter, error) {
+	// white list is matched before rules
+	lines := whiteListRules(proxies.WhiteList)
+	lines = append(lines, proxies.Rules...)
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	engine, err := Rule.NewEngine(lines)
+	if err != nil {
+		return nil, err
+	}
+	router := &ruleRouter{
+		engine:  engine,
+		targets: make(map[string]*proxyRoute),
+	}
+	// resolve proxy targets
+	for _, target := range engine.Targets() {
+		route, err := newTargetRoute(scope, proxies, target)
+		if err != nil {
+			router.release()
+			return nil, err
+		}
+		router.targets[target] = route
+	}
+	return router, nil
+}
+
+// create route of [proto]/[name], group will start probe
+func newTargetRoute(scope define.Scope, proxies config.ScopeProxies, target string) (*proxyRoute, error) {
+	targetSl := strings.SplitN(target, "/", 2)
+	proto, name := targetSl[0], targetSl[1]
+	if proto == define.GROUP {
+		group, members, err := proxies.GetGroup(name)
+		if err != nil {
+			return nil, err
+		}
+		pg, err := newProxyGroup(scope, group, members)
+		if err != nil {
+			return nil, err
+		}
+		pg.start()
+		return &proxyRoute{group: pg}, nil
+	}
+	typ, err := buildTcpProto(proto)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := proxies.GetProxy(proto, name)
+	if err != nil {
+		return nil, err
+	}
+	proxy.ProtoType = proto
+	return &proxyRoute{typ: typ, proxy: proxy}, nil
+}
+
+// convert white list to direct rules, item can be domain url ip or cidr
+func whiteListRules(whiteList []string) []string {
+	var lines []string
+	for _, item := range whiteList {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(item); err == nil {
+			lines = append(lines, "IP-CIDR,"+item+",DIRECT")
+			continue
+		}
+		if ip := net.ParseIP(item); ip != nil {
+			bits := "/32"
+			if ip.To4() == nil {
+				bits = "/128"
+			}
+			lines = append(lines, "IP-CIDR,"+item+bits+",DIRECT")
+			continue
+		}
+		// white list may be url, such as https://baidu.com
+		if strings.Contains(item, "://") {
+			u, err := url.Parse(item)
+			if err != nil || u.Hostname() == "" {
+				logger.Warningf("white list item [%s] is invalid, ignore", item)
+				continue
+			}
+			item = u.Hostname()
+		}
+		lines = append(lines, "DOMAIN-SUFFIX,"+item+",DIRECT")
+	}
+	return lines
+}
+
+// stop all group probe
+func (router *ruleRouter) release() {
+	for _, route := range router.targets {
+		if route.group != nil {
+			route.group.release()
+		}
+	}
+}
+
+// all proto types used by router, use to close handler
+func (router *ruleRouter) protoTyps() []tProxy.ProtoTyp {
+	typs := []tProxy.ProtoTyp{tProxy.NoneProto, tProxy.REJECT}
+	for _, route := range router.targets {
+		typs = append(typs, route.protoTyps()...)
+	}
+	return typs
+}
+
+// match rule of connection, return def if no rule matched, sniffed is domain sniffed from connection
+func (mgr *proxyPrv) routeByRule(router *ruleRouter, def *proxyRoute, network string, lAddr net.Addr, rAddr net.Addr, sniffed string) *proxyRoute {
+	meta := &Rule.Metadata{
+		Network: network,
+	}
+	switch addr := rAddr.(type) {
+	case *net.TCPAddr:
+		meta.IP, meta.Port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		meta.IP, meta.Port = addr.IP, addr.Port
+	}
+	// domain from fake ip
+	if meta.IP != nil {
+		meta.Domain, _ = mgr.dnsProxy.getDomainFromFakeIP(meta.IP)
+	}
+	if meta.Domain == "" {
+		meta.Domain = sniffed
+	}
+	// find process only if needed
+	if router.engine.NeedProcess() {
+		process, err := com.GetProcessByAddr(network, lAddr)
+		if err != nil {
+			logger.Debugf("[%s] find process of [%s] failed, err: %v", mgr.scope, lAddr.String(), err)
+		}
+		meta.Process = process
+	}
+	action, ok := router.engine.Match(meta)
+	if !ok {
+		return def
+	}
+	logger.Debugf("[%s] %s connection [%s] -> [%s](%s) match rule, action: %v",
+		mgr.scope, network, lAddr.String(), rAddr.String(), meta.Domain, action)
+	switch action.Typ {
+	case Rule.ActionDirect:
+		return directRoute
+	case Rule.ActionReject:
+		return rejectRoute
+	default:
+		return router.targets[action.Target]
+	}
+}
@@ -21,6 +21,16 @@ func UnMarshalProxy(buf []byte) (config.Proxy, error) {
 	return proxy, nil
 }
 
+// unmarshal dns policies from json
+func UnMarshalDNSPolicies(buf []byte) ([]config.DNSPolicy, error) {
+	var policies []config.DNSPolicy
+	err := json.Unmarshal(buf, &policies)
+	if err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
 // parse .desktop file to get real path
 func parseDesktopPath(app string) (string, error) {
 	if !strings.HasSuffix(app, ".desktop") {
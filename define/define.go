@@ -37,13 +37,21 @@ func (s Scope) String() string {
 */
 const (
 	// basic type
-	HTTP  = "http"
-	SOCK4 = "sock4"
-	SOCK5 = "sock5"
+	HTTP        = "http"
+	HTTPS       = "https"
+	SOCK4       = "sock4"
+	SOCK4A      = "sock4a"
+	SOCK5       = "sock5"
+	SHADOWSOCKS = "shadowsocks"
+	CHAIN       = "chain"
+	GROUP       = "group"
 
 	// extends type
-	SOCK5UDP = "sock5-udp"
-	SOCK5TCP = "sock5-tcp"
+	SOCK5UDP       = "sock5-udp"
+	SOCK5TCP       = "sock5-tcp"
+	SHADOWSOCKSUDP = "shadowsocks-udp"
+	SHADOWSOCKSTCP = "shadowsocks-tcp"
+	UOT            = "udp-over-tcp"
 )
 
 type Priority int
@@ -58,5 +66,6 @@ const (
 
 const (
 	ConfigName = "proxy.yaml"
-	ScriptName = "clean_script.sh"
+	JournalName = "state_journal.json"
+	FakeIPName = "fake_ip_%s.json"
 )
\ No newline at end of file
@@ -70,9 +70,18 @@ func (info *RouteInfoSpec) String() string {
 	return strings.Join(args, " ")
 }
 
+// ip command of family
+func ipCommand(ipv6 bool) string {
+	if ipv6 {
+		return "ip -6"
+	}
+	return "ip"
+}
+
 // route
 type Route struct {
 	table string // ip route name // local| main | default | all | num
+	ipv6  bool   // ip -6 route, rules of route are ipv6 too
 
 	// manager
 	manager *Manager
@@ -88,7 +97,7 @@ type Route struct {
 // do action
 func (r *Route) action(action action) ([]byte, error) {
 	// do action
-	args := []string{"ip route", action.String(), r.Node.String(), r.Info.String()}
+	args := []string{ipCommand(r.ipv6), "route", action.String(), r.Node.String(), r.Info.String()}
 	// if table is not default
 	if r.table != "" {
 		args = append(args, "table", r.table)
@@ -220,6 +229,7 @@ type Rule struct {
 func (rule *Rule) action(action action) ([]byte, error) {
 	args := []string{"ip rule", action.String(), rule.ruleSelector.String(), rule.ruleAction.String()}
 	if rule.route != nil {
+		args[0] = ipCommand(rule.route.ipv6) + " rule"
 		args = append(args, "table", rule.route.table)
 	}
 	cmd := exec.Command("/bin/sh", "-c", strings.Join(args, " "))
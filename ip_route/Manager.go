@@ -31,6 +31,42 @@ func (m *Manager) CreateRoute(name string, node RouteNodeSpec, info RouteInfoSpe
 	return route, nil
 }
 
+// create ipv6 route, use ip -6
+func (m *Manager) CreateRoute6(name string, node RouteNodeSpec, info RouteInfoSpec) (*Route, error) {
+	route := &Route{
+		table: name,
+		ipv6:  true,
+		Node:  node,
+		Info:  info,
+	}
+	err := route.create()
+	if err != nil {
+		return nil, err
+	}
+	return route, nil
+}
+
+// remove route not created by manager, such as route left by last run
+func RemoveRoute(name string, ipv6 bool, node RouteNodeSpec, info RouteInfoSpec) ([]byte, error) {
+	route := &Route{
+		table: name,
+		ipv6:  ipv6,
+		Node:  node,
+		Info:  info,
+	}
+	return route.action(del)
+}
+
+// remove rule not created by manager, such as rule left by last run
+func RemoveRule(name string, ipv6 bool, ruleAction RuleAction, selector RuleSelector) ([]byte, error) {
+	rule := &Rule{
+		route:        &Route{table: name, ipv6: ipv6},
+		ruleAction:   ruleAction,
+		ruleSelector: selector,
+	}
+	return rule.action(del)
+}
+
 func init() {
 	logger = log.NewLogger("damon/route")
 	logger.SetLogLevel(log.LevelInfo)
@@ -2,9 +2,13 @@ package NewCGroups
 
 import (
 	"errors"
-	com "github.com/ArisAachen/deepin-network-proxy/com"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+
+	com "github.com/ArisAachen/deepin-network-proxy/com"
 )
 
 // Attach pid to cgroups path
@@ -24,3 +28,23 @@ func Attach(pid string, path string) error {
 	logger.Debugf("echo pid %s to cgroups %s success", pid, path)
 	return nil
 }
+
+// remove cgroup left by last run, procs in it is moved to parent cgroup first
+func Remove(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(path, procsPath))
+	if err != nil {
+		return err
+	}
+	parent := filepath.Join(filepath.Dir(path), procsPath)
+	for _, pid := range strings.Fields(string(buf)) {
+		err = ioutil.WriteFile(parent, []byte(pid), 0644)
+		if err != nil {
+			logger.Debugf("move pid %s to %s failed, err: %v", pid, parent, err)
+		}
+	}
+	// cgroup dir can only be removed by rmdir
+	return os.Remove(path)
+}
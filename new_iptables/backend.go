@@ -0,0 +1,230 @@
+package NewIptables
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+)
+
+// one operation on chain of table
+type Command struct {
+	Operation Operation
+	Table     string
+	Chain     string
+	Index     int // position of insert, start from 1
+	Cpl       *CompleteRule
+}
+
+// make string   -I Main 1 -j App -p tcp
+func (cmd *Command) String() string {
+	sl := []string{"-" + cmd.Operation.ToString(), cmd.Chain}
+	if cmd.Index != 0 && cmd.Operation == Insert {
+		sl = append(sl, strconv.Itoa(cmd.Index))
+	}
+	if cmd.Cpl != nil {
+		sl = append(sl, cmd.Cpl.String())
+	}
+	return strings.Join(sl, " ")
+}
+
+// make args   [-I Main 1 -j App -p tcp]
+func (cmd *Command) Args() []string {
+	sl := []string{"-" + cmd.Operation.ToString(), cmd.Chain}
+	if cmd.Index != 0 && cmd.Operation == Insert {
+		sl = append(sl, strconv.Itoa(cmd.Index))
+	}
+	if cmd.Cpl != nil {
+		sl = append(sl, cmd.Cpl.Args()...)
+	}
+	return sl
+}
+
+// command to undo this one, flush and policy cant be undone
+func (cmd *Command) inverse() (Command, bool) {
+	undo := Command{Table: cmd.Table, Chain: cmd.Chain, Cpl: cmd.Cpl}
+	switch cmd.Operation {
+	case New:
+		undo.Operation = Remove
+	case Remove:
+		undo.Operation = New
+	case Append, Insert:
+		undo.Operation = Delete
+	case Delete:
+		// position is lost
+		undo.Operation = Append
+	default:
+		return undo, false
+	}
+	return undo, true
+}
+
+// backend apply chain and rule operation to kernel
+type Backend interface {
+	// backend name, iptables, ip6tables, nftables or nftables6
+	Name() string
+	// prepare backend before first operation
+	Init() error
+	// run operation on chain of table, index is position of insert, start from 1
+	Run(operation Operation, table string, chain string, index int, cpl *CompleteRule) error
+	// apply commands at once, nothing is changed when failed
+	Apply(cmds []Command) error
+	// dump rules of table in kernel as iptables-save output
+	Save(table string) (string, error)
+}
+
+// choose backend, use iptables if installed, otherwise use nftables
+func DetectBackend() Backend {
+	if _, err := exec.LookPath("iptables"); err == nil {
+		return NewIptablesBackend()
+	}
+	logger.Info("iptables not found, use nftables backend")
+	return NewNftablesBackend()
+}
+
+// choose ipv6 backend, use ip6tables if installed, otherwise use nftables
+func DetectBackend6() Backend {
+	if _, err := exec.LookPath("ip6tables"); err == nil {
+		return NewIp6tablesBackend()
+	}
+	logger.Info("ip6tables not found, use nftables backend")
+	return NewNftables6Backend()
+}
+
+// backends of all enabled ip family, ipv6 is skipped when disabled in kernel
+func DetectBackends() []Backend {
+	backends := []Backend{DetectBackend()}
+	if com.IPv6Enabled() {
+		backends = append(backends, DetectBackend6())
+	}
+	return backends
+}
+
+// iptables command backend, ip6tables has the same usage
+type iptablesBackend struct {
+	command string
+}
+
+func NewIptablesBackend() Backend {
+	return &iptablesBackend{command: "iptables"}
+}
+
+func NewIp6tablesBackend() Backend {
+	return &iptablesBackend{command: "ip6tables"}
+}
+
+func (b *iptablesBackend) Name() string {
+	return b.command
+}
+
+// rules of last run is cleaned from state journal by manager first clean
+func (b *iptablesBackend) Init() error {
+	return nil
+}
+
+// run iptables command
+func (b *iptablesBackend) Run(operation Operation, table string, chain string, index int, cpl *CompleteRule) error {
+	command := &Command{Operation: operation, Table: table, Chain: chain, Index: index, Cpl: cpl}
+	// run without shell, so args are not split or quoted again
+	cmd := exec.Command(b.command, append([]string{"-t", table}, command.Args()...)...)
+	logger.Debugf("[%s] begin to run command: %v", table, cmd)
+	buf, err := cmd.CombinedOutput()
+	if err != nil {
+		logger.Warningf("[%s] run command failed, out: %s, err:%v", table, string(buf), err)
+		return err
+	}
+	return nil
+}
+
+// apply commands by iptables-restore, restore commits each table separately,
+// so tables already committed are rolled back when one table failed
+func (b *iptablesBackend) Apply(cmds []Command) error {
+	var tables []string
+	tableCmds := make(map[string][]Command)
+	for _, cmd := range cmds {
+		if _, ok := tableCmds[cmd.Table]; !ok {
+			tables = append(tables, cmd.Table)
+		}
+		tableCmds[cmd.Table] = append(tableCmds[cmd.Table], cmd)
+	}
+	for index, table := range tables {
+		err := b.restore(table, tableCmds[table])
+		if err == nil {
+			continue
+		}
+		// undo committed tables in reverse order
+		for undoIndex := index - 1; undoIndex >= 0; undoIndex-- {
+			undoTable := tables[undoIndex]
+			undoErr := b.restore(undoTable, inverseCommands(tableCmds[undoTable]))
+			if undoErr != nil {
+				logger.Warningf("[%s] rollback failed, err: %v", undoTable, undoErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// run iptables-restore without flush other rules
+func (b *iptablesBackend) restore(table string, cmds []Command) error {
+	input := restoreInput(table, cmds)
+	logger.Debugf("[%s] begin to restore:\n%s", table, input)
+	cmd := exec.Command(b.command+"-restore", "--noflush")
+	cmd.Stdin = strings.NewReader(input)
+	buf, err := cmd.CombinedOutput()
+	if err != nil {
+		logger.Warningf("[%s] restore failed, out: %s, err: %v", table, string(buf), err)
+		return fmt.Errorf("%s-restore %s failed: %s", b.command, table, strings.TrimSpace(string(buf)))
+	}
+	return nil
+}
+
+// dump table by iptables-save
+func (b *iptablesBackend) Save(table string) (string, error) {
+	buf, err := exec.Command(b.command+"-save", "-t", table).Output()
+	if err != nil {
+		logger.Warningf("[%s] save failed, err: %v", table, err)
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// make iptables-restore input of one table
+/*
+	*mangle
+	:App - [0:0]
+	-I Main 1 -j App -p tcp -m cgroup --path App.slice
+	-A App -j MARK --set-mark 8080
+	COMMIT
+*/
+func restoreInput(table string, cmds []Command) string {
+	var buf bytes.Buffer
+	buf.WriteString("*" + table + "\n")
+	for _, cmd := range cmds {
+		// new chain is declared as chain without policy
+		if cmd.Operation == New {
+			buf.WriteString(":" + cmd.Chain + " - [0:0]\n")
+			continue
+		}
+		buf.WriteString(cmd.String() + "\n")
+	}
+	buf.WriteString("COMMIT\n")
+	return buf.String()
+}
+
+// commands to undo cmds in reverse order, command cant be undone is skipped
+func inverseCommands(cmds []Command) []Command {
+	var undo []Command
+	for index := len(cmds) - 1; index >= 0; index-- {
+		cmd, ok := cmds[index].inverse()
+		if !ok {
+			logger.Warningf("[%s] command %s cant be undone", cmds[index].Table, cmds[index].String())
+			continue
+		}
+		undo = append(undo, cmd)
+	}
+	return undo
+}
@@ -2,10 +2,6 @@ package NewIptables
 
 import (
 	"errors"
-	"os/exec"
-	"reflect"
-	"strconv"
-	"strings"
 
 	com "github.com/ArisAachen/deepin-network-proxy/com"
 )
@@ -14,27 +10,25 @@ import (
 type Table struct {
 	Name   string // raw mangle nat filter
 	chains map[string]*Chain
+
+	// command is recorded when transaction in progress
+	tx *Transaction
+	// manager to record applied command
+	manager *Manager
 }
 
-// run iptables command
+// run command by backends of manager
 func (t *Table) runCommand(operation Operation, chain *Chain, index int, cpl *CompleteRule) error {
-	// run command
-	args := []string{"iptables", "-t", t.Name, "-" + operation.ToString(), chain.Name}
-	// add index
-	if index != 0 && operation == Insert {
-		args = append(args, strconv.Itoa(index))
-	}
-	// add one complete rule
-	if cpl != nil {
-		args = append(args, cpl.String())
+	cmd := Command{Operation: operation, Table: t.Name, Chain: chain.Name, Index: index, Cpl: cpl}
+	if t.tx != nil {
+		t.tx.add(cmd)
+		return nil
 	}
-	cmd := exec.Command("/bin/sh", "-c", strings.Join(args, " "))
-	logger.Debugf("[%s] begin to run begin to run command: %v", t.Name, cmd)
-	buf, err := cmd.CombinedOutput()
+	err := t.manager.run(cmd)
 	if err != nil {
-		logger.Warningf("[%s] run command failed, out: %s, err:%v", t.Name, string(buf), err)
 		return err
 	}
+	t.manager.record([]Command{cmd})
 	logger.Debugf("[%s] run command success", t.Name)
 	return nil
 }
@@ -121,7 +115,7 @@ func (c *Chain) GetChildrenCount() int {
 func (c *Chain) GetCreateChildIndex(name string) (int, bool) {
 	// search all rule
 	for index, rule := range c.cplRuleSl {
-		if strings.Contains(rule.String(), strings.Join([]string{"-j", name}, " ")) {
+		if rule.Action == name {
 			logger.Debugf("[%s] chain %s has child %s in %v", c.table.Name, c.Name, name, index)
 			return index, true
 		}
@@ -189,10 +183,17 @@ func (c *Chain) DelChild(child *Chain) error {
 		return nil
 	}
 	logger.Debugf("[%s] chain %s has child %s, begin to delete", c.table.Name, c.Name, child.Name)
-	if index, exist := c.GetCreateChildIndex(child.Name); exist {
-		return c.DelRuleByIndex(index)
+	// child may be jumped by more than one rule, such as tcp and udp
+	for {
+		index, exist := c.GetCreateChildIndex(child.Name)
+		if !exist {
+			return nil
+		}
+		err := c.DelRuleByIndex(index)
+		if err != nil {
+			return err
+		}
 	}
-	return nil
 }
 
 // add rule
@@ -249,14 +250,23 @@ func (c *Chain) InsertRule(index int, cpl *CompleteRule) error {
 	return nil
 }
 
-// check if rule exist
-func (c *Chain) ExistRule(cpl *CompleteRule) bool {
+// find saved rule which is the same in kernel, nil if not exist
+func (c *Chain) findRule(cpl *CompleteRule) *CompleteRule {
+	key := ruleKey(cpl)
 	for _, rule := range c.cplRuleSl {
-		if reflect.DeepEqual(rule, cpl) {
-			logger.Debugf("[%s] chain %s exist rule %s", c.table.Name, c.Name, cpl.String())
-			return true
+		if ruleKey(rule) == key {
+			return rule
 		}
 	}
+	return nil
+}
+
+// check if rule exist
+func (c *Chain) ExistRule(cpl *CompleteRule) bool {
+	if c.findRule(cpl) != nil {
+		logger.Debugf("[%s] chain %s exist rule %s", c.table.Name, c.Name, cpl.String())
+		return true
+	}
 	logger.Debugf("[%s] chain %s dont exist rule %s", c.table.Name, c.Name, cpl.String())
 	return false
 }
@@ -264,7 +274,8 @@ func (c *Chain) ExistRule(cpl *CompleteRule) bool {
 // del rule
 func (c *Chain) DelRule(cpl *CompleteRule) error {
 	// check if rule exist
-	if !c.ExistRule(cpl) {
+	cpl = c.findRule(cpl)
+	if cpl == nil {
 		return nil
 	}
 	// clear self chain
@@ -1,14 +1,18 @@
 package NewIptables
 
-import "github.com/linuxdeepin/go-lib/log"
+import (
+	"strings"
+
+	"github.com/linuxdeepin/go-lib/log"
+)
 
 /*
 	Iptables module extends
 	1. linux net flow redirect (now support)
 	2. transparent proxy (now support)
 	3. firewall (now support)
-	4. ipv4 (now support)       // iptables    may use nf_tables
-	5. ipv6 (not support yet)   // ip6tables   may use nf_tables
+	4. ipv4 (now support)       // iptables or nftables backend
+	5. ipv6 (now support)       // ip6tables or nftables ip6 backend, chains are the same as ipv4
 */
 
 // https://linux.die.net/man/8/iptables
@@ -41,25 +45,92 @@ var tableSl = map[string][]string{
 
 type Manager struct {
 	tables map[string]*Table
+
+	// backend of each ip family, the same command is applied to all
+	backends []Backend
+	// transaction in progress
+	tx *Transaction
+	// record applied commands
+	recorder Recorder
 }
 
-// create manager
+// create manager, backend of ipv4 and ipv6 is detected
 func NewManager() *Manager {
+	return NewManagerWithBackend(DetectBackends()...)
+}
+
+// create manager with backends
+func NewManagerWithBackend(backends ...Backend) *Manager {
 	manager := &Manager{
-		tables: make(map[string]*Table),
+		tables:   make(map[string]*Table),
+		backends: backends,
 	}
 	return manager
 }
 
+// backend names, iptables,ip6tables
+func (m *Manager) BackendName() string {
+	var names []string
+	for _, backend := range m.backends {
+		names = append(names, backend.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// run command by all backends, backends already run is undone when failed
+func (m *Manager) run(cmd Command) error {
+	for index, backend := range m.backends {
+		err := backend.Run(cmd.Operation, cmd.Table, cmd.Chain, cmd.Index, cmd.Cpl)
+		if err == nil {
+			continue
+		}
+		if undo, ok := cmd.inverse(); ok {
+			for undoIndex := index - 1; undoIndex >= 0; undoIndex-- {
+				undoErr := m.backends[undoIndex].Run(undo.Operation, undo.Table, undo.Chain, undo.Index, undo.Cpl)
+				if undoErr != nil {
+					logger.Warningf("[%s] undo %s failed, err: %v", m.backends[undoIndex].Name(), undo.String(), undoErr)
+				}
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// apply commands by all backends, backends already applied is undone when failed
+func (m *Manager) apply(cmds []Command) error {
+	for index, backend := range m.backends {
+		err := backend.Apply(cmds)
+		if err == nil {
+			continue
+		}
+		for undoIndex := index - 1; undoIndex >= 0; undoIndex-- {
+			undoErr := m.backends[undoIndex].Apply(inverseCommands(cmds))
+			if undoErr != nil {
+				logger.Warningf("[%s] rollback failed, err: %v", m.backends[undoIndex].Name(), undoErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
 // init table
 func (m *Manager) Init() {
-	logger.Debug("init manager")
+	logger.Debugf("init manager, backend: %s", m.BackendName())
+	for _, backend := range m.backends {
+		err := backend.Init()
+		if err != nil {
+			logger.Warningf("init backend %s failed, err: %v", backend.Name(), err)
+		}
+	}
 	// init default table and chain
 	for tName, cNameSl := range tableSl {
 		// create tables to manager
 		table := &Table{
-			Name:   tName,
-			chains: make(map[string]*Chain),
+			Name:    tName,
+			chains:  make(map[string]*Chain),
+			manager: m,
 		}
 		// create chain to table
 		for _, cName := range cNameSl {
@@ -0,0 +1,540 @@
+package NewIptables
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// nft tables are named with prefix, dont conflict with iptables-nft tables
+const nftTablePrefix = "deepin_proxy_"
+
+// cgroup v2 mount point, hybrid mode mount at unified
+var cgroup2Paths = []string{"/sys/fs/cgroup/unified", "/sys/fs/cgroup"}
+
+// base chain of iptables table
+type nftBaseChain struct {
+	typ      nftables.ChainType
+	hook     *nftables.ChainHook
+	priority *nftables.ChainPriority
+}
+
+// iptables default chains expressed as nft base chains
+var nftBaseChains = map[string]map[string]nftBaseChain{
+	"raw": {
+		"PREROUTING": {nftables.ChainTypeFilter, nftables.ChainHookPrerouting, nftables.ChainPriorityRaw},
+		"OUTPUT":     {nftables.ChainTypeFilter, nftables.ChainHookOutput, nftables.ChainPriorityRaw},
+	},
+	"mangle": {
+		"PREROUTING":  {nftables.ChainTypeFilter, nftables.ChainHookPrerouting, nftables.ChainPriorityMangle},
+		"INPUT":       {nftables.ChainTypeFilter, nftables.ChainHookInput, nftables.ChainPriorityMangle},
+		"FORWARD":     {nftables.ChainTypeFilter, nftables.ChainHookForward, nftables.ChainPriorityMangle},
+		"OUTPUT":      {nftables.ChainTypeRoute, nftables.ChainHookOutput, nftables.ChainPriorityMangle},
+		"POSTROUTING": {nftables.ChainTypeFilter, nftables.ChainHookPostrouting, nftables.ChainPriorityMangle},
+	},
+	"nat": {
+		"PREROUTING":  {nftables.ChainTypeNAT, nftables.ChainHookPrerouting, nftables.ChainPriorityNATDest},
+		"OUTPUT":      {nftables.ChainTypeNAT, nftables.ChainHookOutput, nftables.ChainPriorityNATDest},
+		"POSTROUTING": {nftables.ChainTypeNAT, nftables.ChainHookPostrouting, nftables.ChainPriorityNATSource},
+	},
+	"filter": {
+		"INPUT":   {nftables.ChainTypeFilter, nftables.ChainHookInput, nftables.ChainPriorityFilter},
+		"FORWARD": {nftables.ChainTypeFilter, nftables.ChainHookForward, nftables.ChainPriorityFilter},
+		"OUTPUT":  {nftables.ChainTypeFilter, nftables.ChainHookOutput, nftables.ChainPriorityFilter},
+	},
+}
+
+// nftables netlink backend, rule is saved with its iptables string as user data,
+// so rule can be found by the same complete rule when delete
+type nftablesBackend struct {
+	lock sync.Mutex
+	// ip or ip6, tables of each family is separated
+	family nftables.TableFamily
+}
+
+func NewNftablesBackend() Backend {
+	return &nftablesBackend{family: nftables.TableFamilyIPv4}
+}
+
+// nftables backend of ipv6
+func NewNftables6Backend() Backend {
+	return &nftablesBackend{family: nftables.TableFamilyIPv6}
+}
+
+func (b *nftablesBackend) Name() string {
+	if b.family == nftables.TableFamilyIPv6 {
+		return "nftables6"
+	}
+	return "nftables"
+}
+
+// remove tables left by last run
+func (b *nftablesBackend) Init() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	tables, err := conn.ListTablesOfFamily(b.family)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if strings.HasPrefix(table.Name, nftTablePrefix) {
+			conn.DelTable(table)
+		}
+	}
+	return conn.Flush()
+}
+
+// run operation with netlink
+func (b *nftablesBackend) Run(operation Operation, table string, chain string, index int, cpl *CompleteRule) error {
+	return b.Apply([]Command{{Operation: operation, Table: table, Chain: chain, Index: index, Cpl: cpl}})
+}
+
+// apply commands in one netlink batch, kernel commits batch as a transaction,
+// batch is split only when insert position cant be expressed by rules in batch
+func (b *nftablesBackend) Apply(cmds []Command) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	batch := &nftBatch{conn: conn, chains: make(map[string]nftChainRules)}
+	for _, cmd := range cmds {
+		err = b.add(batch, cmd.Operation, cmd.Table, cmd.Chain, cmd.Index, cmd.Cpl)
+		if err != nil {
+			return err
+		}
+	}
+	return conn.Flush()
+}
+
+// dump table with rule user data, table not created yet is empty
+func (b *nftablesBackend) Save(table string) (string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	conn, err := nftables.New()
+	if err != nil {
+		return "", err
+	}
+	chains, err := conn.ListChainsOfTableFamily(b.family)
+	if err != nil {
+		return "", err
+	}
+	var header, rules []string
+	for _, chain := range chains {
+		if chain.Table.Name != nftTablePrefix+table {
+			continue
+		}
+		policy := "-"
+		if _, ok := nftBaseChains[table][chain.Name]; ok {
+			policy = "ACCEPT"
+		}
+		header = append(header, fmt.Sprintf(":%s %s [0:0]", chain.Name, policy))
+		chainRules, err := conn.GetRules(chain.Table, chain)
+		if err != nil {
+			return "", err
+		}
+		for _, rule := range chainRules {
+			rules = append(rules, fmt.Sprintf("-A %s %s", chain.Name, string(rule.UserData)))
+		}
+	}
+	lines := append([]string{"*" + table}, header...)
+	lines = append(lines, rules...)
+	lines = append(lines, "COMMIT", "")
+	return strings.Join(lines, "\n"), nil
+}
+
+// add operation to batch
+func (b *nftablesBackend) add(batch *nftBatch, operation Operation, table string, chain string, index int, cpl *CompleteRule) error {
+	conn := batch.conn
+	logger.Debugf("[%s] nft run operation -%s %s %d %v", table, operation.ToString(), chain, index, cpl)
+	nftTable := &nftables.Table{
+		Name:   nftTablePrefix + table,
+		Family: b.family,
+	}
+	nftChain := &nftables.Chain{
+		Name:  chain,
+		Table: nftTable,
+	}
+	// table and base chain is created when used, create is ignored if exist
+	conn.AddTable(nftTable)
+	if base, ok := nftBaseChains[table][chain]; ok {
+		nftChain.Type = base.typ
+		nftChain.Hooknum = base.hook
+		nftChain.Priority = base.priority
+		conn.AddChain(nftChain)
+	}
+	switch operation {
+	case New:
+		conn.AddChain(nftChain)
+		batch.chains[table+"/"+chain] = nftChainRules{}
+	case Remove:
+		conn.DelChain(nftChain)
+		batch.chains[table+"/"+chain] = nftChainRules{}
+	case Flush:
+		conn.FlushChain(nftChain)
+		batch.chains[table+"/"+chain] = nftChainRules{}
+	case Append, Insert:
+		exprs, err := nftExprs(b.family, cpl)
+		if err != nil {
+			return err
+		}
+		rule := &nftables.Rule{
+			Table:    nftTable,
+			Chain:    nftChain,
+			Exprs:    exprs,
+			UserData: []byte(cpl.String()),
+		}
+		rules := batch.rules(nftTable, nftChain)
+		if operation == Append {
+			conn.AddRule(rule)
+			batch.chains[table+"/"+chain] = append(rules, 0)
+			break
+		}
+		// insert at index, anchor may be rule added in this batch
+		pos, ok := rules.locate(index)
+		if !ok {
+			// rules added in batch have no handle, commit them to get handles
+			err = conn.Flush()
+			if err != nil {
+				return err
+			}
+			batch.chains = make(map[string]nftChainRules)
+			rules = batch.rules(nftTable, nftChain)
+			pos, _ = rules.locate(index)
+		}
+		rule.Position = pos.handle
+		if pos.after || pos.tail {
+			conn.AddRule(rule)
+		} else {
+			conn.InsertRule(rule)
+		}
+		batch.chains[table+"/"+chain] = rules.insert(index)
+	case Delete:
+		rules, err := conn.GetRules(nftTable, nftChain)
+		if err != nil {
+			return err
+		}
+		found := false
+		key := ruleKey(cpl)
+		for _, rule := range rules {
+			saved, err := parseRuleString(string(rule.UserData))
+			if err != nil {
+				continue
+			}
+			if ruleKey(saved) == key {
+				err = conn.DelRule(rule)
+				if err != nil {
+					return err
+				}
+				batch.chains[table+"/"+chain] = batch.rules(nftTable, nftChain).remove(rule.Handle)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("rule [%s] not found in chain %s", cpl.String(), chain)
+		}
+	default:
+		return fmt.Errorf("operation -%s is not support by nftables", operation.ToString())
+	}
+	return nil
+}
+
+// operations of one netlink batch and rules of chains changed in batch
+type nftBatch struct {
+	conn *nftables.Conn
+	// [table]/[chain] -> rules
+	chains map[string]nftChainRules
+}
+
+// rules of chain in batch, read from kernel when first used
+func (batch *nftBatch) rules(table *nftables.Table, chain *nftables.Chain) nftChainRules {
+	key := strings.TrimPrefix(table.Name, nftTablePrefix) + "/" + chain.Name
+	if rules, ok := batch.chains[key]; ok {
+		return rules
+	}
+	// chain not exist yet has no rule
+	var rules nftChainRules
+	saved, err := batch.conn.GetRules(table, chain)
+	if err == nil {
+		for _, rule := range saved {
+			rules = append(rules, rule.Handle)
+		}
+	}
+	batch.chains[key] = rules
+	return rules
+}
+
+// handles of rules in chain order, handle of rule added in batch is zero
+type nftChainRules []uint64
+
+// anchor of insert, nft insert before anchor or add after anchor
+type nftPosition struct {
+	handle uint64
+	after  bool
+	// no anchor, insert at head or add at tail
+	tail bool
+}
+
+// find anchor to make rule the index one (start from 1),
+// rule added in batch cant be anchor, false is returned if no anchor can be used
+/*
+	rules 10 0 20      insert 1   head
+	                   insert 2   add after 10
+	                   insert 3   insert before 20
+	                   insert 4   add at tail
+	rules 10 0 0       insert 3   no anchor
+*/
+func (rules nftChainRules) locate(index int) (nftPosition, bool) {
+	pos := index - 1
+	if pos <= 0 {
+		return nftPosition{}, true
+	}
+	if pos >= len(rules) {
+		return nftPosition{tail: true}, true
+	}
+	if prev := rules[pos-1]; prev != 0 {
+		return nftPosition{handle: prev, after: true}, true
+	}
+	if next := rules[pos]; next != 0 {
+		return nftPosition{handle: next}, true
+	}
+	return nftPosition{}, false
+}
+
+// rules after insert at index
+func (rules nftChainRules) insert(index int) nftChainRules {
+	pos := index - 1
+	if pos < 0 {
+		pos = 0
+	}
+	if pos > len(rules) {
+		pos = len(rules)
+	}
+	result := make(nftChainRules, 0, len(rules)+1)
+	result = append(result, rules[:pos]...)
+	result = append(result, 0)
+	return append(result, rules[pos:]...)
+}
+
+// rules after delete
+func (rules nftChainRules) remove(handle uint64) nftChainRules {
+	result := make(nftChainRules, 0, len(rules))
+	for _, rule := range rules {
+		if rule != handle {
+			result = append(result, rule)
+		}
+	}
+	return result
+}
+
+// convert complete rule to nft expressions
+/*
+	-j MARK --set-mark 8080                                 meta mark set 8080
+	-j TPROXY -p tcp --on-port 8080 -m mark --mark 8080     meta l4proto tcp meta mark 8080 tproxy to :8080
+	-j App -p tcp -m cgroup --path App.slice                meta l4proto tcp socket cgroupv2 level 1 "App.slice" jump App
+	-j REDIRECT -p udp --to-ports 1053 -m udp --dport 53    meta l4proto udp udp dport 53 redirect to :1053
+	-j RETURN -o lo                                         oifname "lo" return
+*/
+func nftExprs(family nftables.TableFamily, cpl *CompleteRule) ([]expr.Any, error) {
+	if cpl == nil {
+		return nil, fmt.Errorf("rule is nil")
+	}
+	var proto string
+	// option name -> option
+	options := make(map[string]BaseRule)
+	for _, base := range cpl.BaseSl {
+		name := strings.TrimPrefix(base.Match, "-")
+		if name == "p" {
+			proto = base.Param
+			continue
+		}
+		options[name] = base
+	}
+	for _, extends := range cpl.ExtendsSl {
+		// -p tcp --on-port or -m tcp --dport
+		if extends.Match == "p" || extends.Elem.Match == "tcp" || extends.Elem.Match == "udp" {
+			proto = extends.Elem.Match
+		}
+		options[extends.Elem.Base.Match] = extends.Elem.Base
+	}
+
+	var exprs []expr.Any
+	// interface
+	for _, name := range []string{"i", "o"} {
+		option, ok := options[name]
+		if !ok {
+			continue
+		}
+		delete(options, name)
+		key := expr.MetaKeyIIFNAME
+		if name == "o" {
+			key = expr.MetaKeyOIFNAME
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: key, Register: 1},
+			&expr.Cmp{Op: cmpOp(option.Not), Register: 1, Data: ifname(option.Param)},
+		)
+	}
+	// proto
+	if proto != "" {
+		var protoNum byte
+		switch proto {
+		case "tcp":
+			protoNum = unix.IPPROTO_TCP
+		case "udp":
+			protoNum = unix.IPPROTO_UDP
+		default:
+			return nil, fmt.Errorf("proto %s is not support", proto)
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{protoNum}},
+		)
+	}
+	// dest port
+	if option, ok := options["dport"]; ok {
+		delete(options, "dport")
+		port, err := parsePort(option.Param)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs,
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Cmp{Op: cmpOp(option.Not), Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+		)
+	}
+	// mark
+	if option, ok := options["mark"]; ok {
+		delete(options, "mark")
+		mark, err := strconv.ParseUint(option.Param, 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+			&expr.Cmp{Op: cmpOp(option.Not), Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(mark))},
+		)
+	}
+	// cgroup v2 path
+	if option, ok := options["path"]; ok {
+		delete(options, "path")
+		id, level, err := cgroupID(option.Param)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs,
+			&expr.Socket{Key: expr.SocketKeyCgroupv2, Level: level, Register: 1},
+			&expr.Cmp{Op: cmpOp(option.Not), Register: 1, Data: binaryutil.NativeEndian.PutUint64(id)},
+		)
+	}
+
+	// action
+	switch cpl.Action {
+	case ACCEPT:
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+	case DROP:
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictDrop})
+	case RETURN:
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictReturn})
+	case MARK:
+		option, ok := options["set-mark"]
+		if !ok {
+			return nil, fmt.Errorf("MARK has no --set-mark")
+		}
+		delete(options, "set-mark")
+		mark, err := strconv.ParseUint(option.Param, 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs,
+			&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(mark))},
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+		)
+	case TPROXY, REDIRECT:
+		name := "on-port"
+		if cpl.Action == REDIRECT {
+			name = "to-ports"
+		}
+		option, ok := options[name]
+		if !ok {
+			return nil, fmt.Errorf("%s has no --%s", cpl.Action, name)
+		}
+		delete(options, name)
+		if proto == "" {
+			return nil, fmt.Errorf("%s need proto", cpl.Action)
+		}
+		port, err := parsePort(option.Param)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, &expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(port)})
+		if cpl.Action == TPROXY {
+			exprs = append(exprs, &expr.TProxy{Family: byte(family), TableFamily: byte(family), RegPort: 1})
+		} else {
+			exprs = append(exprs, &expr.Redir{RegisterProtoMin: 1})
+		}
+	default:
+		// self define chain
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictJump, Chain: cpl.Action})
+	}
+	// option which is not converted
+	for name := range options {
+		return nil, fmt.Errorf("option %s is not support by nftables", name)
+	}
+	return exprs, nil
+}
+
+func cmpOp(not bool) expr.CmpOp {
+	if not {
+		return expr.CmpOpNeq
+	}
+	return expr.CmpOpEq
+}
+
+// interface name is compared with IFNAMSIZ bytes
+func ifname(name string) []byte {
+	buf := make([]byte, unix.IFNAMSIZ)
+	copy(buf, name)
+	return buf
+}
+
+func parsePort(port string) (uint16, error) {
+	value, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("port %s is invalid", port)
+	}
+	return uint16(value), nil
+}
+
+// cgroup v2 id is inode of cgroup dir, level is depth from root
+func cgroupID(path string) (uint64, uint32, error) {
+	path = strings.Trim(path, "/")
+	for _, root := range cgroup2Paths {
+		info, err := os.Stat(filepath.Join(root, path))
+		if err != nil {
+			continue
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			continue
+		}
+		if path == "" {
+			return stat.Ino, 0, nil
+		}
+		return stat.Ino, uint32(len(strings.Split(path, "/"))), nil
+	}
+	return 0, 0, fmt.Errorf("cgroup %s not found", path)
+}
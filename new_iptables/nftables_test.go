@@ -0,0 +1,156 @@
+package NewIptables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+func TestNftExprs(t *testing.T) {
+	// fake cgroup v2 root
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	_ = os.Mkdir(filepath.Join(root, "App.slice"), 0755)
+	info, _ := os.Stat(filepath.Join(root, "App.slice"))
+	ino := info.Sys().(*syscall.Stat_t).Ino
+	cgroup2Paths = []string{root}
+
+	// -j App -p tcp -m cgroup ! --path App.slice
+	exprs, err := nftExprs(nftables.TableFamilyIPv4, &CompleteRule{
+		Action: "App",
+		BaseSl: []BaseRule{{Match: "p", Param: "tcp"}},
+		ExtendsSl: []ExtendsRule{{
+			Match: "m",
+			Elem:  ExtendsElem{Match: "cgroup", Base: BaseRule{Not: true, Match: "path", Param: "App.slice"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{6}},
+		&expr.Socket{Key: expr.SocketKeyCgroupv2, Level: 1, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint64(ino)},
+		&expr.Verdict{Kind: expr.VerdictJump, Chain: "App"},
+	}
+	if !reflect.DeepEqual(exprs, want) {
+		t.Errorf("cgroup rule exprs is %v, want %v", exprs, want)
+	}
+
+	// -j TPROXY -p tcp --on-port 8080 -m mark --mark 8080
+	exprs, err = nftExprs(nftables.TableFamilyIPv4, &CompleteRule{
+		Action: TPROXY,
+		ExtendsSl: []ExtendsRule{
+			{Match: "p", Elem: ExtendsElem{Match: "tcp", Base: BaseRule{Match: "on-port", Param: "8080"}}},
+			{Match: "m", Elem: ExtendsElem{Match: "mark", Base: BaseRule{Match: "mark", Param: "8080"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exprs) != 6 {
+		t.Fatalf("tproxy rule exprs is %v", exprs)
+	}
+	if tproxy, ok := exprs[5].(*expr.TProxy); !ok || tproxy.RegPort != 1 {
+		t.Errorf("last expr is %v, want tproxy", exprs[5])
+	}
+	if imm, ok := exprs[4].(*expr.Immediate); !ok || !reflect.DeepEqual(imm.Data, []byte{0x1f, 0x90}) {
+		t.Errorf("port expr is %v", exprs[4])
+	}
+	// ip6 table use ipv6 tproxy
+	exprs, err = nftExprs(nftables.TableFamilyIPv6, &CompleteRule{
+		Action: TPROXY,
+		ExtendsSl: []ExtendsRule{
+			{Match: "p", Elem: ExtendsElem{Match: "tcp", Base: BaseRule{Match: "on-port", Param: "8080"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tproxy, ok := exprs[len(exprs)-1].(*expr.TProxy); !ok || tproxy.Family != byte(nftables.TableFamilyIPv6) {
+		t.Errorf("ipv6 tproxy expr is %v", exprs[len(exprs)-1])
+	}
+
+	// -j REDIRECT -p udp --to-ports 1053 -m udp --dport 53
+	exprs, err = nftExprs(nftables.TableFamilyIPv4, &CompleteRule{
+		Action: REDIRECT,
+		BaseSl: []BaseRule{{Match: "p", Param: "udp"}, {Match: "-to-ports", Param: "1053"}},
+		ExtendsSl: []ExtendsRule{
+			{Match: "m", Elem: ExtendsElem{Match: "udp", Base: BaseRule{Match: "dport", Param: "53"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := exprs[len(exprs)-1].(*expr.Redir); !ok || len(exprs) != 6 {
+		t.Errorf("redirect rule exprs is %v", exprs)
+	}
+
+	// unsupported option
+	_, err = nftExprs(nftables.TableFamilyIPv4, &CompleteRule{Action: ACCEPT, BaseSl: []BaseRule{{Match: "s", Param: "10.0.0.1"}}})
+	if err == nil {
+		t.Error("unsupported option should fail")
+	}
+}
+
+func TestNftChainRulesLocate(t *testing.T) {
+	rules := nftChainRules{10, 0, 20}
+	tests := []struct {
+		index int
+		pos   nftPosition
+	}{
+		{1, nftPosition{}},
+		{2, nftPosition{handle: 10, after: true}},
+		{3, nftPosition{handle: 20}},
+		{4, nftPosition{tail: true}},
+	}
+	for _, test := range tests {
+		pos, ok := rules.locate(test.index)
+		if !ok || pos != test.pos {
+			t.Errorf("locate %d is %+v %v, want %+v", test.index, pos, ok, test.pos)
+		}
+	}
+	// rules added in batch cant be anchor
+	if _, ok := (nftChainRules{10, 0, 0}).locate(3); ok {
+		t.Error("locate between rules added in batch should fail")
+	}
+}
+
+func TestNftChainRulesInsertTwice(t *testing.T) {
+	// tcp and udp jump rules inserted at 2 and 3 in one batch
+	rules := nftChainRules{10, 20, 30}
+	pos, ok := rules.locate(2)
+	if !ok || pos != (nftPosition{handle: 10, after: true}) {
+		t.Fatalf("first insert position is %+v %v", pos, ok)
+	}
+	rules = rules.insert(2)
+	pos, ok = rules.locate(3)
+	if !ok || pos != (nftPosition{handle: 20}) {
+		t.Fatalf("second insert position is %+v %v", pos, ok)
+	}
+	rules = rules.insert(3)
+	if !reflect.DeepEqual(rules, nftChainRules{10, 0, 0, 20, 30}) {
+		t.Errorf("rules after insert is %v", rules)
+	}
+	// empty chain, second insert is at tail
+	rules = nftChainRules{}.insert(1)
+	pos, ok = rules.locate(2)
+	if !ok || pos != (nftPosition{tail: true}) {
+		t.Errorf("insert after rule of batch in empty chain is %+v %v", pos, ok)
+	}
+	// deleted rule is not anchor any more
+	if rules = (nftChainRules{10, 0, 20}).remove(20); !reflect.DeepEqual(rules, nftChainRules{10, 0}) {
+		t.Errorf("rules after remove is %v", rules)
+	}
+}
@@ -0,0 +1,126 @@
+package NewIptables
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// owner tag is saved as rule comment, so rules of daemon can be found in iptables-save
+/*
+	-A PREROUTING -p tcp -m mark --mark 0x1f90 -m comment --comment "deepin-network-proxy:3f2a9c1e:App" -j TPROXY ...
+	                                                                  prefix           instance  scope
+*/
+const OwnerPrefix = "deepin-network-proxy"
+
+// generate instance id of daemon
+func NewInstanceID() string {
+	buf := make([]byte, 4)
+	_, err := rand.Read(buf)
+	if err != nil {
+		logger.Warningf("[owner] generate instance id failed, err: %v", err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// owner tag of daemon instance and scope
+func OwnerTag(instance string, scope string) string {
+	return fmt.Sprintf("%s:%s:%s", OwnerPrefix, instance, scope)
+}
+
+// parse owner tag, false if comment is not made by daemon
+func ParseOwnerTag(comment string) (string, string, bool) {
+	sl := strings.Split(comment, ":")
+	if len(sl) != 3 || sl[0] != OwnerPrefix {
+		return "", "", false
+	}
+	return sl[1], sl[2], true
+}
+
+// delete all rules of owner from chain
+func (c *Chain) DelRulesByOwner(tag string) error {
+	var rules []*CompleteRule
+	for _, rule := range c.cplRuleSl {
+		if rule.Comment == tag {
+			rules = append(rules, rule)
+		}
+	}
+	for _, rule := range rules {
+		err := c.DelRule(rule)
+		if err != nil {
+			return err
+		}
+	}
+	logger.Debugf("[%s] chain %s delete %d rules of %s", c.table.Name, c.Name, len(rules), tag)
+	return nil
+}
+
+// remove rules of instance in kernel and chains only jumped by them,
+// return count of failed command
+func (m *Manager) CleanOwner(instance string) int {
+	var names []string
+	for name := range m.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	failed := 0
+	// rules of each family may be different
+	for _, backend := range m.backends {
+		failed += cleanBackend(backend, ownerCommands(backend, names, instance))
+	}
+	return failed
+}
+
+// commands to remove rules of instance in tables of backend
+func ownerCommands(backend Backend, names []string, instance string) []Command {
+	var cmds []Command
+	for _, name := range names {
+		data, err := backend.Save(name)
+		if err != nil {
+			continue
+		}
+		tables, err := ParseSave(data)
+		if err != nil {
+			logger.Warningf("[%s] parse save failed, err: %v", name, err)
+			continue
+		}
+		kernel, ok := tables[name]
+		if !ok {
+			continue
+		}
+		cmds = append(cmds, kernel.ownerCommands(instance, tableSl[name])...)
+	}
+	return cmds
+}
+
+// commands to delete rules of instance, and flush and remove user chains jumped by them
+func (t *Table) ownerCommands(instance string, defaults []string) []Command {
+	var names []string
+	for name := range t.chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var rules, chains []Command
+	targets := make(map[string]bool)
+	for _, name := range names {
+		for _, cpl := range t.chains[name].cplRuleSl {
+			tagInstance, _, ok := ParseOwnerTag(cpl.Comment)
+			if !ok || tagInstance != instance {
+				continue
+			}
+			rules = append(rules, Command{Operation: Delete, Table: t.Name, Chain: name, Cpl: cpl})
+			targets[cpl.Action] = true
+		}
+	}
+	for _, name := range names {
+		if !targets[name] || indexOf(defaults, name) >= 0 {
+			continue
+		}
+		chains = append(chains,
+			Command{Operation: Flush, Table: t.Name, Chain: name},
+			Command{Operation: Remove, Table: t.Name, Chain: name})
+	}
+	return append(rules, chains...)
+}
@@ -0,0 +1,149 @@
+package NewIptables
+
+import (
+	"fmt"
+	"sort"
+)
+
+// compare chains in memory with kernel, re-apply missing chains and rules,
+// return description of drift, rules added by others are kept
+/*
+	memory:  OUTPUT  -j Main            kernel:  OUTPUT  -j DOCKER
+	         Main    -o lo -j RETURN             Main
+	repair:  -I OUTPUT 1 -j Main
+	         -A Main -o lo -j RETURN
+*/
+func (m *Manager) Reconcile() ([]string, error) {
+	// chains in memory is not applied yet
+	if m.tx != nil {
+		return nil, nil
+	}
+	var names []string
+	for name := range m.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var drift []string
+	// each family is compared and repaired separately
+	for _, backend := range m.backends {
+		backendDrift, err := m.reconcileBackend(backend, names)
+		drift = append(drift, backendDrift...)
+		if err != nil {
+			return drift, err
+		}
+	}
+	return drift, nil
+}
+
+// compare and repair tables of backend
+func (m *Manager) reconcileBackend(backend Backend, names []string) ([]string, error) {
+	var cmds []Command
+	var drift []string
+	for _, name := range names {
+		table := m.tables[name]
+		if !table.hasRules() {
+			continue
+		}
+		data, err := backend.Save(name)
+		if err != nil {
+			return nil, err
+		}
+		tables, err := ParseSave(data)
+		if err != nil {
+			logger.Warningf("[%s] parse save failed, err: %v", name, err)
+			return nil, err
+		}
+		tableCmds, tableDrift := table.diff(tables[name])
+		cmds = append(cmds, tableCmds...)
+		for _, item := range tableDrift {
+			drift = append(drift, backend.Name()+" "+item)
+		}
+	}
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	logger.Warningf("[manager] %s drift detected: %v", backend.Name(), drift)
+	err := backend.Apply(cmds)
+	if err != nil {
+		logger.Warningf("[manager] %s repair drift failed, err: %v", backend.Name(), err)
+		return drift, err
+	}
+	m.record(cmds)
+	return drift, nil
+}
+
+// check if any rule is added to table
+func (t *Table) hasRules() bool {
+	for _, chain := range t.chains {
+		if len(chain.cplRuleSl) != 0 || chain.parent != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// commands to make kernel table contain chains and rules in memory
+func (t *Table) diff(kernel *Table) ([]Command, []string) {
+	var names []string
+	for name := range t.chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var cmds []Command
+	var drift []string
+	// create child chain first, so rule can jump to it
+	for _, name := range names {
+		chain := t.chains[name]
+		if chain.parent == nil || kernel.getKernelChain(name) != nil {
+			continue
+		}
+		cmds = append(cmds, Command{Operation: New, Table: t.Name, Chain: name})
+		drift = append(drift, fmt.Sprintf("[%s] chain %s is missing", t.Name, name))
+	}
+	for _, name := range names {
+		chain := t.chains[name]
+		var keys []string
+		if kernelChain := kernel.getKernelChain(name); kernelChain != nil {
+			for _, cpl := range kernelChain.cplRuleSl {
+				keys = append(keys, ruleKey(cpl))
+			}
+		}
+		// missing rule is inserted after the previous rule of memory
+		pos := 0
+		for _, cpl := range chain.cplRuleSl {
+			key := ruleKey(cpl)
+			if found := indexOf(keys, key); found >= 0 {
+				pos = found + 1
+				continue
+			}
+			cmd := Command{Operation: Append, Table: t.Name, Chain: name, Cpl: cpl}
+			if pos < len(keys) {
+				cmd.Operation = Insert
+				cmd.Index = pos + 1
+			}
+			cmds = append(cmds, cmd)
+			drift = append(drift, fmt.Sprintf("[%s] chain %s rule %s is missing", t.Name, name, cpl.String()))
+			keys = append(keys[:pos], append([]string{key}, keys[pos:]...)...)
+			pos++
+		}
+	}
+	return cmds, drift
+}
+
+// get chain of kernel table, nil if table or chain not exist
+func (t *Table) getKernelChain(name string) *Chain {
+	if t == nil {
+		return nil
+	}
+	return t.chains[name]
+}
+
+// index of key, -1 if not found
+func indexOf(keys []string, key string) int {
+	for index, value := range keys {
+		if value == key {
+			return index
+		}
+	}
+	return -1
+}
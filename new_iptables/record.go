@@ -0,0 +1,109 @@
+package NewIptables
+
+// recorder is called with commands applied to kernel, used to persist rules created
+type Recorder func(cmds []Command)
+
+// set recorder, nil to stop recording
+func (m *Manager) SetRecorder(recorder Recorder) {
+	m.recorder = recorder
+}
+
+// notify recorder of applied commands
+func (m *Manager) record(cmds []Command) {
+	if m.recorder == nil || len(cmds) == 0 {
+		return
+	}
+	m.recorder(cmds)
+}
+
+// update chains and rules alive in kernel with applied commands,
+// only New, Append and Insert commands is kept in live
+/*
+	live:  -N App, -A App -j MARK
+	cmds:  -F App, -X App
+	new:   (empty)
+*/
+func TrackCommands(live []Command, cmds []Command) []Command {
+	for _, cmd := range cmds {
+		switch cmd.Operation {
+		case New, Append, Insert:
+			// repaired rule is already alive
+			if indexOfLive(live, cmd) < 0 {
+				live = append(live, cmd)
+			}
+		case Delete:
+			if index := indexOfLive(live, cmd); index >= 0 {
+				live = append(live[:index:index], live[index+1:]...)
+			}
+		case Flush, Remove:
+			var temp []Command
+			for _, item := range live {
+				if item.Table == cmd.Table && item.Chain == cmd.Chain &&
+					(isRule(item) || cmd.Operation == Remove) {
+					continue
+				}
+				temp = append(temp, item)
+			}
+			live = temp
+		}
+	}
+	return live
+}
+
+// commands to remove live chains and rules, rules is deleted before chains
+func CleanCommands(live []Command) []Command {
+	var rules, chains []Command
+	for index := len(live) - 1; index >= 0; index-- {
+		item := live[index]
+		if isRule(item) {
+			rules = append(rules, Command{Operation: Delete, Table: item.Table, Chain: item.Chain, Cpl: item.Cpl})
+			continue
+		}
+		if item.Operation == New {
+			chains = append(chains,
+				Command{Operation: Flush, Table: item.Table, Chain: item.Chain},
+				Command{Operation: Remove, Table: item.Table, Chain: item.Chain})
+		}
+	}
+	return append(rules, chains...)
+}
+
+// run commands one by one on every backend, failed command is skipped, return count of failed
+func (m *Manager) Clean(cmds []Command) int {
+	failed := 0
+	for _, backend := range m.backends {
+		failed += cleanBackend(backend, cmds)
+	}
+	return failed
+}
+
+// run commands one by one on backend
+func cleanBackend(backend Backend, cmds []Command) int {
+	failed := 0
+	for _, cmd := range cmds {
+		err := backend.Run(cmd.Operation, cmd.Table, cmd.Chain, cmd.Index, cmd.Cpl)
+		if err != nil {
+			logger.Debugf("[%s] %s clean %s failed, err: %v", cmd.Table, backend.Name(), cmd.String(), err)
+			failed++
+		}
+	}
+	return failed
+}
+
+// index of live chain or rule created by cmd, -1 if not found
+func indexOfLive(live []Command, cmd Command) int {
+	for index, item := range live {
+		if item.Table != cmd.Table || item.Chain != cmd.Chain || isRule(item) != (cmd.Cpl != nil) {
+			continue
+		}
+		if cmd.Cpl == nil || item.Cpl.String() == cmd.Cpl.String() {
+			return index
+		}
+	}
+	return -1
+}
+
+// check if command add rule
+func isRule(cmd Command) bool {
+	return (cmd.Operation == Append || cmd.Operation == Insert) && cmd.Cpl != nil
+}
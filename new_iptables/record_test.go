@@ -0,0 +1,53 @@
+package NewIptables
+
+import (
+	"testing"
+)
+
+func TestTrackCommands(t *testing.T) {
+	backend := &fakeBackend{}
+	manager := NewManagerWithBackend(backend)
+	var live []Command
+	manager.SetRecorder(func(cmds []Command) {
+		live = TrackCommands(live, cmds)
+	})
+	manager.Init()
+	output := manager.GetChain("mangle", "OUTPUT")
+	prerouting := manager.GetChain("mangle", "PREROUTING")
+	tproxy := &CompleteRule{Action: TPROXY, BaseSl: []BaseRule{{Match: "-on-port", Param: "8090"}}}
+
+	main, _ := output.CreateChild("Main", 0, &CompleteRule{Action: "Main"})
+	tx, _ := manager.Begin()
+	app, _ := main.CreateChild("App", 0, &CompleteRule{Action: "App"})
+	_ = app.AppendRule(&CompleteRule{Action: MARK, BaseSl: []BaseRule{{Match: "-set-mark", Param: "8090"}}})
+	_ = prerouting.AppendRule(tproxy)
+	_ = tx.Commit()
+	if len(live) != 6 {
+		t.Fatalf("live is %v", live)
+	}
+
+	// repaired rule is not recorded twice
+	manager.record([]Command{{Operation: Append, Table: "mangle", Chain: "PREROUTING", Cpl: tproxy}})
+	if len(live) != 6 {
+		t.Errorf("live is %v after repair", live)
+	}
+
+	// app is stopped
+	_ = app.Remove()
+	_ = prerouting.DelRule(tproxy)
+	if len(live) != 2 {
+		t.Fatalf("live is %v after app removed", live)
+	}
+
+	// crash, clean main left
+	want := []string{"-D OUTPUT -j Main", "-F Main", "-X Main"}
+	clean := CleanCommands(live)
+	if len(clean) != len(want) {
+		t.Fatalf("clean commands is %v", clean)
+	}
+	for index, cmd := range clean {
+		if cmd.String() != want[index] {
+			t.Errorf("clean command %d is %s, want %s", index, cmd.String(), want[index])
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package NewIptables
 
-import "strings"
+import (
+	"strconv"
+	"strings"
+)
 
 // define operation
 type Operation int
@@ -56,13 +59,17 @@ type BaseRule struct {
 
 // make string  -s 1111.2222.3333.4444
 func (bs *BaseRule) String() string {
+	return strings.Join(bs.Args(), " ")
+}
+
+// make args  [-s 1111.2222.3333.4444]
+func (bs *BaseRule) Args() []string {
 	var sl []string
 	// if mark as false
 	if bs.Not {
 		sl = append(sl, "!")
 	}
-	sl = append(sl, "-"+bs.Match, bs.Param)
-	return strings.Join(sl, " ")
+	return append(sl, "-"+bs.Match, bs.Param)
 }
 
 // extends elem
@@ -73,12 +80,16 @@ type ExtendsElem struct {
 
 // make string    mark --mark 1
 func (elem *ExtendsElem) String() string {
+	return strings.Join(elem.Args(), " ")
+}
+
+// make args    [mark --mark 1]
+func (elem *ExtendsElem) Args() []string {
 	sl := []string{elem.Match}
 	if elem.Base.Not {
 		sl = append(sl, "!")
 	}
-	sl = append(sl, "--"+elem.Base.Match, elem.Base.Param)
-	return strings.Join(sl, " ")
+	return append(sl, "--"+elem.Base.Match, elem.Base.Param)
 }
 
 // extends rule
@@ -89,8 +100,12 @@ type ExtendsRule struct {
 
 // make string   -m mark --mark 1
 func (ex *ExtendsRule) String() string {
-	sl := []string{"-" + ex.Match, ex.Elem.String()}
-	return strings.Join(sl, " ")
+	return strings.Join(ex.Args(), " ")
+}
+
+// make args   [-m mark --mark 1]
+func (ex *ExtendsRule) Args() []string {
+	return append([]string{"-" + ex.Match}, ex.Elem.Args()...)
 }
 
 // one complete rule
@@ -98,9 +113,10 @@ type CompleteRule struct {
 	Action    string
 	BaseSl    []BaseRule
 	ExtendsSl []ExtendsRule
+	Comment   string // -m comment --comment, usually owner tag
 }
 
-// make string        -j ACCEPT -s 1111.2222.3333.4444 -m mark --mark 1
+// make string        -j ACCEPT -s 1111.2222.3333.4444 -m mark --mark 1 -m comment --comment "tag"
 func (cpl *CompleteRule) String() string {
 	// action
 	sl := []string{"-j", cpl.Action}
@@ -112,5 +128,24 @@ func (cpl *CompleteRule) String() string {
 	for _, extends := range cpl.ExtendsSl {
 		sl = append(sl, extends.String())
 	}
+	// comment is quoted as iptables-save
+	if cpl.Comment != "" {
+		sl = append(sl, "-m comment --comment", strconv.Quote(cpl.Comment))
+	}
 	return strings.Join(sl, " ")
 }
+
+// make args, comment is one arg without quote, used to run command without shell
+func (cpl *CompleteRule) Args() []string {
+	sl := []string{"-j", cpl.Action}
+	for _, base := range cpl.BaseSl {
+		sl = append(sl, base.Args()...)
+	}
+	for _, extends := range cpl.ExtendsSl {
+		sl = append(sl, extends.Args()...)
+	}
+	if cpl.Comment != "" {
+		sl = append(sl, "-m", "comment", "--comment", cpl.Comment)
+	}
+	return sl
+}
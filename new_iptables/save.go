@@ -0,0 +1,256 @@
+package NewIptables
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parse iptables-save output to tables, child is attached to parent by jump rule
+/*
+	*mangle
+	:OUTPUT ACCEPT [0:0]
+	:Main - [0:0]
+	-A OUTPUT -j Main
+	-A Main -o lo -j RETURN
+	COMMIT
+*/
+func ParseSave(data string) (map[string]*Table, error) {
+	tables := make(map[string]*Table)
+	var table *Table
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case text == "" || strings.HasPrefix(text, "#"):
+		case strings.HasPrefix(text, "*"):
+			table = &Table{
+				Name:   text[1:],
+				chains: make(map[string]*Chain),
+			}
+			tables[table.Name] = table
+		case table == nil:
+			return nil, fmt.Errorf("line %d is out of table", line)
+		case text == "COMMIT":
+			table.attachChildren()
+			table = nil
+		case strings.HasPrefix(text, ":"):
+			// :Main - [0:0]
+			fields := strings.Fields(text[1:])
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("line %d has no chain name", line)
+			}
+			table.chains[fields[0]] = &Chain{
+				Name:      fields[0],
+				table:     table,
+				children:  make(map[string]*Chain),
+				cplRuleSl: []*CompleteRule{},
+			}
+		case strings.HasPrefix(text, "-A "):
+			args, err := splitArgs(text)
+			if err != nil || len(args) < 2 {
+				return nil, fmt.Errorf("line %d is invalid, err: %v", line, err)
+			}
+			chain, ok := table.chains[args[1]]
+			if !ok {
+				return nil, fmt.Errorf("line %d chain %s is not declared", line, args[1])
+			}
+			cpl, err := parseRule(args[2:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d is invalid, err: %v", line, err)
+			}
+			chain.cplRuleSl = append(chain.cplRuleSl, cpl)
+		default:
+			return nil, fmt.Errorf("line %d is not support: %s", line, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if table != nil {
+		return nil, fmt.Errorf("table %s is not committed", table.Name)
+	}
+	return tables, nil
+}
+
+// attach user chain to the chain which jump to it
+func (t *Table) attachChildren() {
+	for _, chain := range t.chains {
+		for _, cpl := range chain.cplRuleSl {
+			child, ok := t.chains[cpl.Action]
+			if !ok || child == chain || child.parent != nil {
+				continue
+			}
+			child.setParent(chain)
+			chain.children[child.Name] = child
+		}
+	}
+}
+
+// parse rule arguments, option after -j belongs to target
+/*
+	-p tcp -m cgroup ! --path App.slice -j App
+	action: App  base: -p tcp  extends: -m cgroup ! --path App.slice
+*/
+func parseRule(args []string) (*CompleteRule, error) {
+	cpl := &CompleteRule{}
+	var not, target bool
+	var module string
+	for index := 0; index < len(args); index++ {
+		arg := args[index]
+		if arg == "!" {
+			not = true
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") {
+			return nil, fmt.Errorf("unexpected argument %s", arg)
+		}
+		var param string
+		if index+1 < len(args) && args[index+1] != "!" && !strings.HasPrefix(args[index+1], "-") {
+			index++
+			param = args[index]
+		}
+		switch {
+		case arg == "-j":
+			cpl.Action = param
+			target = true
+		case arg == "-m":
+			// match after target
+			module = param
+			target = false
+		case arg == "--comment" && module == "comment":
+			cpl.Comment = param
+		case strings.HasPrefix(arg, "--") && !target && module != "":
+			// -m mark --mark 1
+			cpl.ExtendsSl = append(cpl.ExtendsSl, ExtendsRule{
+				Match: "m",
+				Elem: ExtendsElem{
+					Match: module,
+					Base:  BaseRule{Not: not, Match: arg[2:], Param: param},
+				},
+			})
+		default:
+			// -p tcp or --set-mark 1
+			cpl.BaseSl = append(cpl.BaseSl, BaseRule{Not: not, Match: arg[1:], Param: param})
+			// protocol match is implicit module
+			if arg == "-p" && module == "" {
+				module = param
+			}
+		}
+		not = false
+	}
+	if cpl.Action == "" {
+		return nil, fmt.Errorf("rule has no target")
+	}
+	return cpl, nil
+}
+
+// parse rule string made by CompleteRule.String
+func parseRuleString(rule string) (*CompleteRule, error) {
+	args, err := splitArgs(rule)
+	if err != nil {
+		return nil, err
+	}
+	return parseRule(args)
+}
+
+// split arguments, double quoted argument may contain space
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var buf strings.Builder
+	var quoted, escaped, inArg bool
+	for _, char := range line {
+		switch {
+		case escaped:
+			buf.WriteRune(char)
+			escaped = false
+		case char == '\\' && quoted:
+			escaped = true
+		case char == '"':
+			quoted = !quoted
+			inArg = true
+		case (char == ' ' || char == '\t') && !quoted:
+			if inArg {
+				args = append(args, buf.String())
+				buf.Reset()
+				inArg = false
+			}
+		default:
+			buf.WriteRune(char)
+			inArg = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("quote is not closed")
+	}
+	if inArg {
+		args = append(args, buf.String())
+	}
+	return args, nil
+}
+
+// normalized key of rule, rules have the same key if they are the same in kernel,
+// module name and default target option is ignored, mark is hex as iptables-save
+/*
+	-j MARK --set-mark 8080            --set-xmark 0x1f90 -j MARK
+	-j MARK --set-xmark 0x1f90/0xffffffff
+*/
+func ruleKey(cpl *CompleteRule) string {
+	args, err := splitArgs(cpl.String())
+	if err != nil {
+		return cpl.String()
+	}
+	var items []string
+	not := ""
+	for index := 0; index < len(args); index++ {
+		arg := args[index]
+		if arg == "!" {
+			not = "! "
+			continue
+		}
+		var param string
+		if index+1 < len(args) && args[index+1] != "!" && !strings.HasPrefix(args[index+1], "-") {
+			index++
+			param = args[index]
+		}
+		switch arg {
+		case "-m":
+			continue
+		case "--set-mark", "--set-xmark":
+			arg = "--set-xmark"
+			param = normalizeMark(param)
+		case "--mark":
+			param = normalizeMark(param)
+		case "--on-ip":
+			if param == "0.0.0.0" || param == "::" {
+				continue
+			}
+		case "--tproxy-mark":
+			if param == "0x0/0x0" {
+				continue
+			}
+		}
+		items = append(items, not+arg+" "+param)
+		not = ""
+	}
+	sort.Strings(items)
+	return strings.Join(items, " ")
+}
+
+// mark as hex, full mask is omitted
+func normalizeMark(value string) string {
+	mark, mask := value, ""
+	if index := strings.Index(value, "/"); index >= 0 {
+		mark, mask = value[:index], value[index:]
+	}
+	num, err := strconv.ParseUint(mark, 0, 32)
+	if err != nil {
+		return value
+	}
+	if mask == "/0xffffffff" {
+		mask = ""
+	}
+	return fmt.Sprintf("0x%x%s", num, mask)
+}
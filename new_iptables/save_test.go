@@ -0,0 +1,184 @@
+package NewIptables
+
+import (
+	"strings"
+	"testing"
+)
+
+// iptables-save output after app proxy started and docker rule added
+const testSave = `# Generated by iptables-save v1.8.7 on Sun Oct 18 10:00:00 2026
+*mangle
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:Main - [0:0]
+:App - [0:0]
+-A PREROUTING -p tcp -m mark --mark 0x1f90 -j TPROXY --on-port 8080 --on-ip 0.0.0.0 --tproxy-mark 0x0/0x0
+-A OUTPUT -m comment --comment "docker rule" -j RETURN
+-A OUTPUT -j Main
+-A Main -o lo -j RETURN
+-A Main -p tcp -m cgroup --path App.slice -j App
+COMMIT
+# Completed on Sun Oct 18 10:00:00 2026
+`
+
+func TestParseSave(t *testing.T) {
+	tables, err := ParseSave(testSave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mangle, ok := tables["mangle"]
+	if !ok {
+		t.Fatal("mangle table not found")
+	}
+	output := mangle.chains["OUTPUT"]
+	if output.GetRulesCount() != 2 || output.GetRuleByIndex(0).Comment != "docker rule" {
+		t.Errorf("output rules is %v", output.cplRuleSl)
+	}
+	app := mangle.chains["App"]
+	if app.parent != mangle.chains["Main"] || mangle.chains["Main"].parent != output {
+		t.Error("child should be attached to parent")
+	}
+	// rules created by proxy are the same as saved rules
+	rules := []struct {
+		chain string
+		cpl   *CompleteRule
+	}{
+		{"Main", &CompleteRule{Action: "App",
+			BaseSl: []BaseRule{{Match: "p", Param: "tcp"}},
+			ExtendsSl: []ExtendsRule{{Match: "m",
+				Elem: ExtendsElem{Match: "cgroup", Base: BaseRule{Match: "path", Param: "App.slice"}}}}}},
+		{"PREROUTING", &CompleteRule{Action: TPROXY,
+			ExtendsSl: []ExtendsRule{
+				{Match: "p", Elem: ExtendsElem{Match: "tcp", Base: BaseRule{Match: "on-port", Param: "8080"}}},
+				{Match: "m", Elem: ExtendsElem{Match: "mark", Base: BaseRule{Match: "mark", Param: "8080"}}}}}},
+	}
+	for _, rule := range rules {
+		chain := mangle.chains[rule.chain]
+		if ruleKey(rule.cpl) != ruleKey(chain.GetRuleByIndex(chain.GetRulesCount()-1)) {
+			t.Errorf("key of %s is %s, want %s", rule.cpl.String(), ruleKey(rule.cpl), ruleKey(chain.GetRuleByIndex(0)))
+		}
+	}
+	mark := &CompleteRule{Action: MARK, BaseSl: []BaseRule{{Match: "-set-mark", Param: "8080"}}}
+	saved, _ := parseRule([]string{"-j", "MARK", "--set-xmark", "0x1f90/0xffffffff"})
+	if ruleKey(mark) != ruleKey(saved) {
+		t.Errorf("key of mark is %s, want %s", ruleKey(mark), ruleKey(saved))
+	}
+
+	// invalid save
+	if _, err = ParseSave("*mangle\n-A Main -j RETURN\nCOMMIT\n"); err == nil {
+		t.Error("rule of undeclared chain should fail")
+	}
+	if _, err = ParseSave("*mangle\n:Main - [0:0]\n"); err == nil {
+		t.Error("table without commit should fail")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	backend := &fakeBackend{}
+	manager := NewManagerWithBackend(backend)
+	manager.Init()
+	output := manager.GetChain("mangle", "OUTPUT")
+	main, _ := output.CreateChild("Main", 0, &CompleteRule{Action: "Main"})
+	_ = main.AppendRule(&CompleteRule{Action: RETURN, BaseSl: []BaseRule{{Match: "o", Param: "lo"}}})
+	_ = main.AppendRule(&CompleteRule{Action: MARK, BaseSl: []BaseRule{{Match: "-set-mark", Param: "8080"}}})
+	backend.cmds = nil
+
+	// nothing changed
+	backend.saved = map[string]string{
+		"mangle": "*mangle\n:OUTPUT ACCEPT [0:0]\n:Main - [0:0]\n-A OUTPUT -j Main\n" +
+			"-A Main -o lo -j RETURN\n-A Main -j MARK --set-xmark 0x1f90/0xffffffff\nCOMMIT\n",
+	}
+	drift, err := manager.Reconcile()
+	if err != nil || len(drift) != 0 || len(backend.cmds) != 0 {
+		t.Errorf("drift is %v, commands is %v, err: %v", drift, backend.cmds, err)
+	}
+
+	// chain is flushed and other tool insert rule
+	backend.saved = map[string]string{
+		"mangle": "*mangle\n:OUTPUT ACCEPT [0:0]\n:Main - [0:0]\n-A OUTPUT -j DOCKER\n-A OUTPUT -j Main\nCOMMIT\n",
+	}
+	drift, err = manager.Reconcile()
+	if err != nil || len(drift) != 2 {
+		t.Fatalf("drift is %v, err: %v", drift, err)
+	}
+	if len(backend.cmds) != 2 || backend.cmds[0].String() != "-A Main -j RETURN -o lo" {
+		t.Errorf("repair commands is %v", backend.cmds)
+	}
+
+	// everything is removed
+	backend.cmds = nil
+	backend.saved = nil
+	drift, _ = manager.Reconcile()
+	want := []string{"-N Main", "-A Main -j RETURN -o lo", "-A Main -j MARK --set-mark 8080", "-A OUTPUT -j Main"}
+	if len(drift) != 4 || len(backend.cmds) != len(want) {
+		t.Fatalf("drift is %v, commands is %v", drift, backend.cmds)
+	}
+	for index, cmd := range backend.cmds {
+		if cmd.String() != want[index] {
+			t.Errorf("repair command %d is %s, want %s", index, cmd.String(), want[index])
+		}
+	}
+}
+
+func TestCleanOwner(t *testing.T) {
+	tag := OwnerTag("3f2a9c1e", "App")
+	if instance, scope, ok := ParseOwnerTag(tag); !ok || instance != "3f2a9c1e" || scope != "App" {
+		t.Errorf("parse owner tag %s failed", tag)
+	}
+	backend := &fakeBackend{
+		saved: map[string]string{
+			"mangle": "*mangle\n:PREROUTING ACCEPT [0:0]\n:OUTPUT ACCEPT [0:0]\n:Main - [0:0]\n:App - [0:0]\n" +
+				"-A PREROUTING -p tcp -m mark --mark 0x1f90 -m comment --comment \"" + tag + "\" -j TPROXY --on-port 8080\n" +
+				"-A OUTPUT -m comment --comment \"docker rule\" -j RETURN\n" +
+				"-A OUTPUT -m comment --comment \"deepin-network-proxy:3f2a9c1e:Main\" -j Main\n" +
+				"-A Main -p tcp -m cgroup --path App.slice -m comment --comment \"" + tag + "\" -j App\n" +
+				"-A App -m comment --comment \"" + tag + "\" -j MARK --set-xmark 0x1f90/0xffffffff\n" +
+				"COMMIT\n",
+		},
+	}
+	manager := NewManagerWithBackend(backend)
+	manager.Init()
+	if failed := manager.CleanOwner("3f2a9c1e"); failed != 0 {
+		t.Errorf("%d clean commands failed", failed)
+	}
+	want := []string{
+		`-D App -j MARK --set-xmark 0x1f90/0xffffffff -m comment --comment "` + tag + `"`,
+		`-D Main -j App -p tcp -m cgroup --path App.slice -m comment --comment "` + tag + `"`,
+		`-D OUTPUT -j Main -m comment --comment "deepin-network-proxy:3f2a9c1e:Main"`,
+		`-D PREROUTING -j TPROXY -p tcp --on-port 8080 -m mark --mark 0x1f90 -m comment --comment "` + tag + `"`,
+		"-F App", "-X App", "-F Main", "-X Main",
+	}
+	if len(backend.cmds) != len(want) {
+		t.Fatalf("clean commands is %v", backend.cmds)
+	}
+	for index, cmd := range backend.cmds {
+		if cmd.String() != want[index] {
+			t.Errorf("clean command %d is %s, want %s", index, cmd.String(), want[index])
+		}
+	}
+
+	// other instance is kept
+	backend.cmds = nil
+	manager.CleanOwner("00000000")
+	if len(backend.cmds) != 0 {
+		t.Errorf("rules of other instance should be kept, commands is %v", backend.cmds)
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	cmd := Command{Operation: Insert, Table: "mangle", Chain: "Main", Index: 1, Cpl: &CompleteRule{
+		Action:    RETURN,
+		BaseSl:    []BaseRule{{Not: true, Match: "o", Param: "lo"}},
+		ExtendsSl: []ExtendsRule{{Match: "m", Elem: ExtendsElem{Match: "cgroup", Base: BaseRule{Match: "path", Param: "main.slice"}}}},
+		Comment:   "owner tag",
+	}}
+	// comment is one arg without quote
+	want := []string{"-I", "Main", "1", "-j", "RETURN", "!", "-o", "lo", "-m", "cgroup", "--path", "main.slice", "-m", "comment", "--comment", "owner tag"}
+	args := cmd.Args()
+	if strings.Join(args, "|") != strings.Join(want, "|") {
+		t.Errorf("args is %q, want %q", args, want)
+	}
+	if str := cmd.String(); str != `-I Main 1 -j RETURN ! -o lo -m cgroup --path main.slice -m comment --comment "owner tag"` {
+		t.Errorf("string is %s", str)
+	}
+}
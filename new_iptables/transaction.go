@@ -0,0 +1,107 @@
+package NewIptables
+
+import "errors"
+
+// transaction collect operations of all tables and apply them at once,
+// chains and rules in memory are restored when failed
+/*
+	tx, _ := manager.Begin()
+	child, _ := chain.CreateChild(...)    // recorded, not run
+	_ = child.AppendRule(...)             // recorded, not run
+	err := tx.Commit()                    // apply all by backend
+*/
+type Transaction struct {
+	manager *Manager
+	cmds    []Command
+	done    bool
+
+	// snapshot when begin
+	chains map[*Table]map[string]*Chain
+	rules  map[*Chain][]*CompleteRule
+	child  map[*Chain]map[string]*Chain
+}
+
+// begin transaction, only one transaction at the same time
+func (m *Manager) Begin() (*Transaction, error) {
+	if m.tx != nil {
+		return nil, errors.New("transaction already begin")
+	}
+	tx := &Transaction{
+		manager: m,
+		chains:  make(map[*Table]map[string]*Chain),
+		rules:   make(map[*Chain][]*CompleteRule),
+		child:   make(map[*Chain]map[string]*Chain),
+	}
+	for _, table := range m.tables {
+		chains := make(map[string]*Chain)
+		for name, chain := range table.chains {
+			chains[name] = chain
+			tx.rules[chain] = append([]*CompleteRule{}, chain.cplRuleSl...)
+			children := make(map[string]*Chain)
+			for childName, child := range chain.children {
+				children[childName] = child
+			}
+			tx.child[chain] = children
+		}
+		tx.chains[table] = chains
+		table.tx = tx
+	}
+	m.tx = tx
+	logger.Debug("[manager] begin transaction")
+	return tx, nil
+}
+
+// record command
+func (tx *Transaction) add(cmd Command) {
+	tx.cmds = append(tx.cmds, cmd)
+}
+
+// stop recording
+func (tx *Transaction) finish() {
+	tx.done = true
+	for _, table := range tx.manager.tables {
+		table.tx = nil
+	}
+	tx.manager.tx = nil
+}
+
+// restore chains and rules in memory
+func (tx *Transaction) restore() {
+	for table, chains := range tx.chains {
+		table.chains = chains
+		for _, chain := range chains {
+			chain.cplRuleSl = tx.rules[chain]
+			chain.children = tx.child[chain]
+		}
+	}
+}
+
+// apply all commands, nothing is changed when failed
+func (tx *Transaction) Commit() error {
+	if tx.done {
+		return errors.New("transaction already finished")
+	}
+	tx.finish()
+	if len(tx.cmds) == 0 {
+		return nil
+	}
+	err := tx.manager.apply(tx.cmds)
+	if err != nil {
+		logger.Warningf("[manager] commit %d commands failed, err: %v", len(tx.cmds), err)
+		tx.restore()
+		return err
+	}
+	tx.manager.record(tx.cmds)
+	logger.Debugf("[manager] commit %d commands success", len(tx.cmds))
+	return nil
+}
+
+// discard all commands, do nothing if already finished
+func (tx *Transaction) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.finish()
+	tx.restore()
+	logger.Debugf("[manager] rollback %d commands", len(tx.cmds))
+}
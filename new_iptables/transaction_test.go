@@ -0,0 +1,150 @@
+package NewIptables
+
+import (
+	"errors"
+	"testing"
+)
+
+// backend record applied commands
+type fakeBackend struct {
+	cmds  []Command
+	err   error
+	saved map[string]string // [table] -> iptables-save output
+}
+
+func (b *fakeBackend) Name() string {
+	return "fake"
+}
+
+func (b *fakeBackend) Init() error {
+	return nil
+}
+
+func (b *fakeBackend) Run(operation Operation, table string, chain string, index int, cpl *CompleteRule) error {
+	return b.Apply([]Command{{Operation: operation, Table: table, Chain: chain, Index: index, Cpl: cpl}})
+}
+
+func (b *fakeBackend) Apply(cmds []Command) error {
+	if b.err != nil {
+		return b.err
+	}
+	b.cmds = append(b.cmds, cmds...)
+	return nil
+}
+
+func (b *fakeBackend) Save(table string) (string, error) {
+	if data, ok := b.saved[table]; ok {
+		return data, nil
+	}
+	return "*" + table + "\nCOMMIT\n", nil
+}
+
+func TestTransaction(t *testing.T) {
+	backend := &fakeBackend{}
+	manager := NewManagerWithBackend(backend)
+	manager.Init()
+	output := manager.GetChain("mangle", "OUTPUT")
+	mark := &CompleteRule{Action: MARK, BaseSl: []BaseRule{{Match: "-set-mark", Param: "8080"}}}
+
+	// failed commit change nothing
+	backend.err = errors.New("apply failed")
+	tx, err := manager.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = manager.Begin(); err == nil {
+		t.Error("only one transaction at the same time")
+	}
+	child, err := output.CreateChild("App", 0, &CompleteRule{Action: "App"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = child.AppendRule(mark)
+	if len(backend.cmds) != 0 {
+		t.Fatal("command should not run before commit")
+	}
+	if err = tx.Commit(); err == nil {
+		t.Fatal("commit should fail")
+	}
+	if output.GetRulesCount() != 0 || output.GetChildrenCount() != 0 || manager.GetChain("mangle", "App") != nil {
+		t.Error("chains should be restored after failed commit")
+	}
+
+	// commit apply all at once
+	backend.err = nil
+	tx, _ = manager.Begin()
+	child, _ = output.CreateChild("App", 0, &CompleteRule{Action: "App"})
+	_ = child.AppendRule(mark)
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	if output.GetRulesCount() != 1 || child.GetRulesCount() != 1 {
+		t.Error("chains should be kept after commit")
+	}
+	want := "*mangle\n:App - [0:0]\n-I OUTPUT 1 -j App\n-A App -j MARK --set-mark 8080\nCOMMIT\n"
+	if input := restoreInput("mangle", backend.cmds); input != want {
+		t.Errorf("restore input is %q, want %q", input, want)
+	}
+	undo := inverseCommands(backend.cmds)
+	if len(undo) != 3 || undo[0].String() != "-D App -j MARK --set-mark 8080" || undo[2].String() != "-X App" {
+		t.Errorf("undo commands is %v", undo)
+	}
+
+	// rollback discard commands
+	tx, _ = manager.Begin()
+	_ = child.Remove()
+	tx.Rollback()
+	if len(backend.cmds) != 3 || output.GetChildrenCount() != 1 || child.GetRulesCount() != 1 {
+		t.Error("rollback should discard commands")
+	}
+}
+
+func TestManagerFamilies(t *testing.T) {
+	backend4, backend6 := &fakeBackend{}, &fakeBackend{}
+	manager := NewManagerWithBackend(backend4, backend6)
+	manager.Init()
+	output := manager.GetChain("mangle", "OUTPUT")
+
+	// the same chains is applied to each family
+	tx, _ := manager.Begin()
+	_, _ = output.CreateChild("Main", 0, &CompleteRule{Action: "Main"})
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend4.cmds) != 2 || len(backend6.cmds) != 2 {
+		t.Fatalf("commands is %v and %v", backend4.cmds, backend6.cmds)
+	}
+
+	// ipv4 is undone when ipv6 failed
+	backend6.err = errors.New("ip6tables failed")
+	mark := &CompleteRule{Action: MARK, BaseSl: []BaseRule{{Match: "-set-mark", Param: "8080"}}}
+	if err := output.AppendRule(mark); err == nil {
+		t.Fatal("append should fail")
+	}
+	if len(backend4.cmds) != 4 || backend4.cmds[3].String() != "-D OUTPUT -j MARK --set-mark 8080" {
+		t.Errorf("ipv4 commands is %v", backend4.cmds)
+	}
+}
+
+func TestRemoveChildJumpedTwice(t *testing.T) {
+	backend := &fakeBackend{}
+	manager := NewManagerWithBackend(backend)
+	manager.Init()
+	output := manager.GetChain("mangle", "OUTPUT")
+	tcp := &CompleteRule{Action: "App", BaseSl: []BaseRule{{Match: "p", Param: "tcp"}}}
+	udp := &CompleteRule{Action: "App", BaseSl: []BaseRule{{Match: "p", Param: "udp"}}}
+	child, err := output.CreateChild("App", 0, tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = output.InsertRule(1, udp); err != nil {
+		t.Fatal(err)
+	}
+	if err = child.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if output.GetRulesCount() != 0 || output.GetChildrenCount() != 0 {
+		t.Errorf("jump rules is left, commands is %v", backend.cmds)
+	}
+}
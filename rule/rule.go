@@ -0,0 +1,255 @@
+package Rule
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// rule type
+/*
+	rule line is [type],[payload],[action], MATCH has no payload
+	DOMAIN,www.google.com,sock5/sock5_1
+	DOMAIN-SUFFIX,baidu.com,DIRECT
+	DOMAIN-KEYWORD,ads,REJECT
+	IP-CIDR,10.0.0.0/8,DIRECT
+	DST-PORT,8000-9000,group/group_1
+	PROCESS,/usr/bin/wget,http/http_1
+	MATCH,DIRECT
+*/
+type RuleTyp string
+
+const (
+	Domain        RuleTyp = "DOMAIN"
+	DomainSuffix  RuleTyp = "DOMAIN-SUFFIX"
+	DomainKeyword RuleTyp = "DOMAIN-KEYWORD"
+	IpCidr        RuleTyp = "IP-CIDR"
+	DstPort       RuleTyp = "DST-PORT"
+	Process       RuleTyp = "PROCESS"
+	Match         RuleTyp = "MATCH"
+)
+
+// action type
+type ActionTyp int
+
+const (
+	ActionDirect ActionTyp = iota // connect remote directly
+	ActionReject                  // close connection
+	ActionProxy                   // use named proxy or group
+)
+
+func (a ActionTyp) String() string {
+	switch a {
+	case ActionDirect:
+		return "DIRECT"
+	case ActionReject:
+		return "REJECT"
+	case ActionProxy:
+		return "PROXY"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// rule action, target is [proto]/[name] when action is proxy
+type Action struct {
+	Typ    ActionTyp
+	Target string
+}
+
+func (a Action) String() string {
+	if a.Typ == ActionProxy {
+		return a.Target
+	}
+	return a.Typ.String()
+}
+
+// parse action from DIRECT REJECT or [proto]/[name]
+func ParseAction(str string) (Action, error) {
+	switch str {
+	case "DIRECT":
+		return Action{Typ: ActionDirect}, nil
+	case "REJECT":
+		return Action{Typ: ActionReject}, nil
+	}
+	if !strings.Contains(str, "/") {
+		return Action{}, fmt.Errorf("action [%s] is invalid", str)
+	}
+	return Action{Typ: ActionProxy, Target: str}, nil
+}
+
+// connection message to match rule
+type Metadata struct {
+	Network string
+	Domain  string // domain of fake ip, empty if not found
+	IP      net.IP // remote ip
+	Port    int    // remote port
+	Process string // source executable path, only filled when engine need
+}
+
+// one rule
+type rule struct {
+	typ     RuleTyp
+	payload string
+	cidr    *net.IPNet
+	portMin int
+	portMax int
+	action  Action
+}
+
+// create rule from line
+func parseRule(line string) (*rule, error) {
+	lineSl := strings.Split(line, ",")
+	for index := range lineSl {
+		lineSl[index] = strings.TrimSpace(lineSl[index])
+	}
+	// match has no payload
+	if RuleTyp(lineSl[0]) == Match {
+		if len(lineSl) != 2 {
+			return nil, fmt.Errorf("rule [%s] is invalid", line)
+		}
+		action, err := ParseAction(lineSl[1])
+		if err != nil {
+			return nil, err
+		}
+		return &rule{typ: Match, action: action}, nil
+	}
+	if len(lineSl) != 3 {
+		return nil, fmt.Errorf("rule [%s] is invalid", line)
+	}
+	action, err := ParseAction(lineSl[2])
+	if err != nil {
+		return nil, err
+	}
+	r := &rule{
+		typ:     RuleTyp(lineSl[0]),
+		payload: lineSl[1],
+		action:  action,
+	}
+	switch r.typ {
+	case Domain, DomainSuffix, DomainKeyword:
+		r.payload = strings.ToLower(strings.TrimSuffix(r.payload, "."))
+	case IpCidr:
+		_, r.cidr, err = net.ParseCIDR(r.payload)
+		if err != nil {
+			return nil, err
+		}
+	case DstPort:
+		r.portMin, r.portMax, err = parsePortRange(r.payload)
+		if err != nil {
+			return nil, err
+		}
+	case Process:
+	default:
+		return nil, fmt.Errorf("rule type [%s] is not support", lineSl[0])
+	}
+	if r.payload == "" {
+		return nil, fmt.Errorf("rule [%s] has no payload", line)
+	}
+	return r, nil
+}
+
+// parse port or port range, 80 or 8000-9000
+func parsePortRange(str string) (int, int, error) {
+	rangeSl := strings.SplitN(str, "-", 2)
+	min, err := strconv.Atoi(rangeSl[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	max := min
+	if len(rangeSl) == 2 {
+		max, err = strconv.Atoi(rangeSl[1])
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if min < 0 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("port range [%s] is invalid", str)
+	}
+	return min, max, nil
+}
+
+// check if connection match rule
+func (r *rule) match(meta *Metadata) bool {
+	switch r.typ {
+	case Domain:
+		return meta.Domain != "" && strings.ToLower(meta.Domain) == r.payload
+	case DomainSuffix:
+		domain := strings.ToLower(meta.Domain)
+		return domain != "" && (domain == r.payload || strings.HasSuffix(domain, "."+r.payload))
+	case DomainKeyword:
+		return meta.Domain != "" && strings.Contains(strings.ToLower(meta.Domain), r.payload)
+	case IpCidr:
+		return meta.IP != nil && r.cidr.Contains(meta.IP)
+	case DstPort:
+		return meta.Port >= r.portMin && meta.Port <= r.portMax
+	case Process:
+		// full path or executable name
+		return meta.Process != "" && (meta.Process == r.payload || filepath.Base(meta.Process) == r.payload)
+	case Match:
+		return true
+	}
+	return false
+}
+
+// rule engine, rules are matched in order
+type Engine struct {
+	rules       []*rule
+	needProcess bool
+}
+
+// create engine from rule lines
+func NewEngine(lines []string) (*Engine, error) {
+	engine := &Engine{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		// ignore empty and comment
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, err
+		}
+		if r.typ == Process {
+			engine.needProcess = true
+		}
+		engine.rules = append(engine.rules, r)
+	}
+	if len(engine.rules) == 0 {
+		return nil, errors.New("rule engine has no rule")
+	}
+	return engine, nil
+}
+
+// if process is needed, find process is expensive
+func (engine *Engine) NeedProcess() bool {
+	return engine.needProcess
+}
+
+// match connection, return false if no rule matched
+func (engine *Engine) Match(meta *Metadata) (Action, bool) {
+	for _, r := range engine.rules {
+		if r.match(meta) {
+			return r.action, true
+		}
+	}
+	return Action{}, false
+}
+
+// all proxy targets used by rules
+func (engine *Engine) Targets() []string {
+	var targets []string
+	exist := make(map[string]bool)
+	for _, r := range engine.rules {
+		if r.action.Typ != ActionProxy || exist[r.action.Target] {
+			continue
+		}
+		exist[r.action.Target] = true
+		targets = append(targets, r.action.Target)
+	}
+	return targets
+}
@@ -0,0 +1,66 @@
+package Rule
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEngine_Match(t *testing.T) {
+	engine, err := NewEngine([]string{
+		"# comment line",
+		"DOMAIN,www.google.com,sock5/sock5_1",
+		"DOMAIN-SUFFIX,baidu.com,DIRECT",
+		"DOMAIN-KEYWORD,ads,REJECT",
+		"IP-CIDR,10.0.0.0/8,DIRECT",
+		"DST-PORT,8000-9000,group/group_1",
+		"PROCESS,wget,http/http_1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		meta    Metadata
+		action  string
+		matched bool
+	}{
+		{Metadata{Domain: "www.google.com", Port: 443}, "sock5/sock5_1", true},
+		{Metadata{Domain: "google.com", Port: 443}, "", false},
+		{Metadata{Domain: "map.Baidu.com", Port: 443}, "DIRECT", true},
+		{Metadata{Domain: "baidu.com", Port: 443}, "DIRECT", true},
+		{Metadata{Domain: "notbaidu.com", Port: 443}, "", false},
+		{Metadata{Domain: "cdn.ads.example", Port: 443}, "REJECT", true},
+		{Metadata{IP: net.ParseIP("10.1.2.3"), Port: 443}, "DIRECT", true},
+		{Metadata{IP: net.ParseIP("8.8.8.8"), Port: 8080}, "group/group_1", true},
+		{Metadata{IP: net.ParseIP("8.8.8.8"), Port: 443, Process: "/usr/bin/wget"}, "http/http_1", true},
+	}
+	for _, test := range tests {
+		action, matched := engine.Match(&test.meta)
+		if matched != test.matched || (matched && action.String() != test.action) {
+			t.Errorf("match %+v got %v %v, want %v %v", test.meta, action, matched, test.action, test.matched)
+		}
+	}
+	if !engine.NeedProcess() {
+		t.Error("engine should need process")
+	}
+	if targets := engine.Targets(); len(targets) != 3 {
+		t.Errorf("targets is %v, want 3 targets", targets)
+	}
+}
+
+func TestNewEngine(t *testing.T) {
+	invalid := [][]string{
+		{"DOMAIN,google.com"},
+		{"IP-CIDR,10.0.0.0,DIRECT"},
+		{"DST-PORT,9000-8000,DIRECT"},
+		{"GEOIP,CN,DIRECT"},
+		{"DOMAIN,google.com,PROXY"},
+		{"MATCH"},
+		{},
+	}
+	for _, lines := range invalid {
+		_, err := NewEngine(lines)
+		if err == nil {
+			t.Errorf("rules %v should be invalid", lines)
+		}
+	}
+}
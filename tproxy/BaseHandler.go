@@ -35,11 +35,18 @@ type BaseHandler interface {
 type ProtoTyp string
 
 const (
-	NoneProto ProtoTyp = "no-proto"
-	HTTP      ProtoTyp = "http"
-	SOCK4     ProtoTyp = "sock4"
-	SOCK5TCP  ProtoTyp = "sock5-tcp"
-	SOCK5UDP  ProtoTyp = "sock5-udp"
+	NoneProto      ProtoTyp = "no-proto"
+	HTTP           ProtoTyp = "http"
+	HTTPS          ProtoTyp = "https"
+	SOCK4          ProtoTyp = "sock4"
+	SOCK4A         ProtoTyp = "sock4a"
+	SOCK5TCP       ProtoTyp = "sock5-tcp"
+	SOCK5UDP       ProtoTyp = "sock5-udp"
+	SHADOWSOCKSTCP ProtoTyp = "shadowsocks-tcp"
+	SHADOWSOCKSUDP ProtoTyp = "shadowsocks-udp"
+	UOT            ProtoTyp = "udp-over-tcp"
+	CHAIN          ProtoTyp = "chain"
+	REJECT         ProtoTyp = "reject"
 )
 
 func BuildProto(proto string) (ProtoTyp, error) {
@@ -48,12 +55,26 @@ func BuildProto(proto string) (ProtoTyp, error) {
 		return NoneProto, nil
 	case "http":
 		return HTTP, nil
+	case "https":
+		return HTTPS, nil
 	case "sock4":
 		return SOCK4, nil
+	case "sock4a":
+		return SOCK4A, nil
 	case "sock5-tcp":
 		return SOCK5TCP, nil
 	case "sock5-udp":
 		return SOCK5UDP, nil
+	case "shadowsocks-tcp":
+		return SHADOWSOCKSTCP, nil
+	case "shadowsocks-udp":
+		return SHADOWSOCKSUDP, nil
+	case "udp-over-tcp":
+		return UOT, nil
+	case "chain":
+		return CHAIN, nil
+	case "reject":
+		return REJECT, nil
 	default:
 		return NoneProto, fmt.Errorf("scope is invalid, scope: %v", proto)
 	}
@@ -65,12 +86,26 @@ func (Typ ProtoTyp) String() string {
 		return "no-proxy"
 	case HTTP:
 		return "http"
+	case HTTPS:
+		return "https"
 	case SOCK4:
 		return "sock4"
+	case SOCK4A:
+		return "sock4a"
 	case SOCK5TCP:
 		return "sock5-tcp"
 	case SOCK5UDP:
 		return "sock5-udp"
+	case SHADOWSOCKSTCP:
+		return "shadowsocks-tcp"
+	case SHADOWSOCKSUDP:
+		return "shadowsocks-udp"
+	case UOT:
+		return "udp-over-tcp"
+	case CHAIN:
+		return "chain"
+	case REJECT:
+		return "reject"
 	default:
 		return "unknown-proto"
 	}
@@ -182,14 +217,30 @@ func (mgr *HandlerMgr) CloseAll() {
 func NewHandler(proto ProtoTyp, scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) BaseHandler {
 	// search proto
 	switch proto {
+	case NoneProto:
+		return NewDirectHandler(scope, key, proxy, lAddr, rAddr, lConn)
+	case REJECT:
+		return NewRejectHandler(scope, key, proxy, lAddr, rAddr, lConn)
 	case HTTP:
 		return NewHttpHandler(scope, key, proxy, lAddr, rAddr, lConn)
+	case HTTPS:
+		return NewHttpsHandler(scope, key, proxy, lAddr, rAddr, lConn)
 	case SOCK4:
 		return NewSock4Handler(scope, key, proxy, lAddr, rAddr, lConn)
+	case SOCK4A:
+		return NewSock4aHandler(scope, key, proxy, lAddr, rAddr, lConn)
 	case SOCK5TCP:
 		return NewTcpSock5Handler(scope, key, proxy, lAddr, rAddr, lConn)
 	case SOCK5UDP:
 		return NewUdpSock5Handler(scope, key, proxy, lAddr, rAddr, lConn)
+	case SHADOWSOCKSTCP:
+		return NewTcpShadowsocksHandler(scope, key, proxy, lAddr, rAddr, lConn)
+	case SHADOWSOCKSUDP:
+		return NewUdpShadowsocksHandler(scope, key, proxy, lAddr, rAddr, lConn)
+	case UOT:
+		return NewUdpOverTcpHandler(scope, key, proxy, lAddr, rAddr, lConn)
+	case CHAIN:
+		return NewChainHandler(scope, key, proxy, lAddr, rAddr, lConn)
 	default:
 		logger.Warningf("unknown proto type: %v", proto)
 	}
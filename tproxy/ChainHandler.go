@@ -0,0 +1,134 @@
+package TProxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
+)
+
+// chain handler, tunnel is created through hops in order
+// local -> hop1 -> hop2 -> ... -> remote
+type ChainHandler struct {
+	handlerPrv
+}
+
+func NewChainHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *ChainHandler {
+	// create new handler
+	handler := &ChainHandler{
+		handlerPrv: createHandlerPrv(CHAIN, scope, key, proxy, lAddr, rAddr, lConn),
+	}
+	// add self to private parent
+	handler.saveParent(handler)
+	return handler
+}
+
+// create tunnel between proxy and server
+func (handler *ChainHandler) Tunnel() error {
+	hops := handler.proxy.Chain
+	if len(hops) == 0 {
+		logger.Warningf("[%s] chain [%s] has no hop", handler.typ, handler.proxy.Name)
+		return errors.New("chain has no hop")
+	}
+	// dial first hop
+	first := proxyAddr(hops[0])
+	conn, err := net.DialTimeout("tcp", first.String(), 3*time.Second)
+	if err != nil {
+		logger.Warningf("[%s] failed to dial first hop [%s], err: %v", handler.typ, first.String(), err)
+		return err
+	}
+	handler.limitConn(conn)
+	// each hop connect to next hop, the last hop connect to remote
+	for index, hop := range hops {
+		var target net.Addr
+		if index == len(hops)-1 {
+			target = handler.rAddr
+		} else {
+			target = proxyAddr(hops[index+1])
+		}
+		hopAddr, err := hopTarget(hop, target)
+		if err != nil {
+			logger.Warningf("[%s] resolve target [%s] of hop [%s/%s] failed, err: %v",
+				handler.typ, target.String(), hop.ProtoType, hop.Name, err)
+			_ = conn.Close()
+			return err
+		}
+		conn, err = hopConnect(handler.typ, conn, hop, hopAddr)
+		if err != nil {
+			logger.Warningf("[%s] hop [%s/%s] connect to [%s] failed, err: %v",
+				handler.typ, hop.ProtoType, hop.Name, target.String(), err)
+			return err
+		}
+		logger.Debugf("[%s] hop [%s/%s] connect to [%s] success", handler.typ, hop.ProtoType, hop.Name, target.String())
+	}
+	logger.Debugf("[%s] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
+		handler.typ, handler.lAddr.String(), first.String(), handler.rAddr.String())
+	// save rConn handler
+	handler.rConn = conn
+	return nil
+}
+
+// run hop handshake on conn, conn is closed when failed
+func hopConnect(typ ProtoTyp, conn net.Conn, hop config.Proxy, target net.Addr) (net.Conn, error) {
+	var err error
+	switch hop.ProtoType {
+	case define.HTTP:
+		err = httpConnect(typ, conn, hop, target)
+	case define.HTTPS:
+		var tlsConn net.Conn
+		tlsConn, err = tlsClient(conn, hop)
+		if err == nil {
+			conn = tlsConn
+			err = httpConnect(typ, conn, hop, target)
+		}
+	case define.SOCK4:
+		err = sock4Connect(typ, conn, hop, target, false)
+	case define.SOCK4A:
+		err = sock4Connect(typ, conn, hop, target, true)
+	case define.SOCK5:
+		err = sock5Connect(typ, conn, hop, target)
+	case define.SHADOWSOCKS:
+		var ssConn net.Conn
+		ssConn, err = shadowsocksConnect(typ, conn, hop, target)
+		if err == nil {
+			conn = ssConn
+		}
+	default:
+		err = fmt.Errorf("hop proto [%s] is not support in chain", hop.ProtoType)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// sock4 hop cant send domain, resolve target to ipv4 locally
+func hopTarget(hop config.Proxy, target net.Addr) (net.Addr, error) {
+	domain, ok := target.(*com.DomainAddr)
+	if !ok || hop.ProtoType != define.SOCK4 {
+		return target, nil
+	}
+	return net.ResolveTCPAddr("tcp4", net.JoinHostPort(domain.Domain, strconv.Itoa(domain.Port)))
+}
+
+// get proxy server addr, domain server is kept as domain
+func proxyAddr(proxy config.Proxy) net.Addr {
+	port := proxy.Port
+	if port == 0 {
+		port = 80
+		if proxy.ProtoType == define.HTTPS {
+			port = 443
+		}
+	}
+	ip := net.ParseIP(proxy.Server)
+	if ip == nil {
+		return com.NewDomainAddr("tcp", proxy.Server, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
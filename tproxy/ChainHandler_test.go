@@ -0,0 +1,106 @@
+package TProxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
+)
+
+// sock4 proxy relay to dst ip of request, dst of request is sent to chan
+func startSock4Proxy(t *testing.T, dests chan<- string) net.Listener {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// vn cd port(2) ip(4) userid null
+				head := make([]byte, 8)
+				if _, err := io.ReadFull(conn, head); err != nil || head[0] != 4 || head[1] != 1 {
+					return
+				}
+				userId := make([]byte, 1)
+				for {
+					if _, err := io.ReadFull(conn, userId); err != nil {
+						return
+					}
+					if userId[0] == 0 {
+						break
+					}
+				}
+				dst := net.JoinHostPort(net.IP(head[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(head[2:4]))))
+				dests <- dst
+				rConn, err := net.Dial("tcp", dst)
+				if err != nil {
+					_, _ = conn.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer rConn.Close()
+				_, _ = conn.Write([]byte{0, 0x5a, 0, 0, 0, 0, 0, 0})
+				go func() { _, _ = io.Copy(rConn, conn) }()
+				_, _ = io.Copy(conn, rConn)
+			}()
+		}
+	}()
+	return listen
+}
+
+func TestChainHandler(t *testing.T) {
+	// sock4 -> http -> remote, http hop is addressed by host name
+	dests := make(chan string, 1)
+	sock4 := startSock4Proxy(t, dests)
+	defer sock4.Close()
+	requests := make(chan *http.Request, 1)
+	httpProxy := httptest.NewServer(connectEcho(requests))
+	defer httpProxy.Close()
+
+	sock4Addr := sock4.Addr().(*net.TCPAddr)
+	httpAddr := httpProxy.Listener.Addr().(*net.TCPAddr)
+	proxy := config.Proxy{
+		ProtoType: define.CHAIN,
+		Chain: []config.Proxy{
+			{ProtoType: define.SOCK4, Server: sock4Addr.IP.String(), Port: sock4Addr.Port},
+			{ProtoType: define.HTTP, Server: "localhost", Port: httpAddr.Port},
+		},
+	}
+	handler := NewChainHandler(define.App, HandlerKey{}, proxy, &net.TCPAddr{}, com.NewDomainAddr("tcp", "example.com", 80), nil)
+	err := handler.Tunnel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+
+	// sock4 hop connect to resolved ipv4 of next hop
+	if dst := <-dests; dst != httpAddr.String() {
+		t.Errorf("sock4 hop connect to %s, want %s", dst, httpAddr.String())
+	}
+	// last hop connect to remote with domain
+	if req := <-requests; req.Host != "example.com:80" {
+		t.Errorf("http hop connect to %s, want example.com:80", req.Host)
+	}
+	_, err = handler.rConn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = handler.rConn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(handler.rConn, buf)
+	if err != nil || string(buf) != "ping" {
+		t.Errorf("chain echo is %q, err: %v", buf, err)
+	}
+}
@@ -0,0 +1,38 @@
+package TProxy
+
+import (
+	"net"
+	"time"
+
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
+)
+
+// direct handler connect remote without proxy, support tcp and udp
+type DirectHandler struct {
+	handlerPrv
+}
+
+func NewDirectHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *DirectHandler {
+	// create new handler
+	handler := &DirectHandler{
+		handlerPrv: createHandlerPrv(NoneProto, scope, key, proxy, lAddr, rAddr, lConn),
+	}
+	// add self to private parent
+	handler.saveParent(handler)
+	return handler
+}
+
+// create tunnel between local and server
+func (handler *DirectHandler) Tunnel() error {
+	// domain addr is resolved by dial
+	rConn, err := net.DialTimeout(handler.rAddr.Network(), handler.rAddr.String(), 3*time.Second)
+	if err != nil {
+		logger.Warningf("[%s] dial remote [%s] failed, err: %v", handler.typ, handler.rAddr.String(), err)
+		return err
+	}
+	logger.Debugf("[%s] direct: tunnel create success, [%s] -> [%s]", handler.typ, handler.lAddr.String(), handler.rAddr.String())
+	// save rConn handler
+	handler.rConn = rConn
+	return nil
+}
@@ -27,31 +27,56 @@ func NewHttpHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAdd
 	return handler
 }
 
+func NewHttpsHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *HttpHandler {
+	// https is the same as http, but connection to proxy is wrapped in tls
+	handler := &HttpHandler{
+		handlerPrv: createHandlerPrv(HTTPS, scope, key, proxy, lAddr, rAddr, lConn),
+	}
+	// add self to private parent
+	handler.saveParent(handler)
+	return handler
+}
+
 // create tunnel between proxy and server
 func (handler *HttpHandler) Tunnel() error {
-	// dial proxy server
-	rConn, err := handler.dialProxy()
+	// dial proxy server, https proxy need tls to protect auth message
+	var rConn net.Conn
+	var err error
+	if handler.typ == HTTPS {
+		rConn, err = handler.dialTlsProxy()
+	} else {
+		rConn, err = handler.dialProxy()
+	}
 	if err != nil {
-		logger.Warningf("[http] failed to dial proxy server, err: %v", err)
+		logger.Warningf("[%s] failed to dial proxy server, err: %v", handler.typ, err)
 		return err
 	}
-	// check type
-	//tcpAddr, ok := handler.rAddr.(*net.TCPAddr)
-	//if !ok {
-	//	logger.Warning("[http] tunnel addr type is not tcp")
-	//	return errors.New("type is not tcp")
-	//}
+	// create http tunnel
+	err = httpConnect(handler.typ, rConn, handler.proxy, handler.rAddr)
+	if err != nil {
+		_ = rConn.Close()
+		return err
+	}
+	logger.Infof("[%s] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
+		handler.typ, handler.lAddr.String(), rConn.RemoteAddr(), handler.rAddr.String())
+	// save rConn handler
+	handler.rConn = rConn
+	return nil
+}
+
+// send http connect request through conn, conn can be proxy conn or previous hop of chain
+func httpConnect(typ ProtoTyp, rConn net.Conn, proxy config.Proxy, rAddr net.Addr) error {
 	// auth
 	auth := auth{
-		user:     handler.proxy.UserName,
-		password: handler.proxy.Password,
+		user:     proxy.UserName,
+		password: proxy.Password,
 	}
 	// create http head
 	req := &http.Request{
 		Method: http.MethodConnect,
-		Host:   handler.rAddr.String(),
+		Host:   rAddr.String(),
 		URL: &url.URL{
-			Host: handler.rAddr.String(),
+			Host: rAddr.String(),
 		},
 		Header: http.Header{},
 	}
@@ -61,21 +86,21 @@ func (handler *HttpHandler) Tunnel() error {
 		req.Header.Add("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(authMsg)))
 	}
 	// send connect request to rConn to create tunnel
-	logger.Infof("[http] req is %v", req)
-	err = req.Write(rConn)
+	logger.Infof("[%s] req is %v", typ, req)
+	err := req.Write(rConn)
 	if err != nil {
-		logger.Warningf("[http] write http tunnel request failed, err: %v", err)
+		logger.Warningf("[%s] write http tunnel request failed, err: %v", typ, err)
 		return err
 	}
-	logger.Info("[http] write req success")
+	logger.Infof("[%s] write req success", typ)
 	// read response
 	reader := bufio.NewReader(rConn)
 	resp, err := http.ReadResponse(reader, req)
 	if err != nil {
-		logger.Warningf("[http] read response failed, err: %v", err)
+		logger.Warningf("[%s] read response failed, err: %v", typ, err)
 		return err
 	} else {
-		logger.Info("[http] read response success")
+		logger.Infof("[%s] read response success", typ)
 	}
 	logger.Debug(resp.Status)
 	// close body
@@ -85,9 +110,5 @@ func (handler *HttpHandler) Tunnel() error {
 		return fmt.Errorf("proxy response error, status code: %v, message: %s",
 			resp.StatusCode, resp.Status)
 	}
-	logger.Infof("[http] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
-		handler.lAddr.String(), rConn.RemoteAddr(), handler.rAddr.String())
-	// save rConn handler
-	handler.rConn = rConn
 	return nil
 }
@@ -0,0 +1,155 @@
+package TProxy
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
+)
+
+// connect proxy echo data of tunnel, host and auth of request are sent to chan
+func connectEcho(requests chan<- *http.Request) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		requests <- r
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		_, _ = io.Copy(conn, rw)
+	}
+}
+
+func TestHttpsHandler(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	server := httptest.NewTLSServer(connectEcho(requests))
+	defer server.Close()
+	// trust cert of test server only
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+	serverAddr := server.Listener.Addr().(*net.TCPAddr)
+	proxy := config.Proxy{
+		ProtoType: define.HTTPS,
+		Server:    serverAddr.IP.String(),
+		Port:      serverAddr.Port,
+		UserName:  "user",
+		Password:  "password",
+		CAFile:    caFile,
+	}
+	handler := NewHttpsHandler(define.App, HandlerKey{}, proxy, &net.TCPAddr{}, com.NewDomainAddr("tcp", "example.com", 80), nil)
+	err := handler.Tunnel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+
+	req := <-requests
+	if req.Host != "example.com:80" {
+		t.Errorf("connect host is %s, want example.com:80", req.Host)
+	}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:password"))
+	if req.Header.Get("Proxy-Authorization") != auth {
+		t.Errorf("proxy auth is %q, want %q", req.Header.Get("Proxy-Authorization"), auth)
+	}
+	// data is sent in tls tunnel
+	_, err = handler.rConn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = handler.rConn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(handler.rConn, buf)
+	if err != nil || string(buf) != "ping" {
+		t.Errorf("tunnel echo is %q, err: %v", buf, err)
+	}
+}
+
+func TestTlsHandshakeTimeout(t *testing.T) {
+	// proxy accept but never hand shake
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}()
+	timeout := tlsHandshakeTimeout
+	tlsHandshakeTimeout = 100 * time.Millisecond
+	defer func() { tlsHandshakeTimeout = timeout }()
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := tlsClient(conn, config.Proxy{ProtoType: define.HTTPS, Server: "127.0.0.1"})
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Error("hand shake with stalled proxy should fail")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("hand shake with stalled proxy is not timeout")
+	}
+}
+
+func TestTunnelDeadline(t *testing.T) {
+	// proxy accept but never reply
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}()
+	listenAddr := listen.Addr().(*net.TCPAddr)
+	proxy := config.Proxy{ProtoType: define.HTTP, Server: listenAddr.IP.String(), Port: listenAddr.Port}
+	handler := NewHttpHandler(define.App, HandlerKey{}, proxy, &net.TCPAddr{}, com.NewDomainAddr("tcp", "example.com", 80), nil)
+	handler.SetTunnelDeadline(time.Now().Add(100 * time.Millisecond))
+	done := make(chan error, 1)
+	go func() {
+		done <- handler.Tunnel()
+	}()
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Error("tunnel through stalled proxy should fail")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("tunnel through stalled proxy is not stopped by deadline")
+	}
+}
@@ -0,0 +1,43 @@
+package TProxy
+
+import (
+	"errors"
+	"net"
+
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
+)
+
+// reject handler close local connection, no remote connection is created
+type RejectHandler struct {
+	handlerPrv
+}
+
+func NewRejectHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *RejectHandler {
+	// create new handler
+	handler := &RejectHandler{
+		handlerPrv: createHandlerPrv(REJECT, scope, key, proxy, lAddr, rAddr, lConn),
+	}
+	// add self to private parent
+	handler.saveParent(handler)
+	return handler
+}
+
+// reject has no tunnel
+func (handler *RejectHandler) Tunnel() error {
+	logger.Debugf("[%s] reject connection, [%s] -x- [%s]", handler.typ, handler.lAddr.String(), handler.rAddr.String())
+	return nil
+}
+
+// rewrite write remote, data is dropped
+func (handler *RejectHandler) WriteRemote(buf []byte) error {
+	return errors.New("connection is rejected")
+}
+
+// rewrite communication, close local directly
+func (handler *RejectHandler) Communicate() {
+	handler.Close()
+	if handler.mgr != nil {
+		handler.Remove()
+	}
+}
@@ -1,12 +1,14 @@
 package TProxy
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strings"
 
+	com "github.com/ArisAachen/deepin-network-proxy/com"
 	config "github.com/ArisAachen/deepin-network-proxy/config"
 	define "github.com/ArisAachen/deepin-network-proxy/define"
 )
@@ -25,22 +27,66 @@ func NewSock4Handler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAd
 	return handler
 }
 
+func NewSock4aHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *Sock4Handler {
+	// sock4a is the same as sock4, but can send domain
+	handler := &Sock4Handler{
+		handlerPrv: createHandlerPrv(SOCK4A, scope, key, proxy, lAddr, rAddr, lConn),
+	}
+	// add self to private parent
+	handler.saveParent(handler)
+	return handler
+}
+
 func (handler *Sock4Handler) Tunnel() error {
 	// dial proxy server
 	rConn, err := handler.dialProxy()
 	if err != nil {
-		logger.Warningf("[sock4] failed to dial proxy server, err: %v", err)
+		logger.Warningf("[%s] failed to dial proxy server, err: %v", handler.typ, err)
 		return err
 	}
-	// check type
-	tcpAddr, ok := handler.rAddr.(*net.TCPAddr)
-	if !ok {
-		logger.Warning("[sock4] tunnel addr type is not tcp")
+	// create sock4 tunnel
+	err = sock4Connect(handler.typ, rConn, handler.proxy, handler.rAddr, handler.typ == SOCK4A)
+	if err != nil {
+		_ = rConn.Close()
+		return err
+	}
+	logger.Debugf("[%s] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
+		handler.typ, handler.lAddr.String(), rConn.RemoteAddr(), handler.rAddr.String())
+	// save rConn handler
+	handler.rConn = rConn
+	return nil
+}
+
+// send sock4 connect request through conn, conn can be proxy conn or previous hop of chain
+func sock4Connect(typ ProtoTyp, rConn net.Conn, proxy config.Proxy, rAddr net.Addr, sock4a bool) error {
+	// check type, sock4a can send domain to proxy server
+	var ip net.IP
+	var port int
+	var domain string
+	switch addr := rAddr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP.To4()
+		port = addr.Port
+		if ip == nil {
+			logger.Warningf("[%s] tunnel addr is not ipv4, addr: %v", typ, addr)
+			return errors.New("sock4 only support ipv4")
+		}
+	case *com.DomainAddr:
+		if !sock4a {
+			logger.Warningf("[%s] sock4 dont support domain, addr: %v", typ, addr)
+			return errors.New("sock4 dont support domain")
+		}
+		// sock4a use 0.0.0.x as ip, x must not be zero
+		ip = net.IPv4(0, 0, 0, 1).To4()
+		port = addr.Port
+		domain = strings.TrimSuffix(addr.Domain, ".")
+	default:
+		logger.Warningf("[%s] tunnel addr type is not tcp", typ)
 		return errors.New("type is not tcp")
 	}
 	// sock4 dont support password auth
 	auth := auth{
-		user: handler.proxy.UserName,
+		user: proxy.UserName,
 	}
 	/*
 					sock4 connect request
@@ -48,41 +94,34 @@ func (handler *Sock4Handler) Tunnel() error {
 				| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
 				+----+----+----+----+----+----+----+----+----+----+....+----+
 		           1    1      2              4           variable       1
+
+					sock4a connect request, append domain when ip is 0.0.0.x
+				+----+----+----+----+----+----+----+----+----+....+----+----+....+----+
+				| VN | CD | DSTPORT |      DSTIP        | USERID  |NULL| DOMAIN  |NULL|
+				+----+----+----+----+----+----+----+----+----+....+----+----+....+----+
+		           1    1      2              4          variable    1   variable   1
 	*/
 	buf := make([]byte, 2)
 	buf[0] = 4 // sock version
 	buf[1] = 1 // connect command
-	// convert port 2 byte
-	writer := new(bytes.Buffer)
-	port := uint16(tcpAddr.Port)
-	if port == 0 {
-		port = 80
-	}
-	err = binary.Write(writer, binary.LittleEndian, port)
-	if err != nil {
-		logger.Warningf("[sock4] convert port failed, err: %v", err)
-		return err
-	}
-	portBy := writer.Bytes()[0:2]
+	// convert port 2 byte, port is network byte order
+	portBy := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBy, uint16(port))
 	buf = append(buf, portBy...)
-	// add ip and user
-	buf = append(buf, tcpAddr.IP...)
-	if auth.user != "" {
-		buf = append(buf, []byte(auth.user)...)
-	} else {
+	// add ip and user, user id end with null
+	buf = append(buf, ip...)
+	buf = append(buf, []byte(auth.user)...)
+	buf = append(buf, uint8(0))
+	// add domain, domain end with null
+	if domain != "" {
+		buf = append(buf, []byte(domain)...)
 		buf = append(buf, uint8(0))
 	}
 	// request proxy connect rConn server
-	logger.Debugf("[sock4] send connect request, buf: %v", buf)
-	_, err = rConn.Write(buf)
+	logger.Debugf("[%s] send connect request, buf: %v", typ, buf)
+	_, err := rConn.Write(buf)
 	if err != nil {
-		logger.Warningf("[sock4] send connect request failed, err: %v", err)
-		return err
-	}
-	buf = make([]byte, 32)
-	_, err = rConn.Read(buf)
-	if err != nil {
-		logger.Warningf("[sock4] connect response failed, err: %v", err)
+		logger.Warningf("[%s] send connect request failed, err: %v", typ, err)
 		return err
 	}
 	/*
@@ -93,14 +132,16 @@ func (handler *Sock4Handler) Tunnel() error {
 		          1    1      2              4
 
 	*/
+	buf = make([]byte, 8)
+	_, err = io.ReadFull(rConn, buf)
+	if err != nil {
+		logger.Warningf("[%s] connect response failed, err: %v", typ, err)
+		return err
+	}
 	// 0   0x5A
 	if buf[0] != 0 || buf[1] != 90 {
-		logger.Warningf("[sock4] proto is invalid, sock type: %v, code: %v", buf[0], buf[1])
+		logger.Warningf("[%s] proto is invalid, sock type: %v, code: %v", typ, buf[0], buf[1])
 		return fmt.Errorf("sock4 proto is invalid, sock type: %v, code: %v", buf[0], buf[1])
 	}
-	logger.Debugf("[sock4] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
-		handler.lConn.RemoteAddr(), rConn.RemoteAddr(), tcpAddr.String())
-	// save rConn handler
-	handler.lConn = rConn
 	return nil
 }
@@ -0,0 +1,82 @@
+package TProxy
+
+import (
+	"errors"
+	"net"
+
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
+)
+
+type TcpShadowsocksHandler struct {
+	handlerPrv
+}
+
+func NewTcpShadowsocksHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *TcpShadowsocksHandler {
+	// create new handler
+	handler := &TcpShadowsocksHandler{
+		handlerPrv: createHandlerPrv(SHADOWSOCKSTCP, scope, key, proxy, lAddr, rAddr, lConn),
+	}
+	// add self to private parent
+	handler.saveParent(handler)
+	return handler
+}
+
+// create tunnel between proxy and server
+func (handler *TcpShadowsocksHandler) Tunnel() error {
+	// dial proxy server
+	conn, err := handler.dialProxy()
+	if err != nil {
+		logger.Warningf("[%s] failed to dial proxy server, err: %v", handler.typ, err)
+		return err
+	}
+	// create shadowsocks tunnel
+	rConn, err := shadowsocksConnect(handler.typ, conn, handler.proxy, handler.rAddr)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	logger.Debugf("[%s] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
+		handler.typ, handler.lAddr.String(), conn.RemoteAddr(), handler.rAddr.String())
+	// save rConn handler
+	handler.rConn = rConn
+	return nil
+}
+
+// wrap conn with shadowsocks and send target addr, conn can be proxy conn or previous hop of chain
+func shadowsocksConnect(typ ProtoTyp, conn net.Conn, proxy config.Proxy, rAddr net.Addr) (net.Conn, error) {
+	// check type, fake ip may be replaced by domain
+	switch rAddr.(type) {
+	case *net.TCPAddr, *com.DomainAddr:
+	default:
+		logger.Warningf("[%s] tunnel addr type is not tcp", typ)
+		return nil, errors.New("type is not tcp")
+	}
+	// create cipher
+	ciph, err := newSsCipher(proxy.Cipher, proxy.Password)
+	if err != nil {
+		logger.Warningf("[%s] create cipher failed, err: %v", typ, err)
+		return nil, err
+	}
+	rConn := newSsConn(conn, ciph)
+	/*
+			shadowsocks tcp request, the first payload is target addr
+		   +------+----------+----------+
+		   | ATYP | DST.ADDR | DST.PORT |
+		   +------+----------+----------+
+		   |  1   | Variable |    2     |
+		   +------+----------+----------+
+	*/
+	addr, err := com.MarshalSock5Addr(rAddr)
+	if err != nil {
+		logger.Warningf("[%s] marshal target addr failed, err: %v", typ, err)
+		return nil, err
+	}
+	_, err = rConn.Write(addr)
+	if err != nil {
+		logger.Warningf("[%s] send target addr failed, err: %v", typ, err)
+		return nil, err
+	}
+	return rConn, nil
+}
@@ -1,11 +1,12 @@
 package TProxy
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 
+	com "github.com/ArisAachen/deepin-network-proxy/com"
 	config "github.com/ArisAachen/deepin-network-proxy/config"
 	define "github.com/ArisAachen/deepin-network-proxy/define"
 )
@@ -32,16 +33,32 @@ func (handler *TcpSock5Handler) Tunnel() error {
 		logger.Warningf("[%s] failed to dial proxy server, err: %v", handler.typ, err)
 		return err
 	}
-	// check type
-	tcpAddr, ok := handler.rAddr.(*net.TCPAddr)
-	if !ok {
-		logger.Warningf("[%s] tunnel addr type is not tcp", handler.typ)
+	// create sock5 tunnel
+	err = sock5Connect(handler.typ, rConn, handler.proxy, handler.rAddr)
+	if err != nil {
+		_ = rConn.Close()
+		return err
+	}
+	logger.Debugf("[%s] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
+		handler.typ, handler.lAddr.String(), rConn.RemoteAddr(), handler.rAddr.String())
+	// save rConn handler
+	handler.rConn = rConn
+	return nil
+}
+
+// send sock5 connect request through conn, conn can be proxy conn or previous hop of chain
+func sock5Connect(typ ProtoTyp, rConn net.Conn, proxy config.Proxy, rAddr net.Addr) error {
+	// check type, fake ip may be replaced by domain
+	switch rAddr.(type) {
+	case *net.TCPAddr, *com.DomainAddr:
+	default:
+		logger.Warningf("[%s] tunnel addr type is not tcp", typ)
 		return errors.New("type is not tcp")
 	}
 	// auth message
 	auth := auth{
-		user:     handler.proxy.UserName,
-		password: handler.proxy.Password,
+		user:     proxy.UserName,
+		password: proxy.Password,
 	}
 	/*
 	    sock5 client hand shake request
@@ -62,9 +79,9 @@ func (handler *TcpSock5Handler) Tunnel() error {
 		buf = append(buf, byte(2))
 	}
 	// sock5 hand shake
-	_, err = rConn.Write(buf)
+	_, err := rConn.Write(buf)
 	if err != nil {
-		logger.Warningf("[%s] hand shake request failed, err: %v", handler.typ, err)
+		logger.Warningf("[%s] hand shake request failed, err: %v", typ, err)
 		return err
 	}
 	/*
@@ -77,16 +94,16 @@ func (handler *TcpSock5Handler) Tunnel() error {
 	*/
 	_, err = rConn.Read(buf)
 	if err != nil {
-		logger.Warningf("[%s] hand shake response failed, err: %v", handler.typ, err)
+		logger.Warningf("[%s] hand shake response failed, err: %v", typ, err)
 		return err
 	}
-	logger.Debugf("[%s] hand shake response success message auth method: %v", handler.typ, buf[1])
+	logger.Debugf("[%s] hand shake response success message auth method: %v", typ, buf[1])
 	if buf[0] != 5 || (buf[1] != 0 && buf[1] != 2) {
 		return fmt.Errorf("sock5 proto is invalid, sock type: %v, method: %v", buf[0], buf[1])
 	}
 	// check if server need auth
 	if buf[1] == 2 {
-		logger.Debugf("[%s] proxy need auth, start authenticating...", handler.typ)
+		logger.Debugf("[%s] proxy need auth, start authenticating...", typ)
 		/*
 		    sock5 auth request
 		  +----+------+----------+------+----------+
@@ -104,21 +121,21 @@ func (handler *TcpSock5Handler) Tunnel() error {
 		// write auth message to writer
 		_, err = rConn.Write(buf)
 		if err != nil {
-			logger.Warningf("[%s] auth request failed, err: %v", handler.typ, err)
+			logger.Warningf("[%s] auth request failed, err: %v", typ, err)
 			return err
 		}
 		buf = make([]byte, 32)
 		_, err = rConn.Read(buf)
 		if err != nil {
-			logger.Warningf("[%s] auth response failed, err: %v", handler.typ, err)
+			logger.Warningf("[%s] auth response failed, err: %v", typ, err)
 			return err
 		}
 		// RFC1929 user/pass auth should return 1, but some sock5 return 5
 		if buf[0] != 5 && buf[0] != 1 {
-			logger.Warningf("[%s] auth response incorrect code, code: %v", handler.typ, buf[0])
+			logger.Warningf("[%s] auth response incorrect code, code: %v", typ, buf[0])
 			return fmt.Errorf("incorrect sock5 auth response, code: %v", buf[0])
 		}
-		logger.Debugf("[%s] auth success, code: %v", handler.typ, buf[0])
+		logger.Debugf("[%s] auth success, code: %v", typ, buf[0])
 	}
 	/*
 			sock5 connect request
@@ -129,51 +146,50 @@ func (handler *TcpSock5Handler) Tunnel() error {
 		   +----+-----+-------+------+----------+----------+
 	*/
 	// start create tunnel
-	buf = make([]byte, 4)
+	buf = make([]byte, 3)
 	buf[0] = 5
 	buf[1] = 1 // connect
 	buf[2] = 0 // reserved
-	// add tcpAddr
-	if tcpAddr.IP.To4() != nil {
-		buf[3] = 1
-		buf = append(buf, tcpAddr.IP.To4()...)
-	} else if tcpAddr.IP.To16() != nil {
-		buf[3] = 4
-		buf = append(buf, tcpAddr.IP.To16()...)
-	} else {
-		buf[3] = 3
-		buf = append(buf, tcpAddr.IP...)
-	}
-	// convert port 2 byte
-	portU := uint16(tcpAddr.Port)
-	if portU == 0 {
-		portU = 80
+	// add addr, ip or domain
+	addr, err := com.MarshalSock5Addr(rAddr)
+	if err != nil {
+		logger.Warningf("[%s] marshal connect addr failed, err: %v", typ, err)
+		return err
 	}
-	port := make([]byte, 2)
-	binary.BigEndian.PutUint16(port, portU)
-	buf = append(buf, port...)
+	buf = append(buf, addr...)
 	// request proxy connect rConn server
-	logger.Debugf("[%s] send connect request, buf: %v", handler.typ, buf)
+	logger.Debugf("[%s] send connect request, buf: %v", typ, buf)
 	_, err = rConn.Write(buf)
 	if err != nil {
-		logger.Warningf("[%s] send connect request failed, err: %v", handler.typ, err)
+		logger.Warningf("[%s] send connect request failed, err: %v", typ, err)
 		return err
 	}
-	logger.Debugf("[%s] request successfully", handler.typ)
-	buf = make([]byte, 16)
-	_, err = rConn.Read(buf)
+	logger.Debugf("[%s] request successfully", typ)
+	/*
+			sock5 connect response
+		   +----+-----+-------+------+----------+----------+
+		   |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+		   +----+-----+-------+------+----------+----------+
+		   | 1  |  1  | X'00' |  1   | Variable |    2     |
+		   +----+-----+-------+------+----------+----------+
+	*/
+	buf = make([]byte, 3)
+	_, err = io.ReadFull(rConn, buf)
 	if err != nil {
-		logger.Warningf("[%s] connect response failed, err: %v", handler.typ, err)
+		logger.Warningf("[%s] connect response failed, err: %v", typ, err)
 		return err
 	}
-	logger.Debugf("[%s] response successfully, buf: %v", handler.typ, buf)
+	logger.Debugf("[%s] response successfully, buf: %v", typ, buf)
 	if buf[0] != 5 || buf[1] != 0 {
-		logger.Warningf("[%s] connect response failed, version: %v, code: %v", handler.typ, buf[0], buf[1])
+		logger.Warningf("[%s] connect response failed, version: %v, code: %v", typ, buf[0], buf[1])
 		return fmt.Errorf("incorrect sock5 connect reponse, version: %v, code: %v", buf[0], buf[1])
 	}
-	logger.Debugf("[%s] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
-		handler.typ, handler.lAddr.String(), rConn.RemoteAddr(), handler.rAddr.String())
-	// save rConn handler
-	handler.rConn = rConn
+	// bind addr can be ipv4 ipv6 or domain, must read all in case mix with data
+	bndAddr, err := com.ReadSock5Addr(rConn, "tcp")
+	if err != nil {
+		logger.Warningf("[%s] read connect response bind addr failed, err: %v", typ, err)
+		return err
+	}
+	logger.Debugf("[%s] connect response bind addr: %v", typ, bndAddr)
 	return nil
 }
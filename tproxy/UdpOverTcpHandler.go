@@ -0,0 +1,260 @@
+package TProxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
+)
+
+// sing-box relay endpoint of udp over tcp version 2
+const UotMagicAddress = "sp.v2.udp-over-tcp.arpa"
+
+// uot addr family, the rest is the same as sock5 addr
+const (
+	uotIPv4   = 0
+	uotIPv6   = 1
+	uotDomain = 2
+)
+
+// udp over tcp handler, packets are framed in tcp tunnel of http https sock4 or chain proxy
+/*
+	request once after tunnel created
+	+------------+------+----------+----------+
+	| IS_CONNECT | ATYP | DST.ADDR | DST.PORT |
+	+------------+------+----------+----------+
+	|     1      |  1   | Variable |    2     |
+	+------------+------+----------+----------+
+
+	packet of both direction
+	+------+----------+----------+--------+----------+
+	| ATYP | DST.ADDR | DST.PORT | LENGTH |   DATA   |
+	+------+----------+----------+--------+----------+
+	|  1   | Variable |    2     |   2    | Variable |
+	+------+----------+----------+--------+----------+
+*/
+type UdpOverTcpHandler struct {
+	handlerPrv
+	// reader of tcp tunnel
+	reader *bufio.Reader
+	// packets of different destination may be written at the same time
+	writeLock sync.Mutex
+}
+
+func NewUdpOverTcpHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *UdpOverTcpHandler {
+	// create new handler
+	handler := &UdpOverTcpHandler{
+		handlerPrv: createHandlerPrv(UOT, scope, key, proxy, lAddr, rAddr, lConn),
+	}
+	// add self to private parent
+	handler.saveParent(handler)
+	return handler
+}
+
+// rewrite read remote
+func (handler *UdpOverTcpHandler) Read(buf []byte) (int, error) {
+	n, _, err := handler.ReadFrom(buf)
+	return n, err
+}
+
+// read packet from relay endpoint, addr is source of packet
+func (handler *UdpOverTcpHandler) ReadFrom(buf []byte) (int, net.Addr, error) {
+	if handler.reader == nil {
+		return 0, nil, errors.New("remote handler is nil")
+	}
+	for {
+		addr, err := readUotAddr(handler.reader)
+		if err != nil {
+			return 0, nil, err
+		}
+		lenBy := make([]byte, 2)
+		_, err = io.ReadFull(handler.reader, lenBy)
+		if err != nil {
+			return 0, nil, err
+		}
+		length := int(binary.BigEndian.Uint16(lenBy))
+		// stream must be consumed even if packet is dropped
+		if length > len(buf) {
+			_, err = handler.reader.Discard(length)
+			if err != nil {
+				return 0, nil, err
+			}
+			logger.Debugf("[%s] drop remote package larger than buffer, size: %d", handler.typ, length)
+			continue
+		}
+		_, err = io.ReadFull(handler.reader, buf[:length])
+		if err != nil {
+			return 0, nil, err
+		}
+		return length, addr, nil
+	}
+}
+
+// rewrite write remote
+func (handler *UdpOverTcpHandler) Write(buf []byte) (int, error) {
+	return handler.WriteTo(buf, handler.rAddr)
+}
+
+// send packet to addr through relay endpoint
+func (handler *UdpOverTcpHandler) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	if handler.rConn == nil {
+		return 0, errors.New("remote handler is nil")
+	}
+	if len(buf) > com.MaxUdpPackageSize {
+		return 0, fmt.Errorf("udp package is too large, size: %d", len(buf))
+	}
+	msg, err := marshalUotAddr(addr)
+	if err != nil {
+		return 0, err
+	}
+	lenBy := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenBy, uint16(len(buf)))
+	msg = append(msg, lenBy...)
+	msg = append(msg, buf...)
+	// packet is written in one call, or frames are mixed
+	handler.writeLock.Lock()
+	defer handler.writeLock.Unlock()
+	_, err = handler.rConn.Write(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// rewrite write remote, data need to be packed
+func (handler *UdpOverTcpHandler) WriteRemote(buf []byte) error {
+	_, err := handler.Write(buf)
+	return err
+}
+
+// rewrite communication
+func (handler *UdpOverTcpHandler) Communicate() {
+	// local -> remote
+	go func() {
+		logger.Debugf("[%s] begin copy data, local [%s] -> remote [%s]", handler.typ, handler.lAddr.String(), handler.rAddr.String())
+		_, err := io.Copy(handler.lConn, handler)
+		if err != nil {
+			logger.Debugf("[%s] stop copy data, local [%s] -x- remote [%s], reason: %v",
+				handler.typ, handler.lAddr.String(), handler.rAddr.String(), err)
+		}
+		handler.Remove()
+	}()
+
+	// remote -> local
+	go func() {
+		logger.Debugf("[%s] begin copy data, remote [%s] -> local [%s]", handler.typ, handler.rAddr.String(), handler.lAddr.String())
+		_, err := io.Copy(handler, handler.lConn)
+		if err != nil {
+			logger.Debugf("[%s] stop copy data, remote [%s] -x- local [%s], reason: %v",
+				handler.typ, handler.rAddr.String(), handler.lAddr.String(), err)
+		}
+		handler.Remove()
+	}()
+}
+
+// create tcp tunnel to relay endpoint and send request
+func (handler *UdpOverTcpHandler) Tunnel() error {
+	// tcp proto carry the tunnel
+	tcpTyp, err := BuildProto(handler.proxy.ProtoType)
+	if err != nil {
+		return err
+	}
+	switch tcpTyp {
+	case HTTP, HTTPS, SOCK4, SOCK4A, CHAIN:
+	default:
+		return fmt.Errorf("proto [%s] not support udp over tcp", tcpTyp)
+	}
+	endpoint, err := uotEndpoint(handler.proxy.UoT)
+	if err != nil {
+		logger.Warningf("[%s] relay endpoint is invalid, err: %v", handler.typ, err)
+		return err
+	}
+	conn, err := DialProxy(tcpTyp, handler.scope, handler.proxy, endpoint)
+	if err != nil {
+		logger.Warningf("[%s] dial relay endpoint [%s] through [%s] failed, err: %v", handler.typ, endpoint, tcpTyp, err)
+		return err
+	}
+	// packets carry destination, connect mode is not used
+	addr, err := marshalUotAddr(handler.rAddr)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	_, err = conn.Write(append([]byte{0}, addr...))
+	if err != nil {
+		logger.Warningf("[%s] send request failed, err: %v", handler.typ, err)
+		_ = conn.Close()
+		return err
+	}
+	logger.Debugf("[%s] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
+		handler.typ, handler.lAddr.String(), endpoint.String(), handler.rAddr.String())
+	// save rConn handler
+	handler.rConn = conn
+	handler.reader = bufio.NewReader(conn)
+	return nil
+}
+
+// parse relay endpoint, [host]:[port]
+func uotEndpoint(endpoint string) (net.Addr, error) {
+	if endpoint == "" {
+		return nil, errors.New("relay endpoint is empty")
+	}
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("relay endpoint port is invalid, port: %s", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+	return com.NewDomainAddr("tcp", host, port), nil
+}
+
+// marshal addr as sock5 addr with uot family
+func marshalUotAddr(addr net.Addr) ([]byte, error) {
+	buf, err := com.MarshalSock5Addr(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch buf[0] {
+	case com.Sock5IPv4:
+		buf[0] = uotIPv4
+	case com.Sock5IPv6:
+		buf[0] = uotIPv6
+	case com.Sock5Domain:
+		buf[0] = uotDomain
+	}
+	return buf, nil
+}
+
+// read addr with uot family
+func readUotAddr(reader io.Reader) (net.Addr, error) {
+	typ := make([]byte, 1)
+	_, err := io.ReadFull(reader, typ)
+	if err != nil {
+		return nil, err
+	}
+	switch typ[0] {
+	case uotIPv4:
+		typ[0] = com.Sock5IPv4
+	case uotIPv6:
+		typ[0] = com.Sock5IPv6
+	case uotDomain:
+		typ[0] = com.Sock5Domain
+	default:
+		return nil, fmt.Errorf("uot addr type is invalid, type: %v", typ[0])
+	}
+	return com.ReadSock5Addr(io.MultiReader(bytes.NewReader(typ), reader), "udp")
+}
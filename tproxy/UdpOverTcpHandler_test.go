@@ -0,0 +1,214 @@
+package TProxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
+)
+
+// read uot addr by hand, atyp 0 ipv4, 1 ipv6, 2 domain with length, then port
+func readRawUotAddr(reader *bufio.Reader) ([]byte, error) {
+	typ, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	raw := []byte{typ}
+	var size int
+	switch typ {
+	case 0:
+		size = net.IPv4len
+	case 1:
+		size = net.IPv6len
+	case 2:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		raw, size = append(raw, length), int(length)
+	default:
+		return nil, fmt.Errorf("uot addr type is invalid, type: %v", typ)
+	}
+	// addr and port
+	raw = append(raw, make([]byte, size+2)...)
+	_, err = io.ReadFull(reader, raw[len(raw)-size-2:])
+	return raw, err
+}
+
+// http proxy and uot relay in one, raw request and packets are sent to chan, packets are echoed as they are
+func startUotRelay(t *testing.T, connected chan<- string, requests chan<- []byte, frames chan<- []byte) net.Listener {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				connected <- req.Host
+				_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				// request, is connect and destination
+				isConnect, err := reader.ReadByte()
+				if err != nil {
+					return
+				}
+				addr, err := readRawUotAddr(reader)
+				if err != nil {
+					return
+				}
+				requests <- append([]byte{isConnect}, addr...)
+				for {
+					frame, err := readRawUotAddr(reader)
+					if err != nil {
+						return
+					}
+					lenBy := make([]byte, 2)
+					if _, err = io.ReadFull(reader, lenBy); err != nil {
+						return
+					}
+					data := make([]byte, binary.BigEndian.Uint16(lenBy))
+					if _, err = io.ReadFull(reader, data); err != nil {
+						return
+					}
+					frame = append(append(frame, lenBy...), data...)
+					frames <- frame
+					_, _ = conn.Write(frame)
+				}
+			}()
+		}
+	}()
+	return listen
+}
+
+// uot frame, addr then length of data and data
+func uotFrame(addr []byte, data []byte) []byte {
+	frame := append([]byte{}, addr...)
+	frame = append(frame, byte(len(data)>>8), byte(len(data)))
+	return append(frame, data...)
+}
+
+func TestUdpOverTcpRelay(t *testing.T) {
+	connected := make(chan string, 3)
+	requests := make(chan []byte, 3)
+	frames := make(chan []byte, 3)
+	relay := startUotRelay(t, connected, requests, frames)
+	defer relay.Close()
+	relayAddr := relay.Addr().(*net.TCPAddr)
+	proxy := config.Proxy{
+		ProtoType: define.HTTP,
+		Server:    relayAddr.IP.String(),
+		Port:      relayAddr.Port,
+		UoT:       UotMagicAddress + ":0",
+	}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	table := NewUdpSessionTable(define.App, time.Minute)
+	defer table.Close()
+	table.dialLocal = func(rAddr net.Addr, lAddr net.Addr) (net.Conn, error) {
+		return net.Dial("udp", lAddr.String())
+	}
+
+	// addr in sing-box v2 layout
+	ipv4 := []byte{0, 1, 1, 1, 1, 0, 53}
+	ipv6 := append(append([]byte{1}, net.ParseIP("2001:db8::1")...), 1, 187)
+	domain := append(append([]byte{2, 11}, "example.com"...), 0, 53)
+	fake := &net.UDPAddr{IP: net.IPv4(198, 18, 0, 1), Port: 53}
+	dests := []struct {
+		rAddr    net.Addr
+		realAddr net.Addr
+		raw      []byte
+	}{
+		{&net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}, &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}, ipv4},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, ipv6},
+		{fake, com.NewDomainAddr("udp", "example.com", 53), domain},
+	}
+	lAddr := client.LocalAddr()
+	for index, dest := range dests {
+		data := []byte(dest.realAddr.String() + strconv.Itoa(index))
+		err = table.Send(UOT, proxy, lAddr, dest.rAddr, dest.realAddr, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 512)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != string(data) {
+			t.Errorf("reply is %q, want %q", buf[:n], data)
+		}
+		if frame, want := <-frames, uotFrame(dest.raw, data); !bytes.Equal(frame, want) {
+			t.Errorf("frame is % x, want % x", frame, want)
+		}
+	}
+	// ip destinations share one tunnel to relay endpoint, domain has its own
+	for _, want := range [][]byte{append([]byte{0}, ipv4...), append([]byte{0}, domain...)} {
+		select {
+		case host := <-connected:
+			if host != UotMagicAddress+":0" {
+				t.Errorf("connect host is %s, want %s:0", host, UotMagicAddress)
+			}
+			if req := <-requests; !bytes.Equal(req, want) {
+				t.Errorf("request is % x, want % x", req, want)
+			}
+		default:
+			t.Error("relay is not connected")
+		}
+	}
+	select {
+	case host := <-connected:
+		t.Errorf("relay is connected again, host: %s", host)
+	default:
+	}
+}
+
+func TestUotAddr(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		raw  []byte
+	}{
+		{&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}, []byte{0, 1, 2, 3, 4, 0, 53}},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, append(append([]byte{1}, net.ParseIP("2001:db8::1")...), 0, 53)},
+		{com.NewDomainAddr("udp", "example.com", 53), append(append([]byte{2, 11}, "example.com"...), 0, 53)},
+	}
+	for _, test := range tests {
+		buf, err := marshalUotAddr(test.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, test.raw) {
+			t.Errorf("addr %v is marshaled as % x, want % x", test.addr, buf, test.raw)
+		}
+		addr, err := readUotAddr(bytes.NewReader(test.raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != test.addr.String() {
+			t.Errorf("read addr is %v, want %v", addr, test.addr)
+		}
+	}
+}
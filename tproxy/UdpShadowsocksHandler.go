@@ -0,0 +1,163 @@
+package TProxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
+)
+
+type UdpShadowsocksHandler struct {
+	handlerPrv
+	ciph *ssCipher
+	// packet read from server
+	buf []byte
+}
+
+func NewUdpShadowsocksHandler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *UdpShadowsocksHandler {
+	// create new handler
+	handler := &UdpShadowsocksHandler{
+		handlerPrv: createHandlerPrv(SHADOWSOCKSUDP, scope, key, proxy, lAddr, rAddr, lConn),
+	}
+	// add self to private parent
+	handler.saveParent(handler)
+	return handler
+}
+
+// rewrite read remote
+func (handler *UdpShadowsocksHandler) Read(buf []byte) (int, error) {
+	n, _, err := handler.ReadFrom(buf)
+	return n, err
+}
+
+// read packet from server, addr is source of packet
+func (handler *UdpShadowsocksHandler) ReadFrom(buf []byte) (int, net.Addr, error) {
+	// check if rConn is nil
+	if handler.rConn == nil {
+		return 0, nil, errors.New("remote handler is nil")
+	}
+	if handler.buf == nil {
+		handler.buf = make([]byte, udpBufSize)
+	}
+	for {
+		n, err := handler.rConn.Read(handler.buf)
+		if err != nil {
+			logger.Warningf("[%s] read remote failed, err: %v", handler.typ, err)
+			return 0, nil, err
+		}
+		// decrypt packet, drop invalid package, server conn is still usable
+		payload, err := handler.ciph.openPacket(handler.buf[:n])
+		if err != nil {
+			logger.Debugf("[%s] drop undecryptable remote package, err: %v", handler.typ, err)
+			continue
+		}
+		// source addr
+		reader := bytes.NewReader(payload)
+		addr, err := com.ReadSock5Addr(reader, "udp")
+		if err != nil {
+			logger.Debugf("[%s] drop remote package with invalid addr, err: %v", handler.typ, err)
+			continue
+		}
+		return copy(buf, payload[len(payload)-reader.Len():]), addr, nil
+	}
+}
+
+// rewrite write remote
+func (handler *UdpShadowsocksHandler) Write(buf []byte) (int, error) {
+	return handler.WriteTo(buf, handler.rAddr)
+}
+
+// send packet to addr, one server conn can send to any addr
+func (handler *UdpShadowsocksHandler) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	if handler.rConn == nil {
+		return 0, errors.New("remote handler is nil")
+	}
+	/*
+			shadowsocks udp packet
+		   +------+----------+----------+------+
+		   | ATYP | DST.ADDR | DST.PORT | DATA |
+		   +------+----------+----------+------+
+		   |  1   | Variable |    2     | Data |
+		   +------+----------+----------+------+
+	*/
+	payload, err := com.MarshalSock5Addr(addr)
+	if err != nil {
+		return 0, err
+	}
+	payload = append(payload, buf...)
+	pkg, err := handler.ciph.sealPacket(payload)
+	if err != nil {
+		return 0, err
+	}
+	_, err = handler.rConn.Write(pkg)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// rewrite write remote, data need to be packed
+func (handler *UdpShadowsocksHandler) WriteRemote(buf []byte) error {
+	_, err := handler.Write(buf)
+	return err
+}
+
+// rewrite communication
+func (handler *UdpShadowsocksHandler) Communicate() {
+	// local -> remote
+	go func() {
+		logger.Debugf("[%s] begin copy data, local [%s] -> remote [%s]", handler.typ, handler.lAddr.String(), handler.rAddr.String())
+		_, err := io.Copy(handler.lConn, handler)
+		if err != nil {
+			logger.Debugf("[%s] stop copy data, local [%s] -x- remote [%s], reason: %v",
+				handler.typ, handler.lAddr.String(), handler.rAddr.String(), err)
+		}
+		handler.Remove()
+	}()
+
+	// remote -> local
+	go func() {
+		logger.Debugf("[%s] begin copy data, remote [%s] -> local [%s]", handler.typ, handler.rAddr.String(), handler.lAddr.String())
+		_, err := io.Copy(handler, handler.lConn)
+		if err != nil {
+			logger.Debugf("[%s] stop copy data, remote [%s] -x- local [%s], reason: %v",
+				handler.typ, handler.rAddr.String(), handler.lAddr.String(), err)
+		}
+		handler.Remove()
+	}()
+}
+
+// create tunnel between proxy and server
+func (handler *UdpShadowsocksHandler) Tunnel() error {
+	// check type, fake ip may be replaced by domain
+	switch handler.rAddr.(type) {
+	case *net.UDPAddr, *com.DomainAddr:
+	default:
+		logger.Warningf("[%s] tunnel addr type is not udp", handler.typ)
+		return errors.New("type is not udp")
+	}
+	// create cipher
+	ciph, err := newSsCipher(handler.proxy.Cipher, handler.proxy.Password)
+	if err != nil {
+		logger.Warningf("[%s] create cipher failed, err: %v", handler.typ, err)
+		return err
+	}
+	handler.ciph = ciph
+	// shadowsocks udp relay use the same port with tcp
+	server := net.JoinHostPort(handler.proxy.Server, strconv.Itoa(handler.proxy.Port))
+	udpConn, err := net.Dial("udp", server)
+	if err != nil {
+		logger.Warningf("[%s] dial udp server failed, err: %v", handler.typ, err)
+		return err
+	}
+	logger.Debugf("[%s] proxy: tunnel create success, [%s] -> [%s] -> [%s]",
+		handler.typ, handler.lAddr.String(), udpConn.RemoteAddr(), handler.rAddr.String())
+	// save rConn handler
+	handler.rConn = udpConn
+	return nil
+}
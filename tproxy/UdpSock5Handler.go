@@ -1,7 +1,6 @@
 package TProxy
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -15,6 +14,10 @@ import (
 type UdpSock5Handler struct {
 	handlerPrv
 	rTcpConn net.Conn
+	// packet read from relay server
+	buf []byte
+	// fragments of relay server
+	frags *com.Sock5Reassembler
 }
 
 func NewUdpSock5Handler(scope define.Scope, key HandlerKey, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, lConn net.Conn) *UdpSock5Handler {
@@ -37,37 +40,77 @@ func (handler *UdpSock5Handler) Close() {
 
 // rewrite read remote
 func (handler *UdpSock5Handler) Read(buf []byte) (int, error) {
+	n, _, err := handler.ReadFrom(buf)
+	return n, err
+}
+
+// read packet from relay server, addr is source of packet
+func (handler *UdpSock5Handler) ReadFrom(buf []byte) (int, net.Addr, error) {
 	// check if rConn is nil
 	if handler.rConn == nil {
-		return 0, errors.New("remote handler is nil")
+		return 0, nil, errors.New("remote handler is nil")
 	}
-	data := make([]byte, 512)
-	n, err := handler.rConn.Read(data)
-	if err != nil {
-		logger.Warningf("read remote failed, err: %v", err)
-		return n, err
+	if handler.buf == nil {
+		handler.buf = make([]byte, udpBufSize)
+	}
+	if handler.frags == nil {
+		handler.frags = com.NewSock5Reassembler(com.DefaultFragTimeout)
+	}
+	for {
+		n, err := handler.rConn.Read(handler.buf)
+		if err != nil {
+			logger.Warningf("read remote failed, err: %v", err)
+			return 0, nil, err
+		}
+		pkgData, err := com.UnMarshalPackage(handler.buf[:n])
+		if err != nil {
+			// drop invalid package, relay is still usable
+			logger.Debugf("[%s] drop invalid remote package, err: %v", handler.typ, err)
+			continue
+		}
+		pkgData, ok := handler.frags.Push(pkgData)
+		if !ok {
+			continue
+		}
+		if len(pkgData.Data) > len(buf) {
+			logger.Debugf("[%s] drop remote package larger than buffer, size: %d", handler.typ, len(pkgData.Data))
+			continue
+		}
+		return copy(buf, pkgData.Data), pkgData.Addr, nil
 	}
-	pkgData := com.UnMarshalPackage(data)
-	copy(buf, pkgData.Data)
-	return n, nil
 }
 
 // rewrite write remote
 func (handler *UdpSock5Handler) Write(buf []byte) (int, error) {
+	return handler.WriteTo(buf, handler.rAddr)
+}
+
+// send packet to addr through relay server, one association can send to any addr
+func (handler *UdpSock5Handler) WriteTo(buf []byte, addr net.Addr) (int, error) {
 	if handler.rConn == nil {
 		return 0, errors.New("remote handler is nil")
 	}
 	pkgData := com.DataPackage{
-		Addr: handler.rAddr,
+		Addr: addr,
 		Data: buf,
 	}
-	_, err := handler.rConn.Write(com.MarshalPackage(pkgData, "udp"))
+	msg, err := com.MarshalPackage(pkgData)
+	if err != nil {
+		return 0, err
+	}
+	_, err = handler.rConn.Write(msg)
 	if err != nil {
 		return 0, err
 	}
 	return len(buf), nil
 }
 
+// rewrite write remote, data need to be packed
+func (handler *UdpSock5Handler) WriteRemote(buf []byte) error {
+	_, err := handler.Write(buf)
+	return err
+}
+
 // rewrite communication
 func (handler *UdpSock5Handler) Communicate() {
 	// local -> remote
@@ -103,9 +146,10 @@ func (handler *UdpSock5Handler) Tunnel() error {
 	}
 	// save tcp connection
 	handler.rTcpConn = rTcpConn
-	// check type
-	udpAddr, ok := handler.rAddr.(*net.UDPAddr)
-	if !ok {
+	// check type, fake ip may be replaced by domain
+	switch handler.rAddr.(type) {
+	case *net.UDPAddr, *com.DomainAddr:
+	default:
 		logger.Warning("[udp] tunnel addr type is not udp")
 		return errors.New("type is not udp")
 	}
@@ -199,29 +243,17 @@ func (handler *UdpSock5Handler) Tunnel() error {
 		   +----+-----+-------+------+----------+----------+
 	*/
 	// start create tunnel
-	buf = make([]byte, 4)
+	buf = make([]byte, 3)
 	buf[0] = 5
 	buf[1] = 3 // udp
 	buf[2] = 0 // reserved
-	// add addr
-	if udpAddr.IP.To4() != nil {
-		buf[3] = 1
-		buf = append(buf, net.IP{127, 0, 0, 0}...)
-	} else if udpAddr.IP.To16() != nil {
-		buf[3] = 4
-		buf = append(buf, udpAddr.IP.To16()...)
-	} else {
-		buf[3] = 3
-		buf = append(buf, udpAddr.IP...)
-	}
-	// convert port 2 byte
-	portU := uint16(udpAddr.Port)
-	if portU == 0 {
-		portU = 80
+	// udp associate dont know which addr will be used to send udp, use zero addr
+	addr, err := com.MarshalSock5Addr(&net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	if err != nil {
+		logger.Warningf("[udp] sock5 marshal associate addr failed, err: %v", err)
+		return err
 	}
-	port := make([]byte, 2)
-	binary.BigEndian.PutUint16(port, portU)
-	buf = append(buf, port...)
+	buf = append(buf, addr...)
 	// request proxy connect rTcpConn server
 	logger.Debugf("[udp] sock5 send connect request, buf: %v", buf)
 	_, err = rTcpConn.Write(buf)
@@ -230,8 +262,8 @@ func (handler *UdpSock5Handler) Tunnel() error {
 		return err
 	}
 	logger.Debugf("[udp] sock5 request successfully")
-	buf = make([]byte, 16)
-	_, err = rTcpConn.Read(buf)
+	buf = make([]byte, 3)
+	_, err = io.ReadFull(rTcpConn, buf)
 	if err != nil {
 		logger.Warningf("[udp] sock5 connect response failed, err: %v", err)
 		return err
@@ -241,11 +273,20 @@ func (handler *UdpSock5Handler) Tunnel() error {
 		logger.Warningf("[udp] sock5 connect response failed, version: %v, code: %v", buf[0], buf[1])
 		return fmt.Errorf("[udp] incorrect sock5 connect reponse, version: %v, code: %v", buf[0], buf[1])
 	}
-	// dial rTcpConn udp server
-	udpServer := net.UDPAddr{
-		IP:   buf[4:8],
-		Port: int(binary.BigEndian.Uint16(buf[8:10])),
+	// udp relay server addr can be ipv4 ipv6 or domain
+	udpServer, err := com.ReadSock5Addr(rTcpConn, "udp")
+	if err != nil {
+		logger.Warningf("[udp] sock5 read relay addr failed, err: %v", err)
+		return err
 	}
+	// zero relay addr means relay is on proxy server
+	if relay, ok := udpServer.(*net.UDPAddr); ok && relay.IP.IsUnspecified() {
+		proxyAddr, ok := rTcpConn.RemoteAddr().(*net.TCPAddr)
+		if ok {
+			udpServer = &net.UDPAddr{IP: proxyAddr.IP, Port: relay.Port, Zone: proxyAddr.Zone}
+		}
+	}
+	// dial rTcpConn udp server
 	udpConn, err := net.Dial("udp", udpServer.String())
 	if err != nil {
 		logger.Warningf("[udp] dial rTcpConn udp failed, err: %v", err)
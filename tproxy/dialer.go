@@ -0,0 +1,33 @@
+package TProxy
+
+import (
+	"fmt"
+	"net"
+
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
+)
+
+// get remote conn of handler
+func (pr *handlerPrv) remoteConn() net.Conn {
+	return pr.rConn
+}
+
+// dial remote through proxy, return conn is tunnel to remote, used by proxy self such as dns
+func DialProxy(proto ProtoTyp, scope define.Scope, proxy config.Proxy, rAddr net.Addr) (net.Conn, error) {
+	// no local conn, tunnel only
+	handler := NewHandler(proto, scope, HandlerKey{}, proxy, &net.TCPAddr{}, rAddr, nil)
+	if handler == nil {
+		return nil, fmt.Errorf("proto [%s] is not support", proto)
+	}
+	err := handler.Tunnel()
+	if err != nil {
+		return nil, err
+	}
+	remote, ok := handler.(interface{ remoteConn() net.Conn })
+	if !ok || remote.remoteConn() == nil {
+		handler.Close()
+		return nil, fmt.Errorf("proto [%s] has no remote conn", proto)
+	}
+	return remote.remoteConn(), nil
+}
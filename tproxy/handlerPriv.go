@@ -1,8 +1,13 @@
 package TProxy
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
 	"sync"
@@ -12,6 +17,9 @@ import (
 	define "github.com/ArisAachen/deepin-network-proxy/define"
 )
 
+// time limit of tls hand shake with proxy server
+var tlsHandshakeTimeout = 3 * time.Second
+
 // handler private, data of handler
 
 type handlerPrv struct {
@@ -35,6 +43,9 @@ type handlerPrv struct {
 	// delete mark, in case if delete twice, not use this time
 	deleted bool
 	lock    sync.Mutex
+
+	// deadline of conn to proxy, zero is no limit
+	deadline time.Time
 }
 
 // new handler private
@@ -75,6 +86,18 @@ func (pr *handlerPrv) AddMgr(mgr *HandlerMgr) {
 	mgr.AddHandler(pr.typ, pr.key, pr.parent)
 }
 
+// limit time of tunnel, stalled hand shake fails at deadline, conn keeps deadline after tunnel
+func (pr *handlerPrv) SetTunnelDeadline(deadline time.Time) {
+	pr.deadline = deadline
+}
+
+// set deadline on conn to proxy
+func (pr *handlerPrv) limitConn(conn net.Conn) {
+	if !pr.deadline.IsZero() {
+		_ = conn.SetDeadline(pr.deadline)
+	}
+}
+
 // tcp connect to remote server
 func (pr *handlerPrv) dialProxy() (net.Conn, error) {
 	proxy := pr.proxy
@@ -87,10 +110,94 @@ func (pr *handlerPrv) dialProxy() (net.Conn, error) {
 		logger.Warningf("[%s] dial proxy server failed, err: %v", pr.typ, err)
 		return nil, err
 	}
+	pr.limitConn(conn)
 	logger.Infof("[%s] dial proxy server success, local [%s] -> remote [%s]", pr.typ, conn.LocalAddr(), conn.RemoteAddr())
 	return conn, nil
 }
 
+// tls connect to remote server
+func (pr *handlerPrv) dialTlsProxy() (net.Conn, error) {
+	// create tls config
+	tlsConfig, err := newTlsConfig(pr.proxy)
+	if err != nil {
+		logger.Warningf("[%s] create tls config failed, err: %v", pr.typ, err)
+		return nil, err
+	}
+	proxy := pr.proxy
+	if proxy.Port == 0 {
+		proxy.Port = 443
+	}
+	server := net.JoinHostPort(proxy.Server, strconv.Itoa(proxy.Port))
+	tcpConn, err := net.DialTimeout("tcp", server, 3*time.Second)
+	if err != nil {
+		logger.Warningf("[%s] dial tls proxy server failed, err: %v", pr.typ, err)
+		return nil, err
+	}
+	pr.limitConn(tcpConn)
+	conn, err := tlsHandshake(tcpConn, tlsConfig)
+	if err != nil {
+		logger.Warningf("[%s] tls hand shake with proxy server failed, err: %v", pr.typ, err)
+		_ = tcpConn.Close()
+		return nil, err
+	}
+	logger.Infof("[%s] dial tls proxy server success, local [%s] -> remote [%s]", pr.typ, conn.LocalAddr(), conn.RemoteAddr())
+	return conn, nil
+}
+
+// wrap conn in tls, conn can be previous hop of chain
+func tlsClient(conn net.Conn, proxy config.Proxy) (net.Conn, error) {
+	tlsConfig, err := newTlsConfig(proxy)
+	if err != nil {
+		return nil, err
+	}
+	return tlsHandshake(conn, tlsConfig)
+}
+
+// hand shake in time, proxy may stall and block tunnel forever
+func tlsHandshake(conn net.Conn, tlsConfig *tls.Config) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, tlsConfig)
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// create tls config from proxy
+func newTlsConfig(proxy config.Proxy) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         proxy.SNI,
+		InsecureSkipVerify: proxy.SkipVerify,
+	}
+	// sni default is server
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = proxy.Server
+	}
+	// custom ca bundle
+	if proxy.CAFile != "" {
+		buf, err := ioutil.ReadFile(proxy.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no cert found in ca file %s", proxy.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	// client cert for mtls
+	if proxy.CertFile != "" || proxy.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(proxy.CertFile, proxy.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
 // read and write
 
 func (pr *handlerPrv) WriteRemote(buf []byte) error {
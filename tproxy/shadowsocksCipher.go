@@ -0,0 +1,272 @@
+package TProxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// https://shadowsocks.org/guide/aead.html
+
+const (
+	// max payload size of one aead chunk
+	ssMaxPayload = 0x3FFF
+	// sub key info of hkdf
+	ssSubKeyInfo = "ss-subkey"
+)
+
+// shadowsocks aead cipher
+type ssCipher struct {
+	name    string
+	keySize int
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// create aes gcm aead
+func newAesGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// create cipher by name and password
+func newSsCipher(name string, password string) (*ssCipher, error) {
+	ciph := &ssCipher{
+		name: strings.ToLower(name),
+	}
+	switch ciph.name {
+	case "aes-256-gcm":
+		ciph.keySize = 32
+		ciph.newAEAD = newAesGcm
+	case "chacha20-ietf-poly1305":
+		ciph.keySize = chacha20poly1305.KeySize
+		ciph.newAEAD = chacha20poly1305.New
+	default:
+		return nil, fmt.Errorf("shadowsocks cipher is not support, cipher: %s", name)
+	}
+	if password == "" {
+		return nil, errors.New("shadowsocks password is empty")
+	}
+	ciph.key = evpBytesToKey(password, ciph.keySize)
+	return ciph, nil
+}
+
+// salt size is the same as key size
+func (ciph *ssCipher) saltSize() int {
+	return ciph.keySize
+}
+
+// derive session aead from salt
+func (ciph *ssCipher) aead(salt []byte) (cipher.AEAD, error) {
+	subKey := make([]byte, ciph.keySize)
+	reader := hkdf.New(sha1.New, ciph.key, salt, []byte(ssSubKeyInfo))
+	_, err := io.ReadFull(reader, subKey)
+	if err != nil {
+		return nil, err
+	}
+	return ciph.newAEAD(subKey)
+}
+
+// openssl EVP_BytesToKey with md5, used by shadowsocks to derive master key from password
+func evpBytesToKey(password string, keySize int) []byte {
+	var key, prev []byte
+	for len(key) < keySize {
+		hash := md5.New()
+		hash.Write(prev)
+		hash.Write([]byte(password))
+		prev = hash.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keySize]
+}
+
+// increase little endian nonce
+func increaseNonce(nonce []byte) {
+	for index := range nonce {
+		nonce[index]++
+		if nonce[index] != 0 {
+			return
+		}
+	}
+}
+
+// shadowsocks tcp stream conn
+type ssConn struct {
+	net.Conn
+	ciph *ssCipher
+
+	// write
+	enc      cipher.AEAD
+	encNonce []byte
+
+	// read
+	dec      cipher.AEAD
+	decNonce []byte
+	leftover []byte
+}
+
+// wrap conn with shadowsocks aead stream
+func newSsConn(conn net.Conn, ciph *ssCipher) *ssConn {
+	return &ssConn{
+		Conn: conn,
+		ciph: ciph,
+	}
+}
+
+// init write aead, salt is sent at the beginning of stream
+func (conn *ssConn) initWriter() error {
+	salt := make([]byte, conn.ciph.saltSize())
+	_, err := io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return err
+	}
+	conn.enc, err = conn.ciph.aead(salt)
+	if err != nil {
+		return err
+	}
+	conn.encNonce = make([]byte, conn.enc.NonceSize())
+	_, err = conn.Conn.Write(salt)
+	return err
+}
+
+// init read aead, salt is received at the beginning of stream
+func (conn *ssConn) initReader() error {
+	salt := make([]byte, conn.ciph.saltSize())
+	_, err := io.ReadFull(conn.Conn, salt)
+	if err != nil {
+		return err
+	}
+	conn.dec, err = conn.ciph.aead(salt)
+	if err != nil {
+		return err
+	}
+	conn.decNonce = make([]byte, conn.dec.NonceSize())
+	return nil
+}
+
+// write data as aead chunks
+func (conn *ssConn) Write(buf []byte) (int, error) {
+	if conn.enc == nil {
+		err := conn.initWriter()
+		if err != nil {
+			return 0, err
+		}
+	}
+	/*
+		shadowsocks aead chunk
+		+----------------+---------------+------------------+-------------+
+		| encrypted len  |    len tag    | encrypted payload| payload tag |
+		+----------------+---------------+------------------+-------------+
+		|       2        |      16       |     Variable     |     16      |
+		+----------------+---------------+------------------+-------------+
+	*/
+	var written int
+	for len(buf) > 0 {
+		size := len(buf)
+		if size > ssMaxPayload {
+			size = ssMaxPayload
+		}
+		overhead := conn.enc.Overhead()
+		chunk := make([]byte, 2, 2+overhead+size+overhead)
+		binary.BigEndian.PutUint16(chunk, uint16(size))
+		chunk = conn.enc.Seal(chunk[:0], conn.encNonce, chunk, nil)
+		increaseNonce(conn.encNonce)
+		chunk = conn.enc.Seal(chunk, conn.encNonce, buf[:size], nil)
+		increaseNonce(conn.encNonce)
+		_, err := conn.Conn.Write(chunk)
+		if err != nil {
+			return written, err
+		}
+		written += size
+		buf = buf[size:]
+	}
+	return written, nil
+}
+
+// read data from aead chunks
+func (conn *ssConn) Read(buf []byte) (int, error) {
+	// read left data first
+	if len(conn.leftover) > 0 {
+		n := copy(buf, conn.leftover)
+		conn.leftover = conn.leftover[n:]
+		return n, nil
+	}
+	if conn.dec == nil {
+		err := conn.initReader()
+		if err != nil {
+			return 0, err
+		}
+	}
+	overhead := conn.dec.Overhead()
+	// read length
+	lenBuf := make([]byte, 2+overhead)
+	_, err := io.ReadFull(conn.Conn, lenBuf)
+	if err != nil {
+		return 0, err
+	}
+	lenBuf, err = conn.dec.Open(lenBuf[:0], conn.decNonce, lenBuf, nil)
+	if err != nil {
+		return 0, err
+	}
+	increaseNonce(conn.decNonce)
+	size := int(binary.BigEndian.Uint16(lenBuf)) & ssMaxPayload
+	// read payload
+	payload := make([]byte, size+overhead)
+	_, err = io.ReadFull(conn.Conn, payload)
+	if err != nil {
+		return 0, err
+	}
+	payload, err = conn.dec.Open(payload[:0], conn.decNonce, payload, nil)
+	if err != nil {
+		return 0, err
+	}
+	increaseNonce(conn.decNonce)
+	n := copy(buf, payload)
+	conn.leftover = payload[n:]
+	return n, nil
+}
+
+// seal one udp packet, [salt][encrypted payload][tag], nonce is zero
+func (ciph *ssCipher) sealPacket(payload []byte) ([]byte, error) {
+	salt := make([]byte, ciph.saltSize())
+	_, err := io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := ciph.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Seal(salt, nonce, payload, nil), nil
+}
+
+// open one udp packet
+func (ciph *ssCipher) openPacket(pkg []byte) ([]byte, error) {
+	if len(pkg) < ciph.saltSize() {
+		return nil, errors.New("shadowsocks packet is too short")
+	}
+	aead, err := ciph.aead(pkg[:ciph.saltSize()])
+	if err != nil {
+		return nil, err
+	}
+	if len(pkg) < ciph.saltSize()+aead.Overhead() {
+		return nil, errors.New("shadowsocks packet is too short")
+	}
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Open(nil, nonce, pkg[ciph.saltSize():], nil)
+}
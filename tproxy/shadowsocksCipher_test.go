@@ -0,0 +1,233 @@
+package TProxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
+)
+
+// shadowsocks tcp server stand-in, read target addr and echo data
+func startSsTcpServer(t *testing.T, ciph *ssCipher, target chan<- net.Addr) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ssConn := newSsConn(conn, ciph)
+		addr, err := com.ReadSock5Addr(ssConn, "tcp")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		target <- addr
+		_, _ = io.Copy(ssConn, ssConn)
+	}()
+	return listener
+}
+
+// shadowsocks udp server stand-in, echo data with source addr
+func startSsUdpServer(t *testing.T, ciph *ssCipher, target chan<- net.Addr) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 65535)
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		payload, err := ciph.openPacket(buf[:n])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		addr, err := com.ReadSock5Addr(bytes.NewReader(payload), "udp")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		target <- addr
+		pkg, err := ciph.sealPacket(payload)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, _ = conn.WriteTo(pkg, client)
+	}()
+	return conn
+}
+
+func TestTcpShadowsocksHandler_Tunnel(t *testing.T) {
+	for _, name := range []string{"aes-256-gcm", "chacha20-ietf-poly1305"} {
+		ciph, err := newSsCipher(name, "12345678")
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := make(chan net.Addr, 1)
+		listener := startSsTcpServer(t, ciph, target)
+		proxy := config.Proxy{
+			ProtoType: define.SHADOWSOCKS,
+			Server:    "127.0.0.1",
+			Port:      listener.Addr().(*net.TCPAddr).Port,
+			Password:  "12345678",
+			Cipher:    name,
+		}
+		lConn, _ := net.Pipe()
+		rAddr := com.NewDomainAddr("tcp", "example.com", 443)
+		handler := NewTcpShadowsocksHandler(define.App, HandlerKey{}, proxy, lConn.LocalAddr(), rAddr, lConn)
+		err = handler.Tunnel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr := <-target; addr.String() != rAddr.String() {
+			t.Errorf("[%s] target addr is %v, want %v", name, addr, rAddr)
+		}
+		// data larger than one chunk
+		data := bytes.Repeat([]byte("shadowsocks"), 4096)
+		go func() {
+			_ = handler.WriteRemote(data)
+		}()
+		recv := make([]byte, len(data))
+		_, err = io.ReadFull(handler.rConn, recv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(recv, data) {
+			t.Errorf("[%s] echo data is not match", name)
+		}
+		handler.Close()
+		_ = listener.Close()
+	}
+}
+
+func TestUdpShadowsocksHandler_Tunnel(t *testing.T) {
+	ciph, err := newSsCipher("chacha20-ietf-poly1305", "12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := make(chan net.Addr, 1)
+	conn := startSsUdpServer(t, ciph, target)
+	defer conn.Close()
+	proxy := config.Proxy{
+		ProtoType: define.SHADOWSOCKS,
+		Server:    "127.0.0.1",
+		Port:      conn.LocalAddr().(*net.UDPAddr).Port,
+		Password:  "12345678",
+		Cipher:    "chacha20-ietf-poly1305",
+	}
+	lConn, _ := net.Pipe()
+	rAddr := &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+	handler := NewUdpShadowsocksHandler(define.App, HandlerKey{}, proxy, lConn.LocalAddr(), rAddr, lConn)
+	err = handler.Tunnel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+	err = handler.WriteRemote([]byte("query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := <-target; addr.String() != rAddr.String() {
+		t.Errorf("target addr is %v, want %v", addr, rAddr)
+	}
+	buf := make([]byte, 512)
+	n, err := handler.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "query" {
+		t.Errorf("echo data is %q, want %q", buf[:n], "query")
+	}
+}
+
+func TestUdpShadowsocksSession_DropInvalid(t *testing.T) {
+	ciph, err := newSsCipher("aes-256-gcm", "12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// server reply garbage and truncated addr before echo
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, client, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			payload, err := ciph.openPacket(buf[:n])
+			if err != nil {
+				continue
+			}
+			truncated, _ := ciph.sealPacket([]byte{com.Sock5IPv4, 1, 2})
+			echo, _ := ciph.sealPacket(payload)
+			for _, pkg := range [][]byte{[]byte("garbage"), truncated, echo} {
+				_, _ = server.WriteTo(pkg, client)
+			}
+		}
+	}()
+	proxy := config.Proxy{
+		ProtoType: define.SHADOWSOCKS,
+		Server:    "127.0.0.1",
+		Port:      server.LocalAddr().(*net.UDPAddr).Port,
+		Password:  "12345678",
+		Cipher:    "aes-256-gcm",
+	}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	table := NewUdpSessionTable(define.App, time.Minute)
+	defer table.Close()
+	table.dialLocal = func(rAddr net.Addr, lAddr net.Addr) (net.Conn, error) {
+		return net.Dial("udp", lAddr.String())
+	}
+	rAddr := &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+	// session is still alive after invalid package
+	for _, data := range []string{"query1", "query2"} {
+		err = table.Send(SHADOWSOCKSUDP, proxy, client.LocalAddr(), rAddr, rAddr, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 512)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != data {
+			t.Errorf("echo data is %q, want %q", buf[:n], data)
+		}
+	}
+	if count := table.Count(); count != 1 {
+		t.Errorf("session count is %d, want 1", count)
+	}
+}
+
+func TestNewSsCipher(t *testing.T) {
+	_, err := newSsCipher("rc4-md5", "12345678")
+	if err == nil {
+		t.Error("stream cipher should not be supported")
+	}
+	_, err = newSsCipher("aes-256-gcm", "")
+	if err == nil {
+		t.Error("empty password should not be accepted")
+	}
+}
@@ -0,0 +1,188 @@
+package TProxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// tls record header and max record size
+	tlsHeaderLen    = 5
+	tlsMaxRecordLen = 16384
+	// http header is only sniffed in this size
+	httpMaxHeaderLen = 4096
+)
+
+// conn whose first bytes has been peeked, peeked bytes are read again
+type sniffConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *sniffConn) Read(buf []byte) (int, error) {
+	return conn.reader.Read(buf)
+}
+
+// peek first client bytes to find domain from tls sni or http host,
+// return conn must be used instead of conn, domain is empty if not found
+func SniffConn(conn net.Conn, timeout time.Duration) (net.Conn, string) {
+	reader := bufio.NewReaderSize(conn, tlsHeaderLen+tlsMaxRecordLen)
+	sConn := &sniffConn{
+		Conn:   conn,
+		reader: reader,
+	}
+	// server first proto never send data, dont wait too long
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	first, err := reader.Peek(1)
+	if err != nil {
+		return sConn, ""
+	}
+	// tls handshake record
+	if first[0] == 0x16 {
+		header, err := reader.Peek(tlsHeaderLen)
+		if err != nil {
+			return sConn, ""
+		}
+		length := int(binary.BigEndian.Uint16(header[3:]))
+		if length > tlsMaxRecordLen {
+			return sConn, ""
+		}
+		record, err := reader.Peek(tlsHeaderLen + length)
+		if err != nil {
+			return sConn, ""
+		}
+		domain, err := parseSNI(record[tlsHeaderLen:])
+		if err != nil {
+			logger.Debugf("parse tls sni failed, err: %v", err)
+			return sConn, ""
+		}
+		return sConn, domain
+	}
+	// http request, wait until header end
+	size := 1
+	for size < httpMaxHeaderLen {
+		if reader.Buffered() > size {
+			size = reader.Buffered()
+		} else {
+			size++
+		}
+		buf, err := reader.Peek(size)
+		if err != nil {
+			return sConn, ""
+		}
+		// not http request, no need to wait
+		if index := bytes.Index(buf, []byte("\r\n")); index >= 0 && !bytes.Contains(buf[:index], []byte(" HTTP/")) {
+			return sConn, ""
+		}
+		if index := bytes.Index(buf, []byte("\r\n\r\n")); index >= 0 {
+			return sConn, parseHttpHost(buf[:index])
+		}
+	}
+	return sConn, ""
+}
+
+// parse sni from tls client hello
+func parseSNI(buf []byte) (string, error) {
+	/*
+		client hello
+		+------+--------+---------+--------+------------+---------------+-------------+------------+
+		| type | length | version | random | session id | cipher suites | compression | extensions |
+		+------+--------+---------+--------+------------+---------------+-------------+------------+
+		|  1   |   3    |    2    |   32   |  1 + Var   |    2 + Var    |   1 + Var   |  2 + Var   |
+		+------+--------+---------+--------+------------+---------------+-------------+------------+
+	*/
+	if len(buf) < 4 || buf[0] != 0x01 {
+		return "", errors.New("not client hello")
+	}
+	buf = buf[4:]
+	// version and random
+	if len(buf) < 34 {
+		return "", errors.New("client hello is too short")
+	}
+	buf = buf[34:]
+	// session id
+	if len(buf) < 1 || len(buf) < 1+int(buf[0]) {
+		return "", errors.New("session id is invalid")
+	}
+	buf = buf[1+int(buf[0]):]
+	// cipher suites
+	if len(buf) < 2 || len(buf) < 2+int(binary.BigEndian.Uint16(buf)) {
+		return "", errors.New("cipher suites is invalid")
+	}
+	buf = buf[2+int(binary.BigEndian.Uint16(buf)):]
+	// compression
+	if len(buf) < 1 || len(buf) < 1+int(buf[0]) {
+		return "", errors.New("compression is invalid")
+	}
+	buf = buf[1+int(buf[0]):]
+	// extensions
+	if len(buf) < 2 {
+		return "", errors.New("no extension")
+	}
+	extLen := int(binary.BigEndian.Uint16(buf))
+	buf = buf[2:]
+	if len(buf) < extLen {
+		return "", errors.New("extensions is invalid")
+	}
+	buf = buf[:extLen]
+	for len(buf) >= 4 {
+		typ := binary.BigEndian.Uint16(buf)
+		length := int(binary.BigEndian.Uint16(buf[2:]))
+		buf = buf[4:]
+		if len(buf) < length {
+			return "", errors.New("extension is invalid")
+		}
+		// server name extension, list length(2) + [name type(1) + name length(2) + name]
+		if typ == 0 {
+			data := buf[:length]
+			if len(data) < 2 {
+				return "", errors.New("server name is invalid")
+			}
+			data = data[2:]
+			for len(data) >= 3 {
+				nameLen := int(binary.BigEndian.Uint16(data[1:]))
+				if len(data) < 3+nameLen {
+					return "", errors.New("server name is invalid")
+				}
+				if data[0] == 0 {
+					return string(data[3 : 3+nameLen]), nil
+				}
+				data = data[3+nameLen:]
+			}
+		}
+		buf = buf[length:]
+	}
+	return "", errors.New("no server name")
+}
+
+// parse host header from http request header
+func parseHttpHost(header []byte) string {
+	lines := strings.Split(string(header), "\r\n")
+	// first line must be request line
+	if len(lines) < 2 || !strings.Contains(lines[0], " HTTP/") {
+		return ""
+	}
+	for _, line := range lines[1:] {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || !strings.EqualFold(strings.TrimSpace(kv[0]), "host") {
+			continue
+		}
+		host := strings.TrimSpace(kv[1])
+		// remove port
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		// ip is not domain
+		if net.ParseIP(host) != nil {
+			return ""
+		}
+		return host
+	}
+	return ""
+}
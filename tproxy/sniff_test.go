@@ -0,0 +1,58 @@
+package TProxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSniffConn(t *testing.T) {
+	// tls client hello
+	client, server := net.Pipe()
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: "www.example.com"})
+		_ = conn.Handshake()
+	}()
+	conn, domain := SniffConn(server, time.Second)
+	if domain != "www.example.com" {
+		t.Errorf("tls domain is %q, want %q", domain, "www.example.com")
+	}
+	// peeked data must be read again
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil || buf[0] != 0x16 {
+		t.Errorf("peeked data is not replayed, data: %v, err: %v", buf, err)
+	}
+	_ = client.Close()
+	_ = server.Close()
+
+	// http request
+	request := "GET / HTTP/1.1\r\nUser-Agent: test\r\nhost: www.example.com:8080\r\n\r\n"
+	client, server = net.Pipe()
+	go func() {
+		_, _ = client.Write([]byte(request))
+	}()
+	conn, domain = SniffConn(server, time.Second)
+	if domain != "www.example.com" {
+		t.Errorf("http domain is %q, want %q", domain, "www.example.com")
+	}
+	buf = make([]byte, len(request))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != request {
+		t.Errorf("peeked data is not replayed, data: %q, err: %v", buf, err)
+	}
+	_ = client.Close()
+	_ = server.Close()
+
+	// server first proto send nothing
+	client, server = net.Pipe()
+	begin := time.Now()
+	_, domain = SniffConn(server, 100*time.Millisecond)
+	if domain != "" || time.Since(begin) > time.Second {
+		t.Errorf("silent client sniff domain %q cost %v", domain, time.Since(begin))
+	}
+	_ = client.Close()
+	_ = server.Close()
+}
@@ -0,0 +1,463 @@
+package TProxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
+)
+
+const (
+	// max size of udp packet
+	udpBufSize = 65535
+	// idle time before udp session is closed
+	DefaultUdpTimeout = time.Minute
+	// packets wait in session while relay is hand shaking, packet is dropped when full
+	udpQueueSize = 128
+)
+
+// relay send and receive packet of any addr through one association
+type udpRelay interface {
+	WriteTo(buf []byte, addr net.Addr) (int, error)
+	ReadFrom(buf []byte) (int, net.Addr, error)
+	Close()
+}
+
+// session key, packets from the same source use the same session of proxy,
+// domain destination has its own session, so reply from resolved ip can be sent back as its fake ip
+type UdpSessionKey struct {
+	SrcAddr string
+	DstAddr string
+	Typ     ProtoTyp
+	Proxy   string
+}
+
+// udp session table, one association is reused by all destinations of source socket,
+// reply from any addr is sent back to source as full-cone nat
+/*
+	client:5000 -> 1.1.1.1:53   \                          / 1.1.1.1:53
+	                             session -> relay -> proxy
+	client:5000 -> 8.8.8.8:53   /                          \ 8.8.8.8:53
+	reply from 8.8.8.8:53 is sent to client:5000 by fake dial from 8.8.8.8:53
+*/
+type UdpSessionTable struct {
+	scope   define.Scope
+	timeout time.Duration
+
+	lock     sync.Mutex
+	sessions map[UdpSessionKey]*udpSession
+	stop     chan struct{}
+
+	// dial from original destination to source, transparent dial by default
+	dialLocal func(rAddr net.Addr, lAddr net.Addr) (net.Conn, error)
+	// create relay of session
+	newRelay func(typ ProtoTyp, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr) (udpRelay, error)
+}
+
+// create session table, idle session is closed after timeout
+func NewUdpSessionTable(scope define.Scope, timeout time.Duration) *UdpSessionTable {
+	if timeout <= 0 {
+		timeout = DefaultUdpTimeout
+	}
+	table := &UdpSessionTable{
+		scope:    scope,
+		timeout:  timeout,
+		sessions: make(map[UdpSessionKey]*udpSession),
+		stop:     make(chan struct{}),
+		dialLocal: func(rAddr net.Addr, lAddr net.Addr) (net.Conn, error) {
+			return com.MegaDial("udp", rAddr, lAddr)
+		},
+		newRelay: func(typ ProtoTyp, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr) (udpRelay, error) {
+			return newUdpRelay(typ, scope, proxy, lAddr, rAddr)
+		},
+	}
+	go table.expire(table.stop)
+	return table
+}
+
+// send packet of source to destination, realAddr is sent to proxy, which may be domain of fake ip
+func (t *UdpSessionTable) Send(typ ProtoTyp, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr, realAddr net.Addr, buf []byte) error {
+	key := UdpSessionKey{
+		SrcAddr: lAddr.String(),
+		Typ:     typ,
+		Proxy:   net.JoinHostPort(proxy.Server, strconv.Itoa(proxy.Port)),
+	}
+	if _, ok := realAddr.(*com.DomainAddr); ok {
+		key.DstAddr = realAddr.String()
+	}
+	t.lock.Lock()
+	if t.sessions == nil {
+		t.lock.Unlock()
+		return errors.New("udp session table is closed")
+	}
+	session, ok := t.sessions[key]
+	if !ok {
+		session = &udpSession{
+			table:   t,
+			key:     key,
+			typ:     typ,
+			proxy:   proxy,
+			lAddr:   lAddr,
+			queue:   make(chan udpPacket, udpQueueSize),
+			done:    make(chan struct{}),
+			dests:   make(map[string]net.Addr),
+			replies: make(map[string]net.Conn),
+		}
+		session.touch()
+		t.sessions[key] = session
+		logger.Debugf("[%s] create udp session, key: %v", t.scope, key)
+		go session.run()
+	}
+	t.lock.Unlock()
+	// packets are sent in order by session, hand shake dont block caller
+	return session.push(udpPacket{rAddr: rAddr, realAddr: realAddr, buf: buf})
+}
+
+// count of alive session
+func (t *UdpSessionTable) Count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.sessions)
+}
+
+// close all session and stop expire
+func (t *UdpSessionTable) Close() {
+	t.lock.Lock()
+	sessions := t.sessions
+	t.sessions = nil
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+	}
+	t.lock.Unlock()
+	for _, session := range sessions {
+		session.close()
+	}
+}
+
+// remove session from table and close
+func (t *UdpSessionTable) remove(session *udpSession) {
+	t.lock.Lock()
+	if t.sessions[session.key] == session {
+		delete(t.sessions, session.key)
+	}
+	t.lock.Unlock()
+	session.close()
+}
+
+// close idle session periodically
+func (t *UdpSessionTable) expire(stop chan struct{}) {
+	interval := t.timeout / 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		var idle []*udpSession
+		t.lock.Lock()
+		for key, session := range t.sessions {
+			if session.idle() > t.timeout {
+				delete(t.sessions, key)
+				idle = append(idle, session)
+			}
+		}
+		t.lock.Unlock()
+		for _, session := range idle {
+			logger.Debugf("[%s] udp session is idle, key: %v", t.scope, session.key)
+			session.close()
+		}
+	}
+}
+
+// association of one source socket
+type udpSession struct {
+	table *UdpSessionTable
+	key   UdpSessionKey
+	typ   ProtoTyp
+	proxy config.Proxy
+	lAddr net.Addr
+
+	// packets wait to be sent, relay is created by first packet
+	queue chan udpPacket
+	done  chan struct{}
+
+	lock   sync.Mutex
+	relay  udpRelay
+	active time.Time
+	closed bool
+	// addr sent to proxy -> original destination
+	dests map[string]net.Addr
+	// original destination -> fake dial conn to source
+	replies map[string]net.Conn
+}
+
+// packet wait in session, rAddr is original destination, realAddr is sent to proxy
+type udpPacket struct {
+	rAddr    net.Addr
+	realAddr net.Addr
+	buf      []byte
+}
+
+// queue packet, packet is dropped when queue is full as udp does
+func (s *udpSession) push(pkt udpPacket) error {
+	select {
+	case <-s.done:
+		return errors.New("udp session is closed")
+	default:
+	}
+	select {
+	case s.queue <- pkt:
+		return nil
+	default:
+		return fmt.Errorf("udp session queue is full, drop packet to %v", pkt.realAddr)
+	}
+}
+
+// send queued packets in order until session closed
+func (s *udpSession) run() {
+	defer s.table.remove(s)
+	for {
+		select {
+		case <-s.done:
+			return
+		case pkt := <-s.queue:
+			err := s.send(pkt)
+			if err != nil {
+				logger.Warningf("[%s] send udp packet failed, local [%s] -> remote [%s], err: %v", s.typ, s.lAddr, pkt.rAddr, err)
+				return
+			}
+		}
+	}
+}
+
+// send packet, relay is created when first send
+func (s *udpSession) send(pkt udpPacket) error {
+	if s.relay == nil {
+		relay, err := s.table.newRelay(s.typ, s.proxy, s.lAddr, pkt.realAddr)
+		if err != nil {
+			return err
+		}
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			relay.Close()
+			return errors.New("udp session is closed")
+		}
+		s.relay = relay
+		s.lock.Unlock()
+		go s.receive()
+	}
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return errors.New("udp session is closed")
+	}
+	s.dests[pkt.realAddr.String()] = pkt.rAddr
+	s.active = time.Now()
+	s.lock.Unlock()
+	_, err := s.relay.WriteTo(pkt.buf, pkt.realAddr)
+	return err
+}
+
+// send reply back to source until relay closed
+func (s *udpSession) receive() {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, from, err := s.relay.ReadFrom(buf)
+		if err != nil {
+			logger.Debugf("[%s] udp session stop receive, key: %v, reason: %v", s.typ, s.key, err)
+			break
+		}
+		s.touch()
+		conn, err := s.replyConn(from)
+		if err != nil {
+			logger.Debugf("[%s] udp session drop reply from %v, err: %v", s.typ, from, err)
+			continue
+		}
+		_, err = conn.Write(buf[:n])
+		if err != nil {
+			logger.Debugf("[%s] udp session write reply to %v failed, err: %v", s.typ, s.lAddr, err)
+		}
+	}
+	s.table.remove(s)
+}
+
+// conn to send reply from original destination, reply from unknown addr is full-cone
+func (s *udpSession) replyConn(from net.Addr) (net.Conn, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil, errors.New("udp session is closed")
+	}
+	rAddr := s.origin(from)
+	if rAddr == nil {
+		return nil, fmt.Errorf("reply addr %v is unknown", from)
+	}
+	conn, ok := s.replies[rAddr.String()]
+	if ok {
+		return conn, nil
+	}
+	conn, err := s.table.dialLocal(rAddr, s.lAddr)
+	if err != nil {
+		return nil, err
+	}
+	s.replies[rAddr.String()] = conn
+	return conn, nil
+}
+
+// original destination of reply source, proxy may reply ip of domain which is sent as fake ip,
+// session of domain has only one domain destination
+func (s *udpSession) origin(from net.Addr) net.Addr {
+	if from == nil {
+		return nil
+	}
+	if rAddr, ok := s.dests[from.String()]; ok {
+		return rAddr
+	}
+	udpAddr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	// domain sent with the same port
+	for sent, rAddr := range s.dests {
+		host, port, err := net.SplitHostPort(sent)
+		if err == nil && port == strconv.Itoa(udpAddr.Port) && net.ParseIP(host) == nil {
+			return rAddr
+		}
+	}
+	return udpAddr
+}
+
+// update active time
+func (s *udpSession) touch() {
+	s.lock.Lock()
+	s.active = time.Now()
+	s.lock.Unlock()
+}
+
+// time since last packet
+func (s *udpSession) idle() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return time.Since(s.active)
+}
+
+// close relay and reply conns
+func (s *udpSession) close() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	relay := s.relay
+	replies := s.replies
+	s.replies = nil
+	s.lock.Unlock()
+	// relay in hand shake is closed by run
+	if relay != nil {
+		relay.Close()
+	}
+	for _, conn := range replies {
+		_ = conn.Close()
+	}
+	logger.Debugf("[%s] udp session closed, key: %v", s.typ, s.key)
+}
+
+// create relay of proto
+func newUdpRelay(typ ProtoTyp, scope define.Scope, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr) (udpRelay, error) {
+	switch typ {
+	case NoneProto:
+		return newDirectUdpRelay()
+	case SOCK5UDP:
+		handler := NewUdpSock5Handler(scope, HandlerKey{}, proxy, lAddr, rAddr, nil)
+		err := handler.Tunnel()
+		if err != nil {
+			handler.Close()
+			return nil, err
+		}
+		return handler, nil
+	case SHADOWSOCKSUDP:
+		handler := NewUdpShadowsocksHandler(scope, HandlerKey{}, proxy, lAddr, rAddr, nil)
+		err := handler.Tunnel()
+		if err != nil {
+			handler.Close()
+			return nil, err
+		}
+		return handler, nil
+	case UOT:
+		handler := NewUdpOverTcpHandler(scope, HandlerKey{}, proxy, lAddr, rAddr, nil)
+		err := handler.Tunnel()
+		if err != nil {
+			handler.Close()
+			return nil, err
+		}
+		return handler, nil
+	}
+	return nil, fmt.Errorf("proto [%s] not support udp session", typ)
+}
+
+// send packet directly, domain is resolved and replied as domain
+type directUdpRelay struct {
+	conn *net.UDPConn
+
+	lock sync.Mutex
+	// resolved addr -> domain addr
+	domains map[string]net.Addr
+}
+
+func newDirectUdpRelay() (*directUdpRelay, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &directUdpRelay{
+		conn:    conn,
+		domains: make(map[string]net.Addr),
+	}, nil
+}
+
+func (r *directUdpRelay) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		var err error
+		udpAddr, err = net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			return 0, err
+		}
+		r.lock.Lock()
+		r.domains[udpAddr.String()] = addr
+		r.lock.Unlock()
+	}
+	return r.conn.WriteTo(buf, udpAddr)
+}
+
+func (r *directUdpRelay) ReadFrom(buf []byte) (int, net.Addr, error) {
+	n, addr, err := r.conn.ReadFrom(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if domain, ok := r.domains[addr.String()]; ok {
+		return n, domain, nil
+	}
+	return n, addr, nil
+}
+
+func (r *directUdpRelay) Close() {
+	_ = r.conn.Close()
+}
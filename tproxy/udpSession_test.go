@@ -0,0 +1,251 @@
+package TProxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	com "github.com/ArisAachen/deepin-network-proxy/com"
+	config "github.com/ArisAachen/deepin-network-proxy/config"
+	define "github.com/ArisAachen/deepin-network-proxy/define"
+)
+
+// echo udp server
+func startUdpEcho(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, udpBufSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestUdpSessionTable(t *testing.T) {
+	echo1, echo2 := startUdpEcho(t), startUdpEcho(t)
+	defer echo1.Close()
+	defer echo2.Close()
+	// client receive reply by fake dial
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	table := NewUdpSessionTable(define.App, 200*time.Millisecond)
+	defer table.Close()
+	var lock sync.Mutex
+	var dialed []string
+	table.dialLocal = func(rAddr net.Addr, lAddr net.Addr) (net.Conn, error) {
+		lock.Lock()
+		dialed = append(dialed, rAddr.String())
+		lock.Unlock()
+		return net.Dial("udp", lAddr.String())
+	}
+
+	lAddr := client.LocalAddr()
+	for _, echo := range []*net.UDPConn{echo1, echo2} {
+		rAddr := echo.LocalAddr()
+		err = table.Send(NoneProto, config.Proxy{}, lAddr, rAddr, rAddr, []byte(rAddr.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 512)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != rAddr.String() {
+			t.Errorf("reply is %q, want %q", buf[:n], rAddr.String())
+		}
+	}
+	// one session for all destinations, reply is sent from each destination
+	if count := table.Count(); count != 1 {
+		t.Errorf("session count is %d, want 1", count)
+	}
+	lock.Lock()
+	if len(dialed) != 2 || dialed[0] != echo1.LocalAddr().String() || dialed[1] != echo2.LocalAddr().String() {
+		t.Errorf("reply dialed from %v", dialed)
+	}
+	lock.Unlock()
+
+	// idle session is closed
+	time.Sleep(500 * time.Millisecond)
+	if count := table.Count(); count != 0 {
+		t.Errorf("idle session count is %d, want 0", count)
+	}
+}
+
+func TestUdpSessionOrigin(t *testing.T) {
+	fake := &net.UDPAddr{IP: net.IPv4(198, 18, 0, 1), Port: 443}
+	session := &udpSession{
+		dests: map[string]net.Addr{"example.com:443": fake},
+	}
+	// proxy reply resolved ip of domain
+	if addr := session.origin(&net.UDPAddr{IP: net.IPv4(93, 184, 216, 34), Port: 443}); addr != fake {
+		t.Errorf("origin of domain reply is %v, want %v", addr, fake)
+	}
+	// full-cone, unknown addr reply as itself
+	other := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	if addr := session.origin(other); addr.String() != other.String() {
+		t.Errorf("origin of unknown reply is %v, want %v", addr, other)
+	}
+}
+
+// relay stand-in, proxy resolve domain and reply from resolved ip
+type resolveUdpRelay struct {
+	resolved map[string]net.Addr
+	replies  chan udpReply
+	once     sync.Once
+	closed   chan struct{}
+}
+
+type udpReply struct {
+	data []byte
+	from net.Addr
+}
+
+func (r *resolveUdpRelay) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	from, ok := r.resolved[addr.String()]
+	if !ok {
+		from = addr
+	}
+	r.replies <- udpReply{data: append([]byte{}, buf...), from: from}
+	return len(buf), nil
+}
+
+func (r *resolveUdpRelay) ReadFrom(buf []byte) (int, net.Addr, error) {
+	select {
+	case reply := <-r.replies:
+		return copy(buf, reply.data), reply.from, nil
+	case <-r.closed:
+		return 0, nil, errors.New("relay is closed")
+	}
+}
+
+func (r *resolveUdpRelay) Close() {
+	r.once.Do(func() { close(r.closed) })
+}
+
+func TestUdpSessionDomains(t *testing.T) {
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	table := NewUdpSessionTable(define.App, time.Minute)
+	defer table.Close()
+	table.newRelay = func(typ ProtoTyp, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr) (udpRelay, error) {
+		return &resolveUdpRelay{
+			resolved: map[string]net.Addr{
+				"a.com:443": &net.UDPAddr{IP: net.IPv4(93, 184, 216, 1), Port: 443},
+				"b.com:443": &net.UDPAddr{IP: net.IPv4(93, 184, 216, 2), Port: 443},
+			},
+			replies: make(chan udpReply, 8),
+			closed:  make(chan struct{}),
+		}, nil
+	}
+	// reply conn of each fake ip, source port tell which fake ip reply is sent from
+	var lock sync.Mutex
+	dialed := make(map[string]string)
+	table.dialLocal = func(rAddr net.Addr, lAddr net.Addr) (net.Conn, error) {
+		conn, err := net.Dial("udp", lAddr.String())
+		if err == nil {
+			lock.Lock()
+			dialed[conn.LocalAddr().String()] = rAddr.String()
+			lock.Unlock()
+		}
+		return conn, err
+	}
+
+	fakeA := &net.UDPAddr{IP: net.IPv4(198, 18, 0, 1), Port: 443}
+	fakeB := &net.UDPAddr{IP: net.IPv4(198, 18, 0, 2), Port: 443}
+	dests := []struct {
+		rAddr    net.Addr
+		realAddr net.Addr
+	}{
+		{fakeA, com.NewDomainAddr("udp", "a.com", 443)},
+		{fakeB, com.NewDomainAddr("udp", "b.com", 443)},
+	}
+	lAddr := client.LocalAddr()
+	for i := 0; i < 4; i++ {
+		dest := dests[i%2]
+		err = table.Send(SOCK5UDP, config.Proxy{}, lAddr, dest.rAddr, dest.realAddr, []byte(dest.rAddr.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 512)
+		n, from, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lock.Lock()
+		origin := dialed[from.String()]
+		lock.Unlock()
+		// reply of a.com is sent from fake ip of a.com
+		if origin != string(buf[:n]) {
+			t.Errorf("reply of %s is sent from %s", buf[:n], origin)
+		}
+	}
+	if count := table.Count(); count != 2 {
+		t.Errorf("session count is %d, want 2", count)
+	}
+}
+
+func TestUdpSessionOrder(t *testing.T) {
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	table := NewUdpSessionTable(define.App, time.Minute)
+	defer table.Close()
+	// slow hand shake, packets wait in session
+	table.newRelay = func(typ ProtoTyp, proxy config.Proxy, lAddr net.Addr, rAddr net.Addr) (udpRelay, error) {
+		time.Sleep(200 * time.Millisecond)
+		return &resolveUdpRelay{
+			replies: make(chan udpReply, 16),
+			closed:  make(chan struct{}),
+		}, nil
+	}
+	table.dialLocal = func(rAddr net.Addr, lAddr net.Addr) (net.Conn, error) {
+		return net.Dial("udp", lAddr.String())
+	}
+
+	rAddr := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	lAddr := client.LocalAddr()
+	begin := time.Now()
+	for i := 0; i < 10; i++ {
+		err = table.Send(SOCK5UDP, config.Proxy{}, lAddr, rAddr, rAddr, []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cost := time.Since(begin); cost > 100*time.Millisecond {
+		t.Errorf("send is blocked by hand shake, cost: %v", cost)
+	}
+	// packets are sent in order after hand shake
+	for i := 0; i < 10; i++ {
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 512)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 || buf[0] != byte(i) {
+			t.Errorf("reply %d is %v", i, buf[:n])
+		}
+	}
+}